@@ -10,17 +10,23 @@ import (
 	"strings"
 	"time"
 
-	"github.com/serge-v/toolbox/common"
-
-	"github.com/milla-v/chat/config"
+	"github.com/milla-v/chat/mailer"
 )
 
-var cfg = config.Config
+func (f *Files) sendMail(m *mailer.Message) {
+	if f.Mail == nil {
+		log.Println("auth: mail is not configured")
+		return
+	}
+	if err := f.Mail.Send(m); err != nil {
+		log.Println("auth: cannot send mail:", err)
+	}
+}
 
 // AuthenticateHandler gets user, password, redirect parameters from request and logs in the user.
 // Response has Token session cookie.
 // If redirect=1 redirects to /index.html.
-func AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
+func (f *Files) AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
 	var user, password, redir string
 
 	if r.Method == "POST" {
@@ -42,7 +48,7 @@ func AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ua, err := login(user, password)
+	ua, err := f.login(user, password)
 	if err != nil {
 		http.Error(w, "auth: "+err.Error(), http.StatusUnauthorized)
 		return
@@ -66,7 +72,8 @@ func AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
 // Email has the link which should call the CreateHandler.
 // Administrator should accept the registration by forwarding the email to the user.
 // User should follow the link which calls CreateHandler which completes user registration.
-func RegisterHandler(w http.ResponseWriter, r *http.Request) {
+func (f *Files) RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := f.Config()
 	if r.Method != "POST" {
 		http.Error(w, "use POST method to submit user=USER&email=EMAIL", http.StatusMethodNotAllowed)
 		return
@@ -96,29 +103,27 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	registrationToken := base32.StdEncoding.EncodeToString([]byte(randomString))
 
 	fname := cfg.WorkDir + "reg-" + registrationToken + ".txt"
-	f, err := os.Create(fname)
+	rf, err := os.Create(fname)
 	if err != nil {
 		http.Error(w, "cannot open registration file", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
-	fmt.Fprintln(f, user, " ", email)
-	f.Close()
+	fmt.Fprintln(rf, user, " ", email)
+	rf.Close()
 
-	text := "To: chat@voilokov.com\n"
-	text += "Subject: chat account request\n\n"
-	text += "Re: " + user + " " + email + "\n\n"
+	text := "Re: " + user + " " + email + "\n\n"
 	text += "To create a new chat account clink the link below\n\n"
-	text += "https://" + cfg.Address + "/create?user=" + user + "&email=" + email + "&rt=" + registrationToken + "\n\n"
-	text += ".\n"
+	text += "https://" + cfg.Address + "/create?user=" + user + "&email=" + email + "&rt=" + registrationToken + "\n"
 
-	common.Sendmail(common.GetRcVar("MAILTO"), []byte(text))
+	f.sendMail(&mailer.Message{To: []string{cfg.Mail.Admin}, Subject: "chat account request", Body: text})
 	fmt.Fprintln(w, "You will receive a confirmation email from administrator.")
 }
 
 // CreateHandler checks if user, email and rt parameters match registration file and creates permanent
 // user profile. Redirects to AuthenticateHandler with user and password and redirect=1 parameters
-func CreateHandler(w http.ResponseWriter, r *http.Request) {
+func (f *Files) CreateHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := f.Config()
 	q := r.URL.Query()
 	user := q.Get("user")
 	email := q.Get("email")
@@ -168,16 +173,13 @@ func CreateHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(uf, user, password, email)
 	uf.Close()
 
-	text := "To: " + email + "\n"
-	text += "Subject: chat account created\n\n"
-	text += "Re: " + user + " " + email + "\n\n"
+	text := "Re: " + user + " " + email + "\n\n"
 	text += "Your account is created.\n\n"
 	text += "Your username is " + user + ".\n"
 	text += "Your password is " + password + ".\n\n"
 	text += "Follow this URL to log into chat:\n"
-	text += "https://" + cfg.Address + "/auth?user=" + user + "&password=" + password + "&redir=1\n\n"
-	text += ".\n"
-	common.Sendmail(common.GetRcVar("MAILTO"), []byte(text))
+	text += "https://" + cfg.Address + "/auth?user=" + user + "&password=" + password + "&redir=1\n"
+	f.sendMail(&mailer.Message{To: []string{email}, Subject: "chat account created", Body: text})
 
 	w.Header().Add("Content-Type", "text/html")
 	fmt.Fprintln(w, "User "+user+" created. Password is "+password+"<br><br>\nClick link to login with these credentials.<br><br>\n")
@@ -7,8 +7,13 @@ import (
 	"errors"
 	"io/ioutil"
 	"log"
+	"os"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/milla-v/chat/config"
+	"github.com/milla-v/chat/mailer"
 )
 
 // UserAuth is a authentication record
@@ -19,7 +24,14 @@ type UserAuth struct {
 	Token    string // session token
 }
 
-var list []*UserAuth
+// Files keeps user profiles, session tokens and registrations in files of the work directory.
+type Files struct {
+	Config func() *config.ServiceConfig // current service config
+	Mail   mailer.Mailer                // sends registration emails
+
+	mu   sync.Mutex
+	list []*UserAuth // logged in users
+}
 
 func generateRandomBytes(n int) ([]byte, error) {
 	b := make([]byte, n)
@@ -38,19 +50,21 @@ func generateRandomString(s int) (string, error) {
 
 // GetAuthUser finds authenticated user in the list by token.
 // TODO: Eventually should accept user id from cookie to minimize user lookup time.
-func GetAuthUser(token string) (user *UserAuth, err error) {
-	for _, ua := range list {
+func (f *Files) GetAuthUser(token string) (user *UserAuth, err error) {
+	f.mu.Lock()
+	for _, ua := range f.list {
 		if ua.Token == token {
-			user = ua
-			return
+			f.mu.Unlock()
+			return ua, nil
 		}
 	}
+	f.mu.Unlock()
 
-	ua, err := loadUserProfileByToken(token)
+	ua, err := f.loadUserProfileByToken(token)
 	return ua, err
 }
 
-func (ua *UserAuth) createToken() error {
+func (f *Files) createToken(ua *UserAuth) error {
 	var err error
 
 	ua.Token, err = generateRandomString(12)
@@ -59,7 +73,7 @@ func (ua *UserAuth) createToken() error {
 		return errors.New("cannot generate token: " + err.Error())
 	}
 
-	fname := cfg.WorkDir + "token-" + ua.Token + ".txt"
+	fname := f.Config().WorkDir + "token-" + ua.Token + ".txt"
 	dateb, _ := time.Now().UTC().MarshalText()
 	data := ua.Name + " " + string(dateb)
 
@@ -73,10 +87,10 @@ func (ua *UserAuth) createToken() error {
 	return nil
 }
 
-func loadUserProfileByToken(token string) (*UserAuth, error) {
+func (f *Files) loadUserProfileByToken(token string) (*UserAuth, error) {
 	var err error
 
-	fname := cfg.WorkDir + "token-" + token + ".txt"
+	fname := f.Config().WorkDir + "token-" + token + ".txt"
 	bytes, err := ioutil.ReadFile(fname)
 	if err != nil {
 		log.Println(err)
@@ -90,7 +104,7 @@ func loadUserProfileByToken(token string) (*UserAuth, error) {
 	}
 
 	name := fields[0]
-	fname = cfg.WorkDir + "user-" + name + ".txt"
+	fname = f.Config().WorkDir + "user-" + name + ".txt"
 	bytes, err = ioutil.ReadFile(fname)
 	if err != nil {
 		log.Println(err)
@@ -114,8 +128,8 @@ func loadUserProfileByToken(token string) (*UserAuth, error) {
 	return ua, nil
 }
 
-func loadUserProfileByCredentials(name, password string) (*UserAuth, error) {
-	fname := cfg.WorkDir + "user-" + name + ".txt"
+func (f *Files) loadUserProfileByCredentials(name, password string) (*UserAuth, error) {
+	fname := f.Config().WorkDir + "user-" + name + ".txt"
 	bytes, err := ioutil.ReadFile(fname)
 	if err != nil {
 		log.Println(err)
@@ -142,28 +156,66 @@ func loadUserProfileByCredentials(name, password string) (*UserAuth, error) {
 	return ua, nil
 }
 
-func login(name, password string) (*UserAuth, error) {
+// UserExists checks if the user profile exists.
+func (f *Files) UserExists(name string) bool {
+	if strings.ContainsAny(name, "/\\") {
+		return false
+	}
+	_, err := os.Stat(f.Config().WorkDir + "user-" + name + ".txt")
+	return err == nil
+}
+
+// UserEmail returns email from the user profile.
+func (f *Files) UserEmail(name string) (string, error) {
+	if strings.ContainsAny(name, "/\\") {
+		return "", errors.New("invalid user name: " + name)
+	}
+
+	bytes, err := ioutil.ReadFile(f.Config().WorkDir + "user-" + name + ".txt")
+	if err != nil {
+		return "", errors.New("user:" + name + ". cannot read user profile: " + err.Error())
+	}
+
+	fields := strings.Fields(string(bytes))
+	if len(fields) < 3 || name != fields[0] {
+		return "", errors.New("user:" + name + ". broken user profile")
+	}
+
+	return fields[2], nil
+}
+
+// Reload forgets cached users. Profiles are read again on the next lookup,
+// so changed profiles take effect and tokens of removed users stop working.
+func (f *Files) Reload() {
+	f.mu.Lock()
+	f.list = nil
+	f.mu.Unlock()
+}
+
+func (f *Files) login(name, password string) (*UserAuth, error) {
 	var err error
 	log.Println("login attempt. name:", name)
-	ua, err := loadUserProfileByCredentials(name, password)
+	ua, err := f.loadUserProfileByCredentials(name, password)
 	if err != nil {
 		log.Println(err)
 		return nil, errors.New("cannot load token: " + err.Error())
 	}
 
-	err = ua.createToken()
+	err = f.createToken(ua)
 	if err != nil {
 		log.Println(err)
 		return nil, errors.New("cannot create token: " + err.Error())
 	}
 
-	for idx, item := range list {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for idx, item := range f.list {
 		if item.Name == name {
-			list[idx] = ua
-			return list[idx], nil
+			f.list[idx] = ua
+			return ua, nil
 		}
 	}
 
-	list = append(list, ua)
+	f.list = append(f.list, ua)
 	return ua, nil
 }
@@ -5,8 +5,10 @@ package client
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"mime/multipart"
@@ -14,11 +16,14 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"golang.org/x/net/websocket"
 
+	"github.com/milla-v/chat/markdown"
 	"github.com/milla-v/chat/prot"
 )
 
@@ -50,10 +55,10 @@ func (c *Client) readWebsoket() (*prot.Envelope, error) {
 func (c *Client) processMessage(e prot.Envelope) {
 
 	if e.Message != nil {
-		fmt.Printf("%s %s%s%s %s\n",
-			e.Message.Ts.Format("15:04"),
-			"\x1b["+e.Message.ColorXterm256+"m", e.Message.Name, "\x1b[m",
-			e.Message.Text)
+		if mentioned(c.cfg.User, e.Message) {
+			fmt.Print("\x1b[1m@\x1b[22m")
+		}
+		printMessage(e.Message)
 
 		if e.Message.Notification != "" {
 			notify(e.Message.Name, e.Message.Notification)
@@ -69,11 +74,182 @@ func (c *Client) processMessage(e prot.Envelope) {
 		}
 	}
 
-	if e.Roster != nil && e.Roster.Text != c.prevRoster {
-		fmt.Printf("%s chatters online: %s\n",
-			e.Roster.Ts.Format("15:04"), e.Roster.Text)
-			c.prevRoster = e.Roster.Text
+	if e.Edit != nil {
+		fmt.Printf("%s %s edited [%d]: %s\n", e.Edit.Ts.Format("15:04"), e.Edit.Name, e.Edit.ID, e.Edit.Text)
+	}
+
+	if e.Delete != nil {
+		fmt.Printf("%s %s deleted [%d]\n", e.Delete.Ts.Format("15:04"), e.Delete.Name, e.Delete.ID)
+	}
+
+	if e.Reaction != nil {
+		action := "+"
+		if e.Reaction.Remove {
+			action = "-"
+		}
+		fmt.Printf("%s %s %s%s [%d] (%s)\n", e.Reaction.Ts.Format("15:04"), e.Reaction.Name,
+			action, e.Reaction.Emoji, e.Reaction.ID, reactionsText(e.Reaction.Reactions))
+	}
+
+	if e.Action != nil {
+		fmt.Printf("%s %s clicked %d [%d] => %s\n", e.Action.Ts.Format("15:04"), e.Action.Name,
+			e.Action.Click, e.Action.ID, e.Action.Result)
+	}
+
+	if e.Preview != nil {
+		printPreview(e.Preview)
+	}
+
+	if e.Typing != nil {
+		log.Println("typing:", e.Typing.Name)
+	}
+
+	if e.Unread != nil {
+		printUnread(e.Unread)
+	}
+
+	if e.Thread != nil {
+		log.Printf("thread %d: %d replies", e.Thread.ID, e.Thread.Replies)
+	}
+
+	if e.HistoryPage != nil {
+		printHistoryPage(e.HistoryPage)
+	}
+
+	if e.Roster != nil {
+		text := rosterText(e.Roster)
+		if e.Roster.Room+text != c.prevRoster {
+			fmt.Printf("%s %schatters online: %s\n",
+				e.Roster.Ts.Format("15:04"), roomPrefix(e.Roster.Room), text)
+			c.prevRoster = e.Roster.Room + text
+		}
+	}
+}
+
+// rosterText formats roster users like "milla, serge (idle, dnd: busy)".
+func rosterText(r *prot.Roster) string {
+	var list []string
+	for _, p := range r.Users {
+		var attrs []string
+		if p.State != prot.PresenceOnline {
+			attrs = append(attrs, p.State)
+		}
+		if p.DND {
+			attrs = append(attrs, "dnd")
+		}
+		if p.Status != "" {
+			attrs = append(attrs, p.Status)
+		}
+		s := p.Name
+		if len(attrs) > 0 {
+			s += " (" + strings.Join(attrs, ", ") + ")"
+		}
+		list = append(list, s)
+	}
+	return strings.Join(list, ", ")
+}
+
+func printMessage(m *prot.Message) {
+	to := ""
+	if m.To != "" {
+		to = " -> " + m.To
+	}
+	m.Text = markdown.ANSI(html.UnescapeString(m.Text))
+	if m.Deleted {
+		m.Text = "(deleted)"
+	} else if m.Edited {
+		m.Text += " (edited)"
+	}
+	if len(m.Reactions) > 0 {
+		m.Text += " (" + reactionsText(m.Reactions) + ")"
+	}
+	if m.Webhook {
+		to += " (bot)"
+	}
+	if m.Parent != 0 {
+		to += " ^" + strconv.FormatInt(m.Parent, 10)
+	}
+	for i, label := range m.Buttons {
+		m.Text += fmt.Sprintf(" [%d:%s]", i+1, label)
+	}
+	if m.Result != "" {
+		m.Text += " => " + m.Result
+	}
+	if m.Replies > 0 {
+		m.Text += fmt.Sprintf(" [%d: %d replies]", m.ID, m.Replies)
+	}
+	fmt.Printf("%s %s%s%s%s%s %s\n",
+		m.Ts.Format("15:04"),
+		roomPrefix(m.Room),
+		"\x1b["+m.ColorXterm256+"m", m.Name, "\x1b[m", to,
+		m.Text)
+	if m.Preview != nil {
+		printPreview(m.Preview)
+	}
+}
+
+func printPreview(p *prot.Preview) {
+	text := p.Title
+	if p.Description != "" {
+		text += " - " + p.Description
+	}
+	fmt.Printf("      [%d] %s <%s>\n", p.ID, text, p.URL)
+}
+
+// mentioned checks if the message mentions the user.
+func mentioned(user string, m *prot.Message) bool {
+	for _, name := range m.Mentions {
+		if name == user || name == prot.MentionAll || name == prot.MentionHere {
+			return m.Name != user
+		}
+	}
+	return false
+}
+
+// reactionsText returns compact text of reactions like "👍2 ❤1".
+func reactionsText(reactions map[string][]string) string {
+	var list []string
+	for emoji, names := range reactions {
+		list = append(list, emoji+strconv.Itoa(len(names)))
 	}
+	sort.Strings(list)
+	return strings.Join(list, " ")
+}
+
+func printHistoryPage(p *prot.HistoryPage) {
+	for _, m := range p.Messages {
+		printMessage(m)
+	}
+	if p.More && len(p.Messages) > 0 {
+		fmt.Printf("(more messages before %d)\n", p.Messages[0].ID)
+	}
+}
+
+func printUnread(u *prot.Unread) {
+	var list []string
+	for room, n := range u.Rooms {
+		if n > 0 {
+			list = append(list, fmt.Sprintf("#%s %d", room, n))
+		}
+	}
+	for name, n := range u.Private {
+		if n > 0 {
+			list = append(list, fmt.Sprintf("@%s %d", name, n))
+		}
+	}
+	if len(list) == 0 {
+		return
+	}
+	sort.Strings(list)
+	fmt.Printf("%s unread: %s\n", time.Now().Format("15:04"), strings.Join(list, ", "))
+}
+
+// roomPrefix returns "#room " for all rooms except the default one.
+func roomPrefix(room string) string {
+	if room == "" || room == "general" {
+		return ""
+	}
+	return "#" + room + " "
 }
 
 func (c *Client) newHTTPClient() *http.Client {
@@ -140,6 +316,14 @@ func (c *Client) connect() error {
 	}
 
 	log.Println("connected")
+
+	if c.cfg.Room != "" {
+		e := prot.Envelope{Message: &prot.Message{Text: "/join " + c.cfg.Room}}
+		if err = websocket.JSON.Send(c.ws, &e); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -207,13 +391,30 @@ func (c *Client) sendRequest(req *http.Request) error {
 	return nil
 }
 
+func (c *Client) roomQuery() string {
+	if c.cfg.Room == "" {
+		return ""
+	}
+	return "?room=" + url.QueryEscape(c.cfg.Room)
+}
+
 // SendText sends a plain text message to the chat.
 func (c *Client) SendText(message string) error {
+	return c.SendPrivateText("", message)
+}
+
+// SendPrivateText sends a plain text message to the user. If user is empty sends the message to the room.
+func (c *Client) SendPrivateText(user, message string) error {
 	log.Println("sending text")
 
 	r := strings.NewReader(message)
 
-	req, err := http.NewRequest("POST", "https://"+c.cfg.Address+"/m", r)
+	u := "https://" + c.cfg.Address + "/m" + c.roomQuery()
+	if user != "" {
+		u = "https://" + c.cfg.Address + "/m?to=" + url.QueryEscape(user)
+	}
+
+	req, err := http.NewRequest("POST", u, r)
 	if err != nil {
 		return err
 	}
@@ -248,7 +449,7 @@ func (c *Client) SendFile(fname string) error {
 	}
 	w.Close()
 
-	url := "https://" + c.cfg.Address + "/upload"
+	url := "https://" + c.cfg.Address + "/upload" + c.roomQuery()
 	log.Println("sending to", url)
 
 	req, err := http.NewRequest("POST", url, &body)
@@ -307,3 +508,170 @@ func (c *Client) DownloadFile(fname string) error {
 	return nil
 
 }
+
+// History gets a page of history messages with ids less than before.
+// If before is zero gets the latest messages. If user is not empty gets private conversation with the user.
+func (c *Client) History(user string, before int64, limit int) (*prot.HistoryPage, error) {
+	q := url.Values{}
+	if user != "" {
+		q.Set("to", user)
+	} else if c.cfg.Room != "" {
+		q.Set("room", c.cfg.Room)
+	}
+	if before > 0 {
+		q.Set("before", strconv.FormatInt(before, 10))
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+
+	url := "https://" + c.cfg.Address + "/api/history?" + q.Encode()
+	log.Println("get history", url)
+
+	var page prot.HistoryPage
+	if err := c.getJSON(url, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// PrintHistory prints a page of history messages to stdout.
+func (c *Client) PrintHistory(user string, before int64, limit int) error {
+	page, err := c.History(user, before, limit)
+	if err != nil {
+		return err
+	}
+	printHistoryPage(page)
+	return nil
+}
+
+func (c *Client) getJSON(url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		log.Println("cannot create request to ", url, err)
+		return err
+	}
+
+	token, err := c.login()
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Token", token)
+
+	client := c.newHTTPClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Println("get json:", err)
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(os.Stderr, resp.Body)
+		log.Println("http Status", resp.Status)
+		return errors.New("status: " + resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Search finds messages matching the query.
+func (c *Client) Search(query string) (*prot.SearchResult, error) {
+	q := url.Values{"q": {query}}
+	if c.cfg.Room != "" {
+		q.Set("room", c.cfg.Room)
+	}
+
+	url := "https://" + c.cfg.Address + "/api/search?" + q.Encode()
+	log.Println("search", url)
+
+	var res prot.SearchResult
+	if err := c.getJSON(url, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// PrintSearch prints messages matching the query to stdout.
+func (c *Client) PrintSearch(query string) error {
+	res, err := c.Search(query)
+	if err != nil {
+		return err
+	}
+
+	if len(res.Messages) == 0 {
+		fmt.Println("nothing found")
+		return nil
+	}
+
+	for _, m := range res.Messages {
+		fmt.Printf("%s [%d] %s%s: %s\n", m.Ts.Format("2006-01-02 15:04"), m.ID, roomPrefix(m.Room), m.Name, m.Text)
+	}
+	return nil
+}
+
+// Thread gets replies of the thread with parent message id.
+func (c *Client) Thread(id int64, limit int) (*prot.HistoryPage, error) {
+	q := url.Values{"parent": {strconv.FormatInt(id, 10)}}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+
+	url := "https://" + c.cfg.Address + "/api/history?" + q.Encode()
+	log.Println("get thread", url)
+
+	var page prot.HistoryPage
+	if err := c.getJSON(url, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// PrintThread prints thread replies to stdout.
+func (c *Client) PrintThread(id int64, limit int) error {
+	page, err := c.Thread(id, limit)
+	if err != nil {
+		return err
+	}
+	printHistoryPage(page)
+	return nil
+}
+
+// send sends the envelope over the websocket connection. It connects if the client
+// is not connected. Connection is kept for next envelopes until Close.
+func (c *Client) send(e *prot.Envelope) error {
+	if c.ws == nil {
+		if err := c.connect(); err != nil {
+			return err
+		}
+	}
+
+	if err := websocket.JSON.Send(c.ws, e); err != nil {
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+// Close closes the websocket connection.
+func (c *Client) Close() error {
+	if c.ws == nil {
+		return nil
+	}
+	err := c.ws.Close()
+	c.ws = nil
+	return err
+}
+
+// SendTyping notifies the room or the user that you are typing.
+// Indicator expires on the server in a few seconds.
+func (c *Client) SendTyping(user string) error {
+	return c.send(&prot.Envelope{Typing: &prot.Typing{Room: c.cfg.Room, To: user}})
+}
+
+// Click clicks the button number n of the message id.
+func (c *Client) Click(id int64, n int) error {
+	return c.send(&prot.Envelope{Action: &prot.Action{ID: id, Click: n}})
+}
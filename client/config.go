@@ -14,6 +14,7 @@ type Config struct {
 	Password      string `json:"password"`
 	Debug         bool   `json:"debug"`
 	SSLSkipVerify bool   `json:"ssl_skip_verify"`
+	Room          string `json:"room,omitempty"`
 	CacheDir      string `json:"-"`
 
 	configDir  string
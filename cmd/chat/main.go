@@ -2,39 +2,122 @@
 //
 // Usage:
 //
-//	chatd -http host:port
+//	chatd [-c config.json] [-http host:port] [-address host:port] [-workdir dir] [-mailadmin email] [-debug]
+//	chatd -g
+//	chatd -check
 //
 // Command runs standalone server from chat/service package.
 //
+// Config is layered: built-in defaults, then the JSON config file, then CHAT_*
+// environment variables (CHAT_WORK_DIR, CHAT_MAIL_SMTP_ADDR, ...), then flags.
+// Config file path is taken from -c flag or CHAT_CONFIG variable.
+//
+// -g prints the effective config as JSON with the mail password and webhook
+// secrets redacted. -check validates paths, permissions and addresses and
+// exits with non-zero status on problems.
+//
+// SIGTERM and SIGINT notify clients, flush history and stop the server.
+// SIGHUP reloads config, certificates, users and pages without disconnecting clients.
+//
 package main
 
 import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/NYTimes/logrotate"
+	"github.com/milla-v/chat/config"
 	"github.com/milla-v/chat/service"
 )
 
-var printConfig = flag.Bool("g", false, "Print config file")
+var configFile = flag.String("c", os.Getenv("CHAT_CONFIG"), "Config file")
+var printConfig = flag.Bool("g", false, "Print effective config")
+var checkConfig = flag.Bool("check", false, "Validate config and exit")
 var version = flag.Bool("version", false, "Print version")
 var daemon = flag.Bool("daemon", false, "Run as a daemon")
 
+var httpAddr = flag.String("http", "", "Listen address host:port")
+var address = flag.String("address", "", "Public address host:port used in links")
+var workDir = flag.String("workdir", "", "Work directory")
+var debug = flag.Bool("debug", false, "Debug logging")
+var mailAdmin = flag.String("mailadmin", "", "Recipient of account requests")
+
 // Version is set by linker
 var Version string
 
+// defaults is the built-in config. Reload starts from it so removed settings get default values.
+var defaults = config.Config.Clone()
+
+// loadConfig applies config file, environment and flags to cfg.
+func loadConfig(cfg *config.ServiceConfig) error {
+	if *configFile != "" {
+		if err := cfg.Load(*configFile); err != nil {
+			return err
+		}
+	}
+
+	if err := cfg.LoadEnv(os.Environ()); err != nil {
+		return err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "http":
+			cfg.HTTP = *httpAddr
+		case "address":
+			cfg.Address = *address
+		case "workdir":
+			cfg.WorkDir = *workDir
+		case "debug":
+			cfg.Debug = *debug
+		case "mailadmin":
+			cfg.Mail.Admin = *mailAdmin
+		}
+	})
+	return nil
+}
+
+// reloadConfig loads a new config from the defaults. config.Config is not changed.
+func reloadConfig() (*config.ServiceConfig, error) {
+	cfg := defaults.Clone()
+	if err := loadConfig(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
 func main() {
 	flag.Parse()
 	if *version {
 		fmt.Println("version:", Version)
 		return
 	}
-	flag.Parse()
-	if *version {
-		fmt.Println(Version)
+
+	if err := loadConfig(config.Config); err != nil {
+		log.Fatal(err)
+	}
+
+	if *printConfig {
+		if err := config.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
+
+	if *checkConfig {
+		errs := config.Check()
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("config is ok")
+		return
+	}
+
 	if *daemon {
 		logfile, err := logrotate.NewFile("/var/log/chat.log")
 		if err != nil {
@@ -44,5 +127,5 @@ func main() {
 		defer logfile.Close()
 	}
 
-	service.Run()
+	service.Run(service.Options{Reload: reloadConfig})
 }
@@ -7,6 +7,7 @@
 // The flags are:
 //	-c FILENAME -- specify config file
 //	-d          -- enable debug log
+//	-r ROOM     -- join ROOM and send messages there
 //
 // Command runs simple chat listener.
 //
@@ -18,13 +19,26 @@
 // Flags:
 //
 //	-t "TEXT"   -- Send plain text
+//	-to USER    -- Send the text as a private message to USER
+//	-typing     -- Notify the room or USER from -to that you are typing
+//	-click ID:N -- Click button N of the message ID
 //	-f FILENAME -- Send file as an attachment
 //	-d FILENAME -- Download file from chat
 //
+// Reading history
+//
+// Flags:
+//
+//	-history N  -- Print last N messages of the room or of the private conversation with -to USER
+//	-before ID  -- Print messages older than message ID
+//	-search Q   -- Print messages matching query Q
+//	-thread ID  -- Print replies of the thread started by message ID
+//
 package main
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -38,6 +52,14 @@ var sendFile = flag.String("f", "", "file to send to the chat")
 var getFile = flag.String("d", "", "download a file from chat")
 var sendText = flag.String("t", "", "text to send to the chat")
 var printConfig = flag.Bool("g", false, "print config")
+var sendTo = flag.String("to", "", "recipient of the private text")
+var historySize = flag.Int("history", 0, "print last N messages")
+var historyBefore = flag.Int64("before", 0, "print messages older than message ID")
+var searchQuery = flag.String("search", "", "search messages")
+var threadID = flag.Int64("thread", 0, "print replies of the thread")
+var sendTyping = flag.Bool("typing", false, "notify that you are typing")
+var clickButton = flag.String("click", "", "click button N of the message ID. Format: ID:N")
+var useRoom = flag.String("r", "", "room to join and send messages to")
 
 func main() {
 	flag.Parse()
@@ -60,15 +82,60 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
+	if *useRoom != "" {
+		cfg.Room = *useRoom
+	}
+
 	if *printConfig {
 		cfg.Print()
 		return
 	}
 
 	cli := client.NewClient(cfg)
+	defer cli.Close()
+
+	if *clickButton != "" {
+		var id int64
+		var n int
+		if _, err := fmt.Sscanf(*clickButton, "%d:%d", &id, &n); err != nil {
+			panic("invalid -click format. Use ID:N")
+		}
+		if err := cli.Click(id, n); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if *sendTyping {
+		if err := cli.SendTyping(*sendTo); err != nil {
+			panic(err)
+		}
+		return
+	}
 
 	if *sendText != "" {
-		if err := cli.SendText(*sendText); err != nil {
+		if err := cli.SendPrivateText(*sendTo, *sendText); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if *searchQuery != "" {
+		if err := cli.PrintSearch(*searchQuery); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if *threadID > 0 {
+		if err := cli.PrintThread(*threadID, *historySize); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if *historySize > 0 || *historyBefore > 0 {
+		if err := cli.PrintHistory(*sendTo, *historyBefore, *historySize); err != nil {
 			panic(err)
 		}
 		return
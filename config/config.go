@@ -7,10 +7,69 @@ import (
 
 // ServiceConfig is a chat service config.
 type ServiceConfig struct {
-	Address  string `json:"address"`
-	WorkDir  string `json:"work_dir"`
-	CertPath string
-	Debug    bool `json:"debug"`
+	Address         string   `json:"address"`   // public host[:port] used in links
+	HTTP            string   `json:"http"`      // listen address host:port
+	WorkDir         string   `json:"work_dir"`  // data directory
+	CertPath        string   `json:"cert_path"` // autocert cache directory
+	Debug           bool     `json:"debug"`
+	HistoryMaxCount int      `json:"history_max_count"` // max stored messages per room or private conversation
+	HistoryMaxDays  int      `json:"history_max_days"`  // max age of stored messages
+	Admins          []string `json:"admins"`            // users who can edit and delete any message
+
+	OutgoingWebhooks []OutgoingWebhook `json:"outgoing_webhooks"`
+
+	Previews            bool `json:"previews"`              // fetch link previews
+	PreviewAllowPrivate bool `json:"preview_allow_private"` // allow previews of private and loopback addresses
+
+	Mail MailConfig `json:"mail"`
+	TLS  TLSConfig  `json:"tls"`
+}
+
+// TLS modes.
+const (
+	TLSACME       = "acme"       // certificates from ACME directory cached in CertPath
+	TLSStatic     = "static"     // certificate and key files reloaded on change
+	TLSSelfSigned = "selfsigned" // certificate generated on first run in CertPath, for development
+	TLSOff        = "off"        // plain http behind a reverse proxy
+)
+
+// TLSConfig selects how the service gets certificates.
+type TLSConfig struct {
+	Mode           string   `json:"mode"`            // acme, static, selfsigned or off
+	Hosts          []string `json:"hosts"`           // acme host whitelist. Default is the host of Address
+	Directory      string   `json:"directory"`       // acme directory url. Default is Let's Encrypt
+	DirectoryCA    string   `json:"directory_ca"`    // PEM file with CA certificates trusted for the acme directory
+	Email          string   `json:"email"`           // acme account contact
+	CertFile       string   `json:"cert_file"`       // static certificate chain PEM file
+	KeyFile        string   `json:"key_file"`        // static private key PEM file
+	Redirect       string   `json:"redirect"`        // listen address of http to https redirect, for example ":80"
+	TrustedProxies []string `json:"trusted_proxies"` // IPs or CIDRs whose X-Forwarded-* headers are honoured in off mode
+}
+
+// MailConfig is outgoing mail config.
+type MailConfig struct {
+	Transport  string `json:"transport"`   // "smtp" or "maildir"
+	From       string `json:"from"`        // sender address
+	Admin      string `json:"admin"`       // recipient of account requests. No default
+	SMTPAddr   string `json:"smtp_addr"`   // smtp server host:port
+	Username   string `json:"username"`    // smtp AUTH username. Empty disables authentication
+	Password   string `json:"password"`    // smtp AUTH password
+	RequireTLS bool   `json:"require_tls"` // fail if smtp server does not support STARTTLS
+	Maildir    string `json:"maildir"`     // maildir transport directory. Default is WorkDir + "private/maildir/"
+}
+
+// OutgoingWebhook posts matching room messages to the URL. Message matches if it is posted
+// in one of Rooms and starts with one of Triggers or mentions @Name. If there are no Triggers
+// and Mention is false all messages in Rooms match.
+type OutgoingWebhook struct {
+	Name     string   `json:"name"`     // bot username for replies. At least 3 characters
+	URL      string   `json:"url"`      // receiver url
+	Secret   string   `json:"secret"`   // HMAC-SHA256 key for X-Chat-Signature header. See prot.WebhookRequest
+	Triggers []string `json:"triggers"` // trigger words
+	Rooms    []string `json:"rooms"`    // rooms to watch. Empty means all rooms
+	Mention  bool     `json:"mention"`  // trigger on @Name mention
+	Timeout  int      `json:"timeout"`  // request timeout in seconds. Default is 5
+	Retries  int      `json:"retries"`  // number of retries on error. Default is 0
 }
 
 func hostname() string {
@@ -21,6 +80,22 @@ func hostname() string {
 // Config is loaded config.
 var Config = &ServiceConfig{
 	Address:  "wet." + hostname() + ":8085",
+	HTTP:     ":8085",
 	WorkDir:  "/usr/local/www/wet/work/",
 	CertPath: "/usr/local/etc/letsencrypt/golang-autocert",
+
+	HistoryMaxCount: 10000,
+	HistoryMaxDays:  365,
+	Previews:        true,
+
+	Mail: MailConfig{
+		Transport: "smtp",
+		SMTPAddr:  "localhost:25",
+		From:      "chat@" + hostname(),
+	},
+
+	TLS: TLSConfig{
+		Mode:           TLSACME,
+		TrustedProxies: []string{"127.0.0.1", "::1"},
+	},
 }
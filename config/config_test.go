@@ -0,0 +1,81 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	defer func(c ServiceConfig) { *Config = c }(*Config)
+
+	dir, err := ioutil.TempDir("", "chatconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := dir + "/chat.json"
+	data := `{"address": "chat.example.com", "work_dir": "` + dir + `/", "http": ":9000", "mail": {"transport": "smtp", "smtp_addr": "mx:25"}}`
+	if err = ioutil.WriteFile(fname, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = Load(fname); err != nil {
+		t.Fatal(err)
+	}
+	if Config.Address != "chat.example.com" || Config.HTTP != ":9000" || Config.Mail.SMTPAddr != "mx:25" || Config.HistoryMaxDays != 365 {
+		t.Errorf("loaded config: %+v", Config)
+	}
+
+	env := []string{"CHAT_HTTP=:9001", "CHAT_ADMINS=alice, bob", "CHAT_DEBUG=1", "CHAT_MAIL_SMTP_ADDR=smtp.example.com:587", "HOME=/"}
+	if err = LoadEnv(env); err != nil {
+		t.Fatal(err)
+	}
+	if Config.HTTP != ":9001" || len(Config.Admins) != 2 || Config.Admins[1] != "bob" || !Config.Debug || Config.Mail.SMTPAddr != "smtp.example.com:587" {
+		t.Errorf("env config: %+v", Config)
+	}
+
+	if err = LoadEnv([]string{"CHAT_HISTORY_MAX_DAYS=x"}); err == nil {
+		t.Error("invalid int is accepted")
+	}
+
+	Config.CertPath = dir + "/certs"
+	Config.Mail.From = "chat@example.com"
+	Config.Mail.Admin = "admin@example.com"
+	if errs := Check(); len(errs) != 0 {
+		t.Errorf("check: %v", errs)
+	}
+
+	Config.HTTP = "9000"
+	Config.WorkDir = dir + "/missing/dir/"
+	Config.Mail.Transport = "pigeon"
+	if errs := Check(); len(errs) != 3 {
+		t.Errorf("check: %v", errs)
+	}
+
+	ioutil.WriteFile(fname, []byte(`{"adress": "typo"}`), 0600)
+	if err = Load(fname); err == nil {
+		t.Error("unknown field is accepted")
+	}
+}
+
+func TestPrint(t *testing.T) {
+	defer func(c ServiceConfig) { *Config = c }(*Config)
+
+	Config.Mail.Password = "mailpass"
+	Config.OutgoingWebhooks = []OutgoingWebhook{{Name: "bot", Secret: "hooksecret"}}
+
+	var buf bytes.Buffer
+	if err := Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); strings.Contains(out, "mailpass") || strings.Contains(out, "hooksecret") || strings.Count(out, redacted) != 2 {
+		t.Errorf("secrets are printed:\n%s", out)
+	}
+	if Config.Mail.Password != "mailpass" || Config.OutgoingWebhooks[0].Secret != "hooksecret" {
+		t.Error("config is changed")
+	}
+}
@@ -0,0 +1,322 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is a prefix of environment variables which override the config.
+// Variable name is the prefix and upper case json name, for example
+// CHAT_WORK_DIR or CHAT_MAIL_SMTP_ADDR. Lists are comma separated.
+const EnvPrefix = "CHAT_"
+
+// Load reads the JSON config file into Config. Fields missing in the file keep their values.
+func Load(path string) error {
+	return Config.Load(path)
+}
+
+// Load reads the JSON config file into c. Fields missing in the file keep their values.
+func (c *ServiceConfig) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(c); err != nil {
+		return fmt.Errorf("config: %s: %v", path, err)
+	}
+	return nil
+}
+
+// LoadEnv overrides Config with CHAT_* variables from the environment list in os.Environ format.
+func LoadEnv(environ []string) error {
+	return Config.LoadEnv(environ)
+}
+
+// LoadEnv overrides c with CHAT_* variables from the environment list in os.Environ format.
+func (c *ServiceConfig) LoadEnv(environ []string) error {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if n := strings.Index(kv, "="); n > 0 && strings.HasPrefix(kv, EnvPrefix) {
+			env[kv[:n]] = kv[n+1:]
+		}
+	}
+	return setEnv(reflect.ValueOf(c).Elem(), EnvPrefix, env)
+}
+
+func setEnv(v reflect.Value, prefix string, env map[string]string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		name = prefix + strings.ToUpper(name)
+		f := v.Field(i)
+
+		if f.Kind() == reflect.Struct {
+			if err := setEnv(f, name+"_", env); err != nil {
+				return err
+			}
+			continue
+		}
+
+		s, ok := env[name]
+		if !ok {
+			continue
+		}
+
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(s)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return fmt.Errorf("config: %s: %v", name, err)
+			}
+			f.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("config: %s: %v", name, err)
+			}
+			f.SetInt(int64(n))
+		case reflect.Slice:
+			if f.Type().Elem().Kind() != reflect.String {
+				return fmt.Errorf("config: %s cannot be set from the environment", name)
+			}
+			var list []string
+			for _, item := range strings.Split(s, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			f.Set(reflect.ValueOf(list))
+		}
+	}
+	return nil
+}
+
+// Clone returns a copy of c which does not share lists with c.
+func (c *ServiceConfig) Clone() *ServiceConfig {
+	cc := *c
+	cc.Admins = cloneList(c.Admins)
+	cc.TLS.Hosts = cloneList(c.TLS.Hosts)
+	cc.TLS.TrustedProxies = cloneList(c.TLS.TrustedProxies)
+	if c.OutgoingWebhooks != nil {
+		cc.OutgoingWebhooks = make([]OutgoingWebhook, len(c.OutgoingWebhooks))
+		for i, h := range c.OutgoingWebhooks {
+			h.Triggers = cloneList(h.Triggers)
+			h.Rooms = cloneList(h.Rooms)
+			cc.OutgoingWebhooks[i] = h
+		}
+	}
+	return &cc
+}
+
+func cloneList(list []string) []string {
+	if list == nil {
+		return nil
+	}
+	return append([]string{}, list...)
+}
+
+// redacted replaces passwords and secrets in the printed config.
+const redacted = "REDACTED"
+
+// Print writes Config as indented JSON which can be used as a config file.
+// Mail password and webhook secrets are replaced with REDACTED.
+func Print(w io.Writer) error {
+	c := Config.Clone()
+	if c.Mail.Password != "" {
+		c.Mail.Password = redacted
+	}
+	for i := range c.OutgoingWebhooks {
+		if c.OutgoingWebhooks[i].Secret != "" {
+			c.OutgoingWebhooks[i].Secret = redacted
+		}
+	}
+
+	data, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// checkDir checks that the directory exists or can be created, is writable and is not world writable.
+func checkDir(name, dir string) error {
+	if dir == "" {
+		return fmt.Errorf("%s is empty", name)
+	}
+
+	st, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		// will be created on start if the parent is writable
+		parent := filepath.Dir(filepath.Clean(dir))
+		if _, err = os.Stat(parent); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("%s: %s is not a directory", name, dir)
+	}
+	if st.Mode().Perm()&0002 != 0 {
+		return fmt.Errorf("%s: %s is world writable", name, dir)
+	}
+
+	f, err := ioutil.TempFile(dir, ".check")
+	if err != nil {
+		return fmt.Errorf("%s: %s is not writable: %v", name, dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// checkFile checks that the file exists and is readable.
+func checkFile(name, fname string) error {
+	if fname == "" {
+		return fmt.Errorf("%s is empty", name)
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	f.Close()
+	return nil
+}
+
+// checkHostPort checks host:port address. Host can be empty if allowEmptyHost is set.
+func checkHostPort(name, addr string, allowEmptyHost bool) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if host == "" && !allowEmptyHost {
+		return fmt.Errorf("%s: empty host in %q", name, addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("%s: invalid port in %q", name, addr)
+	}
+	return nil
+}
+
+// Check validates Config paths, permissions and addresses and returns all found problems.
+func Check() []error {
+	return Config.Check()
+}
+
+// Check validates c paths, permissions and addresses and returns all found problems.
+func (c *ServiceConfig) Check() []error {
+	var errs []error
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.Address == "" || strings.ContainsAny(c.Address, "/?# ") {
+		add(fmt.Errorf("address: invalid public address %q", c.Address))
+	} else if strings.Contains(c.Address, ":") {
+		add(checkHostPort("address", c.Address, false))
+	}
+	add(checkHostPort("http", c.HTTP, true))
+	add(checkDir("work_dir", c.WorkDir))
+	if !strings.HasSuffix(c.WorkDir, "/") {
+		add(fmt.Errorf("work_dir: %q must end with /", c.WorkDir))
+	}
+	add(checkDir("cert_path", c.CertPath))
+
+	if c.HistoryMaxCount < 0 {
+		add(fmt.Errorf("history_max_count: negative value %d", c.HistoryMaxCount))
+	}
+	if c.HistoryMaxDays < 0 {
+		add(fmt.Errorf("history_max_days: negative value %d", c.HistoryMaxDays))
+	}
+
+	for i, h := range c.OutgoingWebhooks {
+		name := fmt.Sprintf("outgoing_webhooks[%d]", i)
+		if len(h.Name) < 3 {
+			add(fmt.Errorf("%s: name %q is shorter than 3 characters", name, h.Name))
+		}
+		if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add(fmt.Errorf("%s: invalid url %q", name, h.URL))
+		}
+		if h.Timeout < 0 || h.Retries < 0 {
+			add(fmt.Errorf("%s: negative timeout or retries", name))
+		}
+	}
+
+	t := c.TLS
+	switch t.Mode {
+	case TLSACME:
+		if t.Directory != "" {
+			if u, err := url.Parse(t.Directory); err != nil || u.Scheme != "https" || u.Host == "" {
+				add(fmt.Errorf("tls.directory: invalid url %q", t.Directory))
+			}
+		}
+		if t.DirectoryCA != "" {
+			add(checkFile("tls.directory_ca", t.DirectoryCA))
+		}
+	case TLSStatic:
+		add(checkFile("tls.cert_file", t.CertFile))
+		add(checkFile("tls.key_file", t.KeyFile))
+		if st, err := os.Stat(t.KeyFile); err == nil && st.Mode().Perm()&0044 != 0 {
+			add(fmt.Errorf("tls.key_file: %s is readable by group or others", t.KeyFile))
+		}
+	case TLSSelfSigned:
+	case TLSOff:
+		if t.Redirect != "" {
+			add(fmt.Errorf("tls.redirect: redirect is not supported in off mode"))
+		}
+	default:
+		add(fmt.Errorf("tls.mode: unknown mode %q", t.Mode))
+	}
+	if t.Redirect != "" {
+		add(checkHostPort("tls.redirect", t.Redirect, true))
+	}
+	for _, p := range t.TrustedProxies {
+		if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+			add(fmt.Errorf("tls.trusted_proxies: invalid address %q", p))
+		}
+	}
+
+	m := c.Mail
+	switch m.Transport {
+	case "smtp", "":
+		add(checkHostPort("mail.smtp_addr", m.SMTPAddr, false))
+	case "maildir":
+		if m.Maildir != "" {
+			add(checkDir("mail.maildir", m.Maildir))
+		}
+	default:
+		add(fmt.Errorf("mail.transport: unknown transport %q", m.Transport))
+	}
+	if _, err := mail.ParseAddress(m.From); err != nil {
+		add(fmt.Errorf("mail.from: %v", err))
+	}
+	if _, err := mail.ParseAddress(m.Admin); err != nil {
+		add(fmt.Errorf("mail.admin: %v", err))
+	}
+
+	return errs
+}
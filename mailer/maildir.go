@@ -0,0 +1,34 @@
+package mailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Maildir delivers messages into the maildir directory. Used for development and tests.
+type Maildir struct {
+	Dir  string // maildir with tmp, new and cur subdirectories created on demand
+	From string // sender address
+}
+
+// Send implements Mailer.
+func (d *Maildir) Send(m *Message) error {
+	if err := m.Check(); err != nil {
+		return err
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(d.Dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	name := uniqueName()
+	tmp := filepath.Join(d.Dir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, m.Bytes(d.From), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(d.Dir, "new", name))
+}
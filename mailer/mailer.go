@@ -0,0 +1,83 @@
+// Package mailer implements outgoing email: SMTP and maildir transports
+// and a persistent queue which retries failed messages.
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Message is an outgoing plain text email.
+type Message struct {
+	To      []string `json:"to"`      // recipient addresses
+	Subject string   `json:"subject"` // subject in UTF-8
+	Body    string   `json:"body"`    // plain text body in UTF-8
+}
+
+// Mailer sends email messages.
+type Mailer interface {
+	Send(m *Message) error
+}
+
+var counter uint64 // unique id counter for message ids and file names
+
+// uniqueName returns unique name for message ids and files.
+func uniqueName() string {
+	host, _ := os.Hostname()
+	n := atomic.AddUint64(&counter, 1)
+	return fmt.Sprintf("%d.%d_%d.%s", time.Now().Unix(), os.Getpid(), n, strings.Replace(host, "/", "_", -1))
+}
+
+// Check validates recipient addresses.
+func (m *Message) Check() error {
+	if len(m.To) == 0 {
+		return errors.New("mailer: no recipients")
+	}
+	for _, to := range m.To {
+		if _, err := mail.ParseAddress(to); err != nil || strings.ContainsAny(to, "\r\n") {
+			return fmt.Errorf("mailer: invalid address %q", to)
+		}
+	}
+	return nil
+}
+
+// Bytes formats the message with headers and quoted-printable body.
+func (m *Message) Bytes(from string) []byte {
+	var b bytes.Buffer
+	subject := strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, m.Subject)
+
+	domain := "localhost"
+	if n := strings.LastIndex(from, "@"); n >= 0 {
+		domain = strings.Trim(from[n+1:], "> ")
+	}
+
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", uniqueName(), domain)
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&b, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	w := quotedprintable.NewWriter(&b)
+	body := strings.Replace(m.Body, "\r\n", "\n", -1)
+	w.Write([]byte(strings.Replace(body, "\n", "\r\n", -1)))
+	w.Close()
+	b.WriteString("\r\n")
+
+	return b.Bytes()
+}
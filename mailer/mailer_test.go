@@ -0,0 +1,196 @@
+package mailer
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBytes(t *testing.T) {
+	m := &Message{To: []string{"bob@example.com"}, Subject: "hi\r\nBcc: x@example.com", Body: "line 1\n.\nприв"}
+	s := string(m.Bytes("chat@example.com"))
+
+	for _, h := range []string{"From: chat@example.com\r\n", "To: bob@example.com\r\n", "Subject: hi  Bcc: x@example.com\r\n", "@example.com>\r\n"} {
+		if !strings.Contains(s, h) {
+			t.Errorf("no %q in:\n%s", h, s)
+		}
+	}
+	if strings.Contains(s, "\nBcc:") {
+		t.Errorf("header injection:\n%s", s)
+	}
+	if !strings.HasSuffix(s, "\r\n\r\nline 1\r\n.\r\n=D0=BF=D1=80=D0=B8=D0=B2\r\n") {
+		t.Errorf("body:\n%q", s)
+	}
+
+	if err := (&Message{To: []string{"bob@example.com\r\nx"}}).Check(); err == nil {
+		t.Error("invalid address is accepted")
+	}
+}
+
+func TestMaildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatmaildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &Maildir{Dir: dir, From: "chat@example.com"}
+	for i := 0; i < 2; i++ {
+		if err = d.Send(&Message{To: []string{"bob@example.com"}, Subject: "hi", Body: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "new", "*"))
+	if len(files) != 2 {
+		t.Fatalf("files: %v", files)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "tmp", "*")); len(tmp) != 0 {
+		t.Errorf("tmp files: %v", tmp)
+	}
+}
+
+type failMailer struct {
+	fails int
+	sent  []*Message
+}
+
+func (f *failMailer) Send(m *Message) error {
+	if f.fails > 0 {
+		f.fails--
+		return errors.New("temporary failure")
+	}
+	f.sent = append(f.sent, m)
+	return nil
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatmailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "failed"), 0700)
+
+	fm := &failMailer{fails: 2}
+	q := &Queue{dir: dir, mailer: fm, kick: make(chan struct{}, 1), done: make(chan struct{})}
+
+	if err = q.Send(&Message{To: []string{"bob@example.com"}, Subject: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Send(&Message{To: []string{"bad address"}}); err == nil {
+		t.Fatal("invalid message is queued")
+	}
+
+	now := time.Now()
+	q.deliver(now)
+	q.deliver(now)
+	if len(fm.sent) != 0 || fm.fails != 1 {
+		t.Fatal("message is retried before the delay")
+	}
+
+	q.deliver(now.Add(retryDelay))
+	q.deliver(now.Add(retryDelay * 4))
+	if len(fm.sent) != 1 || fm.sent[0].Subject != "hi" {
+		t.Fatalf("sent: %+v", fm.sent)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) != 0 {
+		t.Errorf("files after delivery: %v", files)
+	}
+
+	fm.fails = maxAttempts
+	q.Send(&Message{To: []string{"bob@example.com"}})
+	for i := 0; i < maxAttempts; i++ {
+		q.deliver(now.Add(maxRetryDelay * time.Duration(i+1)))
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "failed", "*.json")); len(files) != 1 {
+		t.Errorf("failed files: %v", files)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) != 0 {
+		t.Errorf("files after failure: %v", files)
+	}
+}
+
+// smtpServer accepts one session and returns received lines.
+func smtpServer(t *testing.T, ln net.Listener, lines chan<- string) {
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+	reply("220 test ESMTP")
+	data := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			close(lines)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines <- line
+
+		switch {
+		case data:
+			if line == "." {
+				data = false
+				reply("250 queued")
+			}
+		case strings.HasPrefix(line, "EHLO"):
+			reply("250-test\r\n250 AUTH PLAIN")
+		case strings.HasPrefix(line, "AUTH"):
+			reply("235 ok")
+		case line == "DATA":
+			data = true
+			reply("354 go ahead")
+		case line == "QUIT":
+			reply("221 bye")
+			close(lines)
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestSMTP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	lines := make(chan string, 100)
+	go smtpServer(t, ln, lines)
+
+	s := &SMTP{Addr: ln.Addr().String(), From: "chat@example.com", Username: "chat", Password: "secret"}
+	if err = s.Send(&Message{To: []string{"bob@example.com"}, Subject: "hi", Body: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var all []string
+	for line := range lines {
+		all = append(all, line)
+	}
+	session := strings.Join(all, "\n")
+	for _, cmd := range []string{"AUTH PLAIN AGNoYXQAc2VjcmV0", "MAIL FROM:<chat@example.com>", "RCPT TO:<bob@example.com>", "Subject: hi", "hello", "QUIT"} {
+		if !strings.Contains(session, cmd) {
+			t.Errorf("no %q in session:\n%s", cmd, session)
+		}
+	}
+
+	s.RequireTLS = true
+	go smtpServer(t, ln, make(chan string, 100))
+	if err = s.Send(&Message{To: []string{"bob@example.com"}}); err == nil {
+		t.Error("sent without required STARTTLS")
+	}
+}
@@ -0,0 +1,186 @@
+package mailer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxAttempts   = 10               // attempts before the message is moved to the failed directory
+	retryDelay    = time.Minute      // delay after the first failure. Doubles on each failure
+	maxRetryDelay = time.Hour * 6    // max delay between attempts
+	queueInterval = time.Second * 30 // how often the queue is checked for due messages
+)
+
+// queued is a message persisted in the queue directory.
+type queued struct {
+	Message  *Message  `json:"message"`
+	Attempts int       `json:"attempts"`
+	Next     time.Time `json:"next"`            // time of the next attempt
+	Error    string    `json:"error,omitempty"` // last error
+}
+
+// Queue is a persistent outbound queue. Send stores the message in the directory
+// and returns. The queue routine delivers stored messages through the Mailer
+// and retries failed deliveries with exponential backoff.
+type Queue struct {
+	dir    string
+	mailer Mailer
+	kick   chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+// NewQueue creates the queue in the directory and starts delivery of stored messages.
+func NewQueue(dir string, m Mailer) (*Queue, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "failed"), 0700); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		dir:    dir,
+		mailer: m,
+		kick:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	q.wg.Add(1)
+	go q.run()
+	q.wake()
+	return q, nil
+}
+
+// Send implements Mailer. The message is stored and delivered asynchronously.
+func (q *Queue) Send(m *Message) error {
+	if err := m.Check(); err != nil {
+		return err
+	}
+
+	name := uniqueName() + ".json"
+	if err := q.save(name, &queued{Message: m, Next: time.Now()}); err != nil {
+		return err
+	}
+
+	q.wake()
+	return nil
+}
+
+// Close stops the queue routine. Undelivered messages stay in the directory
+// and are sent by the next queue.
+func (q *Queue) Close() {
+	q.once.Do(func() { close(q.done) })
+	q.wg.Wait()
+}
+
+func (q *Queue) wake() {
+	select {
+	case q.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) save(name string, e *queued) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(q.dir, filepath.Dir(name), "."+filepath.Base(name))
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(q.dir, name))
+}
+
+func (q *Queue) run() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(queueInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-q.kick:
+		case <-ticker.C:
+		}
+		q.deliver(time.Now())
+	}
+}
+
+// deliver sends messages which are due.
+func (q *Queue) deliver(now time.Time) {
+	names, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		log.Println("mailer:", err)
+		return
+	}
+	sort.Strings(names)
+
+	for _, fname := range names {
+		select {
+		case <-q.done:
+			return
+		default:
+		}
+
+		name := filepath.Base(fname)
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		var e queued
+		data, err := ioutil.ReadFile(fname)
+		if err == nil {
+			err = json.Unmarshal(data, &e)
+		}
+		if err == nil && e.Message == nil {
+			err = os.ErrInvalid
+		}
+		if err != nil {
+			log.Println("mailer: cannot load", name+":", err)
+			os.Rename(fname, filepath.Join(q.dir, "failed", name))
+			continue
+		}
+
+		if now.Before(e.Next) {
+			continue
+		}
+
+		err = q.mailer.Send(e.Message)
+		if err == nil {
+			if err = os.Remove(fname); err != nil {
+				log.Println("mailer:", err)
+			}
+			continue
+		}
+
+		e.Attempts++
+		e.Error = err.Error()
+		log.Printf("mailer: attempt %d to %v failed: %v", e.Attempts, e.Message.To, err)
+
+		if e.Attempts >= maxAttempts {
+			name = filepath.Join("failed", name)
+			os.Remove(fname)
+		}
+
+		delay := retryDelay << uint(e.Attempts-1)
+		if delay > maxRetryDelay || delay <= 0 {
+			delay = maxRetryDelay
+		}
+		e.Next = now.Add(delay)
+
+		if err = q.save(name, &e); err != nil {
+			log.Println("mailer:", err)
+		}
+	}
+}
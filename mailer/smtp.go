@@ -0,0 +1,82 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+const smtpTimeout = time.Second * 30 // smtp session timeout
+
+// SMTP sends messages to the SMTP server. It uses STARTTLS when the server supports it
+// and authenticates with AUTH PLAIN when Username is set.
+type SMTP struct {
+	Addr       string // server host:port
+	From       string // sender address
+	Username   string // AUTH username. Empty disables authentication
+	Password   string // AUTH password
+	RequireTLS bool   // fail if the server does not support STARTTLS
+}
+
+// Send implements Mailer.
+func (s *SMTP) Send(m *Message) error {
+	if err := m.Check(); err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", s.Addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	} else if s.RequireTLS {
+		return errors.New("mailer: server does not support STARTTLS")
+	}
+
+	if s.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(s.From); err != nil {
+		return err
+	}
+	for _, to := range m.To {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(m.Bytes(s.From)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
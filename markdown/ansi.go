@@ -0,0 +1,104 @@
+package markdown
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// ANSI escape sequences used by the console renderer.
+const (
+	ansiBold      = "\x1b[1m"
+	ansiBoldOff   = "\x1b[22m"
+	ansiItalic    = "\x1b[3m"
+	ansiItalicOff = "\x1b[23m"
+	ansiUnder     = "\x1b[4m"
+	ansiUnderOff  = "\x1b[24m"
+	ansiCode      = "\x1b[36m"
+	ansiQuote     = "\x1b[90m"
+	ansiColorOff  = "\x1b[39m"
+)
+
+// ANSI renders the text for terminals. Control characters of the text are removed.
+func ANSI(text string) string {
+	return RenderANSI(Parse(text))
+}
+
+// RenderANSI renders the document with ANSI escapes.
+func RenderANSI(doc *Node) string {
+	var buf bytes.Buffer
+	renderANSIBlocks(&buf, doc.Children)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// stripControl removes control characters which can change terminal state.
+func stripControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' || r >= 0x7f && r < 0xa0 {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func renderANSIBlocks(buf *bytes.Buffer, blocks []*Node) {
+	for i, n := range blocks {
+		if i > 0 && n.Kind == Paragraph && blocks[i-1].Kind == Paragraph {
+			buf.WriteString("\n")
+		}
+
+		switch n.Kind {
+		case Paragraph:
+			renderANSIInline(buf, n.Children)
+			buf.WriteString("\n")
+		case CodeBlock:
+			for _, line := range strings.Split(n.Text, "\n") {
+				buf.WriteString("    " + ansiCode + stripControl(line) + ansiColorOff + "\n")
+			}
+		case Quote:
+			var quoted bytes.Buffer
+			renderANSIBlocks(&quoted, n.Children)
+			for _, line := range strings.Split(strings.TrimSuffix(quoted.String(), "\n"), "\n") {
+				buf.WriteString(ansiQuote + "|" + ansiColorOff + " " + line + "\n")
+			}
+		case List, OrderedList:
+			for j, item := range n.Children {
+				if n.Kind == List {
+					buf.WriteString("  * ")
+				} else {
+					buf.WriteString("  " + strconv.Itoa(n.Start+j) + ". ")
+				}
+				renderANSIInline(buf, item.Children)
+				buf.WriteString("\n")
+			}
+		}
+	}
+}
+
+func renderANSIInline(buf *bytes.Buffer, nodes []*Node) {
+	for _, n := range nodes {
+		switch n.Kind {
+		case Text:
+			buf.WriteString(stripControl(n.Text))
+		case Code:
+			buf.WriteString(ansiCode + stripControl(n.Text) + ansiColorOff)
+		case Bold:
+			buf.WriteString(ansiBold)
+			renderANSIInline(buf, n.Children)
+			buf.WriteString(ansiBoldOff)
+		case Italic:
+			buf.WriteString(ansiItalic)
+			renderANSIInline(buf, n.Children)
+			buf.WriteString(ansiItalicOff)
+		case Link:
+			buf.WriteString(ansiUnder)
+			renderANSIInline(buf, n.Children)
+			buf.WriteString(ansiUnderOff)
+			if PlainText(n.Children) != n.URL {
+				buf.WriteString(" <" + stripControl(n.URL) + ">")
+			}
+		case LineBreak:
+			buf.WriteString("\n")
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package markdown
+
+import (
+	"bytes"
+	"html"
+	"strconv"
+)
+
+// HTML renders the text to HTML. All text is escaped and only http, https and mailto links are allowed.
+func HTML(text string) string {
+	return RenderHTML(Parse(text))
+}
+
+// RenderHTML renders the document to HTML.
+func RenderHTML(doc *Node) string {
+	var buf bytes.Buffer
+	renderHTMLBlocks(&buf, doc.Children)
+	return buf.String()
+}
+
+func renderHTMLBlocks(buf *bytes.Buffer, blocks []*Node) {
+	for i, n := range blocks {
+		if i > 0 && n.Kind == Paragraph && blocks[i-1].Kind == Paragraph {
+			buf.WriteString("<br>\n<br>\n")
+		}
+
+		switch n.Kind {
+		case Paragraph:
+			renderHTMLInline(buf, n.Children)
+		case CodeBlock:
+			buf.WriteString("<pre><code")
+			if n.Lang != "" {
+				buf.WriteString(` class="language-` + html.EscapeString(n.Lang) + `"`)
+			}
+			buf.WriteString(">" + html.EscapeString(n.Text) + "</code></pre>\n")
+		case Quote:
+			buf.WriteString("<blockquote>")
+			renderHTMLBlocks(buf, n.Children)
+			buf.WriteString("</blockquote>\n")
+		case List, OrderedList:
+			tag := "ul"
+			if n.Kind == OrderedList {
+				tag = "ol"
+			}
+			buf.WriteString("<" + tag)
+			if n.Kind == OrderedList && n.Start != 1 {
+				buf.WriteString(` start="` + strconv.Itoa(n.Start) + `"`)
+			}
+			buf.WriteString(">\n")
+			for _, item := range n.Children {
+				buf.WriteString("<li>")
+				renderHTMLInline(buf, item.Children)
+				buf.WriteString("</li>\n")
+			}
+			buf.WriteString("</" + tag + ">\n")
+		}
+	}
+}
+
+func renderHTMLInline(buf *bytes.Buffer, nodes []*Node) {
+	for _, n := range nodes {
+		switch n.Kind {
+		case Text:
+			buf.WriteString(html.EscapeString(n.Text))
+		case Code:
+			buf.WriteString("<code>" + html.EscapeString(n.Text) + "</code>")
+		case Bold:
+			buf.WriteString("<b>")
+			renderHTMLInline(buf, n.Children)
+			buf.WriteString("</b>")
+		case Italic:
+			buf.WriteString("<i>")
+			renderHTMLInline(buf, n.Children)
+			buf.WriteString("</i>")
+		case Link:
+			buf.WriteString(`<a target="chaturls" rel="noopener noreferrer" href="` + html.EscapeString(n.URL) + `">`)
+			renderHTMLInline(buf, n.Children)
+			buf.WriteString("</a>")
+		case LineBreak:
+			buf.WriteString("<br>\n")
+		}
+	}
+}
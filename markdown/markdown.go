@@ -0,0 +1,345 @@
+// Package markdown implements a markdown subset used for chat messages.
+//
+// Supported syntax: **bold**, *italic*, `inline code`, fenced code blocks,
+// "- " and "1. " lists, "> " quotes, [text](url) links and bare http(s) urls.
+// Single newlines are preserved as line breaks.
+// Parsed document is rendered to sanitized HTML by HTML and to ANSI escapes by ANSI.
+package markdown
+
+import (
+	"bytes"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Kind is a node kind.
+type Kind int
+
+// Node kinds.
+const (
+	Document    Kind = iota // root node
+	Paragraph               // lines of inline nodes separated by LineBreak
+	CodeBlock               // fenced code block. Code is in Text
+	Quote                   // quoted blocks
+	List                    // unordered list of Item nodes
+	OrderedList             // ordered list of Item nodes
+	Item                    // list item with inline nodes
+	Text                    // plain text in Text
+	Bold                    // bold inline nodes
+	Italic                  // italic inline nodes
+	Code                    // inline code in Text
+	Link                    // link to URL with inline nodes
+	LineBreak               // line break inside a paragraph
+)
+
+// Node is a parsed document node.
+type Node struct {
+	Kind     Kind
+	Text     string  // text of Text, Code and CodeBlock nodes
+	URL      string  // Link url
+	Lang     string  // CodeBlock language
+	Start    int     // first OrderedList number
+	Children []*Node // child nodes
+}
+
+const maxDepth = 8 // max nesting of quotes and inline styles
+
+var (
+	orderedRe = regexp.MustCompile(`^(\d{1,9})[.)] `)
+	langRe    = regexp.MustCompile(`^[A-Za-z0-9_+-]+$`)
+)
+
+// Parse parses the text into the document tree.
+func Parse(text string) *Node {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	return &Node{Kind: Document, Children: parseBlocks(strings.Split(text, "\n"), 0)}
+}
+
+func isFence(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "```")
+}
+
+func isQuote(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), ">")
+}
+
+func unquote(line string) string {
+	line = strings.TrimPrefix(strings.TrimSpace(line), ">")
+	return strings.TrimPrefix(line, " ")
+}
+
+// listItem returns the list kind, first number and text of the list item line.
+func listItem(line string) (kind Kind, start int, text string, ok bool) {
+	line = strings.TrimSpace(line)
+	if len(line) > 2 && strings.IndexByte("-*+", line[0]) >= 0 && line[1] == ' ' {
+		return List, 0, strings.TrimSpace(line[2:]), true
+	}
+
+	if m := orderedRe.FindStringSubmatch(line); m != nil {
+		start, _ = strconv.Atoi(m[1])
+		return OrderedList, start, strings.TrimSpace(line[len(m[0]):]), true
+	}
+
+	return 0, 0, "", false
+}
+
+func parseBlocks(lines []string, depth int) []*Node {
+	var blocks []*Node
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		kind, start, _, isItem := listItem(line)
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case isFence(line):
+			lang := strings.TrimSpace(strings.TrimSpace(line)[3:])
+			if !langRe.MatchString(lang) {
+				lang = ""
+			}
+			var code []string
+			for i++; i < len(lines) && strings.TrimSpace(lines[i]) != "```"; i++ {
+				code = append(code, lines[i])
+			}
+			i++ // closing fence
+			blocks = append(blocks, &Node{Kind: CodeBlock, Lang: lang, Text: strings.Join(code, "\n")})
+
+		case isQuote(line) && depth < maxDepth:
+			var quoted []string
+			for ; i < len(lines) && isQuote(lines[i]); i++ {
+				quoted = append(quoted, unquote(lines[i]))
+			}
+			blocks = append(blocks, &Node{Kind: Quote, Children: parseBlocks(quoted, depth+1)})
+
+		case isItem:
+			list := &Node{Kind: kind, Start: start}
+			for ; i < len(lines); i++ {
+				k, _, text, ok := listItem(lines[i])
+				if !ok || k != kind {
+					break
+				}
+				list.Children = append(list.Children, &Node{Kind: Item, Children: parseInline(text, 0)})
+			}
+			blocks = append(blocks, list)
+
+		default:
+			p := &Node{Kind: Paragraph}
+			for ; i < len(lines); i++ {
+				line = lines[i]
+				_, _, _, isItem = listItem(line)
+				if strings.TrimSpace(line) == "" || len(p.Children) > 0 && (isFence(line) || isQuote(line) || isItem) {
+					break
+				}
+				if len(p.Children) > 0 {
+					p.Children = append(p.Children, &Node{Kind: LineBreak})
+				}
+				p.Children = append(p.Children, parseInline(strings.TrimSpace(line), 0)...)
+			}
+			blocks = append(blocks, p)
+		}
+	}
+	return blocks
+}
+
+func isWordByte(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= 0x80
+}
+
+// findCloser finds closing delimiter of the emphasis opened at s[:from].
+// Returns -1 if there is no closing delimiter.
+func findCloser(s string, from int, delim string) int {
+	for j := from + 1; j+len(delim) <= len(s); j++ {
+		if !strings.HasPrefix(s[j:], delim) || s[j-1] == ' ' {
+			continue
+		}
+		end := j + len(delim)
+		if len(delim) == 1 && (end < len(s) && s[end] == delim[0] || s[j-1] == delim[0]) {
+			// part of a double delimiter
+			continue
+		}
+		if delim[0] == '_' && end < len(s) && isWordByte(s[end]) {
+			continue
+		}
+		for len(delim) == 2 && end < len(s) && s[end] == delim[0] {
+			// "***" closes italic first
+			j++
+			end++
+		}
+		return j
+	}
+	return -1
+}
+
+// parseLink parses "[text](url)" at the start of s. Returns the link node and the link length.
+func parseLink(s string, depth int) (*Node, int) {
+	end := strings.Index(s, "](")
+	if end < 0 {
+		return nil, 0
+	}
+	close := strings.IndexByte(s[end+2:], ')')
+	if close < 0 {
+		return nil, 0
+	}
+
+	u := s[end+2 : end+2+close]
+	if !safeURL(u) {
+		return nil, 0
+	}
+
+	return &Node{Kind: Link, URL: u, Children: parseInline(s[1:end], depth+1)}, end + 3 + close
+}
+
+// autolinkLength returns length of the bare url at the start of s without trailing punctuation.
+func autolinkLength(s string) int {
+	n := strings.IndexFunc(s, unicode.IsSpace)
+	if n < 0 {
+		n = len(s)
+	}
+	for n > 0 && strings.IndexByte(".,:;!?'\")", s[n-1]) >= 0 {
+		if s[n-1] == ')' && strings.Count(s[:n], "(") >= strings.Count(s[:n], ")") {
+			break
+		}
+		n--
+	}
+	return n
+}
+
+// escapable are the characters which are taken literally after a backslash.
+const escapable = "\\`*_[]()<>#+-.!"
+
+// Escape adds backslashes before markdown characters, so the text is rendered as is.
+func Escape(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(escapable, s[i]) >= 0 {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+// safeURL allows only http, https and mailto urls.
+func safeURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return u.Opaque != ""
+	}
+	return false
+}
+
+// parseInline parses a line of text into inline nodes.
+func parseInline(s string, depth int) []*Node {
+	if depth > maxDepth {
+		return []*Node{{Kind: Text, Text: s}}
+	}
+
+	var nodes []*Node
+	var buf bytes.Buffer
+	flush := func() {
+		if buf.Len() > 0 {
+			nodes = append(nodes, &Node{Kind: Text, Text: buf.String()})
+			buf.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(escapable, s[i+1]) >= 0:
+			buf.WriteByte(s[i+1])
+			i += 2
+			continue
+
+		case c == '`':
+			if j := strings.IndexByte(s[i+1:], '`'); j > 0 {
+				flush()
+				nodes = append(nodes, &Node{Kind: Code, Text: s[i+1 : i+1+j]})
+				i += j + 2
+				continue
+			}
+
+		case c == '*' || c == '_':
+			delim := s[i : i+1]
+			kind := Italic
+			if strings.HasPrefix(s[i:], delim+delim) {
+				delim += delim
+				kind = Bold
+			}
+			from := i + len(delim)
+			opens := from < len(s) && s[from] != ' ' && (c == '*' || i == 0 || !isWordByte(s[i-1]))
+			if j := findCloser(s, from, delim); opens && j > 0 {
+				flush()
+				nodes = append(nodes, &Node{Kind: kind, Children: parseInline(s[from:j], depth+1)})
+				i = j + len(delim)
+				continue
+			}
+			buf.WriteString(delim)
+			i += len(delim)
+			continue
+
+		case c == '[':
+			if link, n := parseLink(s[i:], depth); link != nil {
+				flush()
+				nodes = append(nodes, link)
+				i += n
+				continue
+			}
+
+		case c == 'h' && (i == 0 || !isWordByte(s[i-1])) && (strings.HasPrefix(s[i:], "http://") || strings.HasPrefix(s[i:], "https://")):
+			if n := autolinkLength(s[i:]); safeURL(s[i : i+n]) {
+				flush()
+				u := s[i : i+n]
+				nodes = append(nodes, &Node{Kind: Link, URL: u, Children: []*Node{{Kind: Text, Text: u}}})
+				i += n
+				continue
+			}
+		}
+
+		_, size := utf8.DecodeRuneInString(s[i:])
+		buf.WriteString(s[i : i+size])
+		i += size
+	}
+
+	flush()
+	return nodes
+}
+
+// Links returns urls of the document links in the text order.
+func Links(n *Node) []string {
+	var list []string
+	if n.Kind == Link {
+		list = append(list, n.URL)
+	}
+	for _, c := range n.Children {
+		list = append(list, Links(c)...)
+	}
+	return list
+}
+
+// PlainText returns text of the inline nodes without formatting.
+func PlainText(nodes []*Node) string {
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		switch n.Kind {
+		case Text, Code:
+			buf.WriteString(n.Text)
+		case LineBreak:
+			buf.WriteByte('\n')
+		default:
+			buf.WriteString(PlainText(n.Children))
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,141 @@
+package markdown
+
+import (
+	"testing"
+)
+
+func TestHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		html string
+	}{
+		{"plain", "hello", "hello"},
+		{"escape", `<script>alert("x")</script> & more`, "&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; &amp; more"},
+		{"bold", "a **bold** b", "a <b>bold</b> b"},
+		{"bold underscore", "__bold__", "<b>bold</b>"},
+		{"italic", "an *italic* word", "an <i>italic</i> word"},
+		{"italic underscore", "_italic_", "<i>italic</i>"},
+		{"nested", "**bold *and italic***", "<b>bold <i>and italic</i></b>"},
+		{"snake case", "call some_func_name now", "call some_func_name now"},
+		{"unclosed", "2 * 3 = 6, **no", "2 * 3 = 6, **no"},
+		{"space after opener", "* not italic*", "<ul>\n<li>not italic*</li>\n</ul>\n"},
+		{"space before closer", "a *not italic *", "a *not italic *"},
+		{"code", "run `rm -rf *` **now**", "run <code>rm -rf *</code> <b>now</b>"},
+		{"code escape", "`<b>`", "<code>&lt;b&gt;</code>"},
+		{"empty code", "``", "``"},
+		{"backslash", `\*not italic\*`, "*not italic*"},
+		{"backslash other", `C:\dir`, `C:\dir`},
+		{"line break", "one\ntwo", "one<br>\ntwo"},
+		{"paragraphs", "one\n\ntwo", "one<br>\n<br>\ntwo"},
+		{"crlf", "one\r\ntwo", "one<br>\ntwo"},
+		{"autolink", "see https://example.com/a?b=1&c=2.", `see <a target="chaturls" rel="noopener noreferrer" href="https://example.com/a?b=1&amp;c=2">https://example.com/a?b=1&amp;c=2</a>.`},
+		{"autolink parens", "(https://example.com/x)", `(<a target="chaturls" rel="noopener noreferrer" href="https://example.com/x">https://example.com/x</a>)`},
+		{"autolink wiki", "https://en.wikipedia.org/wiki/Go_(language)", `<a target="chaturls" rel="noopener noreferrer" href="https://en.wikipedia.org/wiki/Go_(language)">https://en.wikipedia.org/wiki/Go_(language)</a>`},
+		{"no autolink in word", "xhttps://example.com", "xhttps://example.com"},
+		{"link", "[docs](https://example.com/docs)", `<a target="chaturls" rel="noopener noreferrer" href="https://example.com/docs">docs</a>`},
+		{"link bold", "[**docs**](http://example.com)", `<a target="chaturls" rel="noopener noreferrer" href="http://example.com"><b>docs</b></a>`},
+		{"link quote", `[x](https://example.com/"onmouseover="alert(1))`, `<a target="chaturls" rel="noopener noreferrer" href="https://example.com/&#34;onmouseover=&#34;alert(1">x</a>)`},
+		{"mailto", "[mail](mailto:a@example.com)", `<a target="chaturls" rel="noopener noreferrer" href="mailto:a@example.com">mail</a>`},
+		{"javascript link", "[x](javascript:alert(1))", "[x](javascript:alert(1))"},
+		{"data link", "[x](data:text/html,<b>)", "[x](data:text/html,&lt;b&gt;)"},
+		{"relative link", "[x](/etc/passwd)", "[x](/etc/passwd)"},
+		{"fence", "```go\nfmt.Println(\"<hi>\")\n```", "<pre><code class=\"language-go\">fmt.Println(&#34;&lt;hi&gt;&#34;)</code></pre>\n"},
+		{"fence bad lang", "```\"><script>\nx\n```", "<pre><code>x</code></pre>\n"},
+		{"fence keeps markdown", "```\n**a** *b*\n```", "<pre><code>**a** *b*</code></pre>\n"},
+		{"unclosed fence", "```\ncode", "<pre><code>code</code></pre>\n"},
+		{"fence after text", "look:\n```\nx\n```\ndone", "look:<pre><code>x</code></pre>\ndone"},
+		{"list", "- one\n- **two**\n* three", "<ul>\n<li>one</li>\n<li><b>two</b></li>\n<li>three</li>\n</ul>\n"},
+		{"ordered list", "3. three\n4) four", "<ol start=\"3\">\n<li>three</li>\n<li>four</li>\n</ol>\n"},
+		{"ordered list from one", "1. one", "<ol>\n<li>one</li>\n</ol>\n"},
+		{"list after text", "todo:\n- a", "todo:<ul>\n<li>a</li>\n</ul>\n"},
+		{"not a list", "-1 degrees", "-1 degrees"},
+		{"quote", "> quoted *text*\n> line two\nanswer", "<blockquote>quoted <i>text</i><br>\nline two</blockquote>\nanswer"},
+		{"nested quote", ">> deep\n> shallow", "<blockquote><blockquote>deep</blockquote>\nshallow</blockquote>\n"},
+		{"quote list", "> - a", "<blockquote><ul>\n<li>a</li>\n</ul>\n</blockquote>\n"},
+		{"russian", "*привет* **мир**", "<i>привет</i> <b>мир</b>"},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		if got := HTML(tt.text); got != tt.html {
+			t.Errorf("%s: %q\ngot:  %q\nwant: %q", tt.name, tt.text, got, tt.html)
+		}
+	}
+}
+
+func TestANSI(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		ansi string
+	}{
+		{"plain", "hello <b>", "hello <b>"},
+		{"bold", "**b**", "\x1b[1mb\x1b[22m"},
+		{"italic", "*i*", "\x1b[3mi\x1b[23m"},
+		{"code", "`x`", "\x1b[36mx\x1b[39m"},
+		{"autolink", "https://example.com", "\x1b[4mhttps://example.com\x1b[24m"},
+		{"link", "[docs](https://example.com)", "\x1b[4mdocs\x1b[24m <https://example.com>"},
+		{"paragraphs", "a\nb\n\nc", "a\nb\n\nc"},
+		{"fence", "```\na\n  b\n```", "    \x1b[36ma\x1b[39m\n    \x1b[36m  b\x1b[39m"},
+		{"list", "- a\n- b", "  * a\n  * b"},
+		{"ordered list", "2. a\n3. b", "  2. a\n  3. b"},
+		{"quote", "> a\n> b", "\x1b[90m|\x1b[39m a\n\x1b[90m|\x1b[39m b"},
+		{"control", "red\x1b[31m text\x07", "red[31m text"},
+		{"control in code", "```\n\x1b]0;title\x07\n```", "    \x1b[36m]0;title\x1b[39m"},
+	}
+
+	for _, tt := range tests {
+		if got := ANSI(tt.text); got != tt.ansi {
+			t.Errorf("%s: %q\ngot:  %q\nwant: %q", tt.name, tt.text, got, tt.ansi)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	doc := Parse("**a** `b`\n\n1. c\n```sh\nd\n```")
+	if len(doc.Children) != 3 {
+		t.Fatalf("blocks: %d", len(doc.Children))
+	}
+
+	p := doc.Children[0]
+	if p.Kind != Paragraph || len(p.Children) != 3 || p.Children[0].Kind != Bold || p.Children[2].Kind != Code {
+		t.Errorf("paragraph: %+v", p.Children)
+	}
+
+	if l := doc.Children[1]; l.Kind != OrderedList || l.Start != 1 || len(l.Children) != 1 {
+		t.Errorf("list: %+v", l)
+	}
+
+	if c := doc.Children[2]; c.Kind != CodeBlock || c.Lang != "sh" || c.Text != "d" {
+		t.Errorf("code: %+v", c)
+	}
+
+	if s := PlainText(p.Children); s != "a b" {
+		t.Errorf("plain text: %q", s)
+	}
+}
+
+func TestDeepNesting(t *testing.T) {
+	text := ""
+	for i := 0; i < 100; i++ {
+		text += ">"
+	}
+	text += " x"
+	if got := HTML(text); got == "" {
+		t.Error("empty html")
+	}
+
+	text = ""
+	for i := 0; i < 100; i++ {
+		text += "*a "
+	}
+	HTML(text)
+}
+
+func TestEscape(t *testing.T) {
+	text := "- 1. *a* _b_ `c` [d](http://example.com) \\"
+	if got := HTML(Escape(text)); got != "- 1. *a* _b_ `c` [d](http://example.com) \\" {
+		t.Errorf("escaped text: %s", got)
+	}
+}
@@ -6,7 +6,7 @@ VERSION=$(git describe --long --tags)
 DATE=$(date +%Y-%m-%dT%H:%M:%S%z)
 
 # build for cloud server
-GOOS=freebsd GOARCH=amd64 go build -ldflags "-X github.com/milla-v/chat/service.version=$VERSION -X github.com/milla-v/chat/service.date=$DATE" -o chatd-freebsd github.com/milla-v/chat/cmd/chatd
+GOOS=freebsd GOARCH=amd64 go build -ldflags "-X github.com/milla-v/chat/service.version=$VERSION -X github.com/milla-v/chat/service.date=$DATE" -o chatd-freebsd github.com/milla-v/chat/cmd/chat
 
 # create destination directory structure
 rm -rf dist~
@@ -22,8 +22,8 @@ cp chatd dist~/root/usr/local/etc/rc.d/
 #cp server.key dist~/root/usr/local/www/wet/
 #cp server.pem dist~/root/usr/local/www/wet/
 
-# prepare init script
-echo service chatd restart > dist~/root/usr/local/lib/chat.tar.gz-configure.sh
+# prepare init script. Upgrade passes the listener and clients to the new binary without restart.
+echo service chatd upgrade > dist~/root/usr/local/lib/chat.tar.gz-configure.sh
 echo echo == done == >> dist~/root/usr/local/lib/chat.tar.gz-configure.sh
 chmod +x dist~/root/usr/local/lib/chat.tar.gz-configure.sh
 
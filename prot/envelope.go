@@ -14,25 +14,196 @@ type Ping struct {
 
 // Message is a conversation message
 type Message struct {
-	Ts            time.Time `json:"ts"`             // timestamp
-	Name          string    `json:"name"`           // username
-	Text          string    `json:"text"`           // plain text for console clients
-	HTML          string    `json:"html"`           // html text for browsers
-	Notification  string    `json:"notification"`   // plain notification for browsers
-	Color         string    `json:"color"`          // RGB color
-	ColorXterm256 string    `json:"color_xterm256"` // xterm color number suitable for \033[%sm formatting
+	ID            int64     `json:"id,omitempty"`      // server assigned message id
+	Ts            time.Time `json:"ts"`                // timestamp
+	Room          string    `json:"room"`              // room name
+	Name          string    `json:"name"`              // username
+	To            string    `json:"to,omitempty"`      // recipient username for private messages
+	Text          string    `json:"text"`              // plain text for console clients
+	HTML          string    `json:"html"`              // html text for browsers
+	Notification  string    `json:"notification"`      // plain notification for browsers
+	Color         string    `json:"color"`             // RGB color
+	ColorXterm256 string    `json:"color_xterm256"`    // xterm color number suitable for \033[%sm formatting
+	Edited        bool      `json:"edited,omitempty"`  // message text was edited
+	Deleted       bool      `json:"deleted,omitempty"` // message was deleted
+
+	Reactions map[string][]string `json:"reactions,omitempty"` // usernames by reaction emoji
+
+	Parent    int64      `json:"parent,omitempty"`     // parent message id for thread replies
+	Replies   int        `json:"replies,omitempty"`    // number of thread replies
+	LastReply *time.Time `json:"last_reply,omitempty"` // time of the latest thread reply
+
+	Buttons []string `json:"buttons,omitempty"` // labels of interactive buttons
+	Bot     string   `json:"bot,omitempty"`     // name of the action handler which handles button clicks
+	Result  string   `json:"result,omitempty"`  // text of the latest action result
+	Webhook bool     `json:"webhook,omitempty"` // message is posted by a webhook bot
+
+	Preview *Preview `json:"preview,omitempty"` // preview of the first message link
+
+	Mentions []string `json:"mentions,omitempty"` // mentioned usernames, "all" or "here"
+}
+
+// Mention names which address several users.
+const (
+	MentionAll  = "all"  // all room users
+	MentionHere = "here" // online room users
+)
+
+// Inbox is a list of messages which mention the user, newest first.
+type Inbox struct {
+	Name     string     `json:"name"`     // username
+	Messages []*Message `json:"messages"` // messages
+}
+
+// Preview is a preview of the first link of the message. Server sends it
+// after the message when the linked page is fetched.
+type Preview struct {
+	ID          int64     `json:"id"`                    // message id
+	Ts          time.Time `json:"ts"`                    // fetch time
+	URL         string    `json:"url"`                   // link url
+	Title       string    `json:"title,omitempty"`       // page title
+	Description string    `json:"description,omitempty"` // page description
+	Image       string    `json:"image,omitempty"`       // image url
+	SiteName    string    `json:"site_name,omitempty"`   // site name
+	HTML        string    `json:"html"`                  // html preview for browsers
+}
+
+// Action is a click on the message button. Client sends ID and Click.
+// Server broadcasts the action with the result to the message recipients.
+type Action struct {
+	ID     int64     `json:"id"`               // message id
+	Click  int       `json:"click"`            // clicked button number starting from 1
+	Ts     time.Time `json:"ts"`               // click timestamp, set by server
+	Name   string    `json:"name,omitempty"`   // username who clicked, set by server
+	Result string    `json:"result,omitempty"` // action result text, set by server
+}
+
+// ThreadSummary is sent when a reply is added to the thread.
+type ThreadSummary struct {
+	ID        int64     `json:"id"`         // thread parent message id
+	Replies   int       `json:"replies"`    // number of replies
+	LastReply time.Time `json:"last_reply"` // time of the latest reply
+}
+
+// Edit replaces the text of the message. Only the author or an admin can edit the message.
+type Edit struct {
+	ID   int64     `json:"id"`             // message id
+	Ts   time.Time `json:"ts"`             // edit timestamp, set by server
+	Name string    `json:"name,omitempty"` // editor username, set by server
+	Text string    `json:"text"`           // new plain text
+	HTML string    `json:"html,omitempty"` // new html text, set by server
+}
+
+// Reaction adds or removes user reaction to the message.
+type Reaction struct {
+	ID     int64     `json:"id"`               // message id
+	Ts     time.Time `json:"ts"`               // reaction timestamp, set by server
+	Name   string    `json:"name,omitempty"`   // username, set by server
+	Emoji  string    `json:"emoji"`            // reaction emoji
+	Remove bool      `json:"remove,omitempty"` // remove reaction instead of adding
+
+	Reactions map[string][]string `json:"reactions,omitempty"` // all message reactions after update, set by server
 }
 
-// Roster is a list of online users
+// Delete replaces the message with a tombstone. Only the author or an admin can delete the message.
+type Delete struct {
+	ID   int64     `json:"id"`             // message id
+	Ts   time.Time `json:"ts"`             // delete timestamp, set by server
+	Name string    `json:"name,omitempty"` // username who deleted the message, set by server
+	HTML string    `json:"html,omitempty"` // tombstone html text, set by server
+}
+
+// Presence states
+const (
+	PresenceOnline  = "online"  // connected and recently active
+	PresenceIdle    = "idle"    // connected but not active for a while
+	PresenceAway    = "away"    // connected but not active for a long time or not responding to pings
+	PresenceOffline = "offline" // not connected
+)
+
+// Presence is a user presence. Client sends Presence to set status text and do not disturb mode.
+type Presence struct {
+	Name       string    `json:"name,omitempty"`        // username, set by server
+	State      string    `json:"state,omitempty"`       // one of Presence* constants, set by server
+	Status     string    `json:"status,omitempty"`      // user status text
+	DND        bool      `json:"dnd,omitempty"`         // do not disturb. Notifications are not sent
+	LastActive time.Time `json:"last_active,omitempty"` // time of the last user activity, set by server
+}
+
+// Roster is a list of room users with their presence
 type Roster struct {
-	Ts   time.Time `json:"ts"`   // timestamp
-	Text string    `json:"text"` // plain text for console clients
-	HTML string    `json:"html"` // html text for browsers
+	Ts    time.Time   `json:"ts"`    // timestamp
+	Room  string      `json:"room"`  // room name
+	Rooms []string    `json:"rooms"` // rooms joined by the client
+	Users []*Presence `json:"users"` // room users sorted by name
+}
+
+// HistoryRequest is a request for a page of history. If Before and After are zero
+// requests the latest messages.
+type HistoryRequest struct {
+	Room   string `json:"room,omitempty"`   // room name
+	To     string `json:"to,omitempty"`     // user name for private conversation history
+	Before int64  `json:"before,omitempty"` // get messages with id less than Before
+	After  int64  `json:"after,omitempty"`  // get messages with id greater than After
+	Limit  int    `json:"limit,omitempty"`  // max number of messages
+	Parent int64  `json:"parent,omitempty"` // get replies of the thread instead of the room messages
+}
+
+// HistoryPage is a page of history messages in ascending id order.
+type HistoryPage struct {
+	Room     string     `json:"room,omitempty"`   // room name
+	To       string     `json:"to,omitempty"`     // user name for private conversation history
+	Parent   int64      `json:"parent,omitempty"` // thread parent message id
+	Messages []*Message `json:"messages"`         // messages
+	More     bool       `json:"more"`             // more messages exist in the requested direction
+}
+
+// SearchResult is a list of messages found by the query. Latest messages go first.
+type SearchResult struct {
+	Query    string     `json:"query"`    // search query
+	Messages []*Message `json:"messages"` // found messages
+}
+
+// MarkRead marks messages of the room or of the private conversation as read up to message ID.
+type MarkRead struct {
+	Room string `json:"room,omitempty"` // room name
+	To   string `json:"to,omitempty"`   // user name for private conversation
+	ID   int64  `json:"id"`             // last read message id
+}
+
+// Unread has unread message counts of the user. Sent on connect and after read markers change.
+type Unread struct {
+	Rooms    map[string]int   `json:"rooms"`     // unread counts by room name
+	Private  map[string]int   `json:"private"`   // unread counts by private conversation user name
+	LastRead map[string]int64 `json:"last_read"` // last read message id by room name or "@user"
+}
+
+// Typing notifies room members or the private conversation peer that the user is typing.
+// Typing is not stored in history.
+type Typing struct {
+	Room    string    `json:"room,omitempty"`    // room name
+	To      string    `json:"to,omitempty"`      // user name for private conversation
+	Name    string    `json:"name,omitempty"`    // typing username, set by server
+	Expires time.Time `json:"expires,omitempty"` // indicator expiration time, set by server
 }
 
 // Envelope is a top level communication structure. Includes all another submessages.
 type Envelope struct {
+	Room    string   `json:"room,omitempty"`    // room name. Empty means the current room of the client
 	Message *Message `json:"message,omitempty"` // conversation message
 	Ping    *Ping    `json:"ping,omitempty"`    // ping message
 	Roster  *Roster  `json:"roster,omitempty"`  // roster (list of users) message
+
+	HistoryRequest *HistoryRequest `json:"history_request,omitempty"` // request for a history page
+	HistoryPage    *HistoryPage    `json:"history_page,omitempty"`    // history page
+	Edit           *Edit           `json:"edit,omitempty"`            // message edit
+	Delete         *Delete         `json:"delete,omitempty"`          // message delete
+	Reaction       *Reaction       `json:"reaction,omitempty"`        // message reaction
+	Thread         *ThreadSummary  `json:"thread,omitempty"`          // thread summary update
+	MarkRead       *MarkRead       `json:"mark_read,omitempty"`       // read marker update
+	Unread         *Unread         `json:"unread,omitempty"`          // unread counts
+	Typing         *Typing         `json:"typing,omitempty"`          // typing indicator
+	Presence       *Presence       `json:"presence,omitempty"`        // user status update
+	Action         *Action         `json:"action,omitempty"`          // message button click
+	Preview        *Preview        `json:"preview,omitempty"`         // message link preview
 }
@@ -0,0 +1,32 @@
+package prot
+
+import (
+	"time"
+)
+
+// WebhookReplayWindow is max age of the X-Chat-Timestamp of accepted webhook requests.
+const WebhookReplayWindow = 5 * time.Minute
+
+// WebhookRequest is posted by the chat server to the outgoing webhook url.
+// Request has X-Chat-Timestamp header with unix time of the request and X-Chat-Signature
+// header with "sha256=" prefixed hex HMAC-SHA256 of the timestamp, "." and the body.
+// Receivers should check the signature and reject requests with the timestamp older
+// than WebhookReplayWindow to not accept replayed requests.
+type WebhookRequest struct {
+	ID      int64     `json:"id"`              // message id
+	Ts      time.Time `json:"ts"`              // message timestamp
+	Room    string    `json:"room"`            // room name
+	Name    string    `json:"name"`            // message author username
+	Text    string    `json:"text"`            // message plain text
+	Trigger string    `json:"trigger"`         // matched trigger word or mention. Empty if matched by room
+	Click   int       `json:"click,omitempty"` // clicked button number starting from 1. Set if Name clicked the button of the bot message
+}
+
+// WebhookResponse is an optional response of the outgoing webhook receiver.
+// Non-empty Text is posted into the room by the bot with Buttons. Clicks on the buttons
+// are posted to the webhook and the reply Text to a click becomes the message action result.
+// Incoming webhooks accept the same JSON and ignore Buttons.
+type WebhookResponse struct {
+	Text    string   `json:"text"`              // reply text
+	Buttons []string `json:"buttons,omitempty"` // labels of the reply message buttons
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/milla-v/chat/prot"
+)
+
+// ActionHandler handles clicks on the buttons of the messages posted with the handler name.
+type ActionHandler interface {
+	// Click is called in the worker routine when the user clicks the button number
+	// starting from 1. Returned text becomes the message action result.
+	Click(user string, msg *prot.Message, button int) (string, error)
+}
+
+// ActionRestorer is implemented by action handlers which keep state. Restore is called
+// for every stored click on startup instead of Click.
+type ActionRestorer interface {
+	Restore(user string, msg *prot.Message, button int)
+}
+
+// RegisterActionHandler registers the handler for messages with Bot field equal to name.
+// Should be called before Start.
+func (s *Server) RegisterActionHandler(name string, h ActionHandler) {
+	s.actionHandlers[name] = h
+}
+
+// actionRequest is a button click passed to the worker.
+type actionRequest struct {
+	cli    *client
+	action prot.Action
+}
+
+// actionMessage finds the message with the clicked button.
+func (s *Server) actionMessage(user string, a *prot.Action) (*prot.Message, error) {
+	msg, ok := s.index.messages[a.ID]
+	if !ok || msg.Deleted || msg.To != "" && msg.To != user && msg.Name != user {
+		return nil, fmt.Errorf("no such message: %d", a.ID)
+	}
+
+	if a.Click < 1 || a.Click > len(msg.Buttons) {
+		return nil, fmt.Errorf("no such button: %d", a.Click)
+	}
+
+	return msg, nil
+}
+
+// processAction passes the click to the action handler or to the webhook of the bot which posted the message.
+func (s *Server) processAction(req *actionRequest) {
+	name := req.cli.ua.Name
+	msg, err := s.actionMessage(name, &req.action)
+	if err != nil {
+		log.Println("action:", name, err)
+		sendInfo(req.cli, err.Error())
+		return
+	}
+
+	if msg.Webhook {
+		s.clickWebhook(req.cli, msg, req.action.Click)
+		return
+	}
+
+	h, ok := s.actionHandlers[msg.Bot]
+	if !ok {
+		log.Println("action: no action handler:", msg.Bot)
+		sendInfo(req.cli, "no action handler: "+msg.Bot)
+		return
+	}
+
+	result, err := h.Click(name, msg, req.action.Click)
+	if err != nil {
+		log.Println("action:", msg.Bot, err)
+		sendInfo(req.cli, err.Error())
+		return
+	}
+
+	s.applyAction(msg, name, req.action.Click, result)
+}
+
+// applyAction sets the action result of the message, stores the click and sends it to the participants.
+func (s *Server) applyAction(msg *prot.Message, name string, click int, result string) {
+	msg.Result = result
+	e := prot.Envelope{Room: msg.Room, Action: &prot.Action{
+		ID:     msg.ID,
+		Click:  click,
+		Ts:     time.Now(),
+		Name:   name,
+		Result: result,
+	}}
+
+	s.storeEnvelope(&e)
+	s.sendToParticipants(msg, &e)
+}
+
+// loadAction applies stored click to the loaded history.
+func (s *Server) loadAction(e *prot.Envelope) {
+	msg, ok := s.index.messages[e.Action.ID]
+	if !ok {
+		return
+	}
+
+	msg.Result = e.Action.Result
+	if r, ok := s.actionHandlers[msg.Bot].(ActionRestorer); ok {
+		r.Restore(e.Action.Name, msg, e.Action.Click)
+	}
+}
+
+// poll is an action handler for /poll command messages.
+type poll struct {
+	votes map[int64]map[string]int // button number by user by message id
+}
+
+func (p *poll) Restore(user string, msg *prot.Message, button int) {
+	votes, ok := p.votes[msg.ID]
+	if !ok {
+		votes = map[string]int{}
+		p.votes[msg.ID] = votes
+	}
+	votes[user] = button
+}
+
+func (p *poll) Click(user string, msg *prot.Message, button int) (string, error) {
+	p.Restore(user, msg, button)
+
+	counts := make([]int, len(msg.Buttons))
+	for _, b := range p.votes[msg.ID] {
+		counts[b-1]++
+	}
+
+	var list []string
+	for i, label := range msg.Buttons {
+		list = append(list, fmt.Sprintf("%s: %d", label, counts[i]))
+	}
+	return strings.Join(list, ", "), nil
+}
+
+// pollCommand handles "/poll QUESTION | OPTION1 | OPTION2" command.
+func (s *Server) pollCommand(m *message, arg string) {
+	fields := strings.Split(arg, "|")
+	if len(fields) < 3 {
+		sendInfo(m.from, "usage: /poll QUESTION | OPTION1 | OPTION2 ...")
+		return
+	}
+
+	poll := *m
+	poll.text = strings.TrimSpace(fields[0])
+	poll.bot = "poll"
+	poll.buttons = nil
+	for _, f := range fields[1:] {
+		if f = strings.TrimSpace(f); f != "" {
+			poll.buttons = append(poll.buttons, f)
+		}
+	}
+
+	s.broadcastMessage(&poll)
+}
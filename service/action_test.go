@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/milla-v/chat/auth"
+	"github.com/milla-v/chat/prot"
+)
+
+func TestPoll(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice", "T2": "bob"}})
+	defer os.RemoveAll(dir)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	tc := newTestClient(t, s.Handler())
+	defer tc.ts.Close()
+
+	tc.do("POST", "/m", "/poll lunch? | pizza | sushi", "T1")
+	var page prot.HistoryPage
+	json.Unmarshal([]byte(tc.history("T1", "lunch?")), &page)
+	if len(page.Messages) != 1 || page.Messages[0].Bot != "poll" || len(page.Messages[0].Buttons) != 2 {
+		t.Fatalf("poll: %+v", page.Messages)
+	}
+	id := page.Messages[0].ID
+
+	var infos []string
+	alice := &client{ua: &auth.UserAuth{Name: "alice"}, infos: &infos}
+	bob := &client{ua: &auth.UserAuth{Name: "bob"}}
+
+	tests := []struct {
+		cli    *client
+		click  int
+		result string
+	}{
+		{alice, 1, "pizza: 1, sushi: 0"},
+		{bob, 2, "pizza: 1, sushi: 1"},
+		{alice, 2, "pizza: 0, sushi: 2"}, // re-vote
+		{alice, 3, ""},
+		{alice, 0, ""},
+		{bob, 1, "pizza: 1, sushi: 1"},
+	}
+	for i, tt := range tests {
+		s.actionChan <- &actionRequest{cli: tt.cli, action: prot.Action{ID: id, Click: tt.click}}
+		if tt.result != "" && tc.history("T1", `"result":"`+tt.result+`"`) == "" {
+			t.Errorf("%d: result is not %q", i, tt.result)
+		}
+	}
+	// history request after the clicks is processed by the worker after them
+	if len(infos) != 2 || infos[0] != "no such button: 3" || infos[1] != "no such button: 0" {
+		t.Errorf("invalid clicks: %q", infos)
+	}
+
+	// votes are restored from the stored clicks
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if tc.history("T1", `"result":"pizza: 1, sushi: 1"`) == "" {
+		t.Error("result is not restored")
+	}
+	s.actionChan <- &actionRequest{cli: bob, action: prot.Action{ID: id, Click: 2}}
+	if tc.history("T1", `"result":"pizza: 0, sushi: 2"`) == "" {
+		t.Error("votes are not restored")
+	}
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// permission is a permission required to run a command.
+type permission int
+
+const (
+	permUser  permission = iota // any authenticated user
+	permAdmin                   // users listed in config admins
+)
+
+// command is a slash command.
+type command struct {
+	name   string                                  // command name with leading slash
+	args   string                                  // arguments synopsis for help
+	help   string                                  // one line description
+	perm   permission                              // permission required to run the command
+	hidden bool                                    // internal command not shown in help
+	run    func(s *Server, m *message, arg string) // command handler called in the worker routine
+}
+
+var commands = map[string]*command{} // commands by name
+
+// registerCommand adds the command to the registry. Should be called before Run.
+func registerCommand(c *command) {
+	if _, ok := commands[c.name]; ok {
+		panic("command already registered: " + c.name)
+	}
+	commands[c.name] = c
+}
+
+// keysHelpText describes web client shortcuts.
+const keysHelpText = `
+	f       &mdash; show/hide file send panel
+	n       &mdash; show/hide notifications
+	.       &mdash; answer да
+	!       &mdash; answer ДА!!!
+	,       &mdash; answer нет
+	//text  &mdash; send text starting with /
+`
+
+func (s *Server) allowed(c *command, cli *client) bool {
+	return c.perm == permUser || c.perm == permAdmin && s.isAdmin(cli.ua.Name)
+}
+
+// helpText generates help for the commands available to the client.
+func (s *Server) helpText(cli *client) string {
+	var list []*command
+	width := 0
+	for _, c := range commands {
+		if c.hidden || !s.allowed(c, cli) {
+			continue
+		}
+		list = append(list, c)
+		if n := len(c.name) + len(c.args) + 1; n > width {
+			width = n
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+
+	text := "\n"
+	for _, c := range list {
+		text += fmt.Sprintf("\t%-*s &mdash; %s\n", width, strings.TrimSpace(c.name+" "+c.args), c.help)
+	}
+	return text + keysHelpText
+}
+
+// splitCommand splits "/cmd arg" text into command and argument.
+// Returns empty command for a regular text.
+func splitCommand(text string) (cmd, arg string) {
+	if !strings.HasPrefix(text, "/") || strings.HasPrefix(text, "//") || strings.Contains(text, "\n") {
+		return "", ""
+	}
+
+	fields := strings.SplitN(text, " ", 2)
+	cmd = fields[0]
+	if len(fields) > 1 {
+		arg = strings.TrimSpace(fields[1])
+	}
+	return cmd, arg
+}
+
+// processMessage runs the command or broadcasts the text.
+func (s *Server) processMessage(m *message) {
+	if m.pong || m.active {
+		m.from.lastPongTime = time.Now()
+	}
+	if m.active {
+		m.from.lastMessageTime = m.from.lastPongTime
+	}
+	if m.from.ws == nil && m.from.ua.Token != "" {
+		// message over http. Replies go to the websocket of the user
+		if cli, err := s.findClient(m.from.ua.Token); err == nil {
+			m.from = cli
+		}
+	}
+	if m.reply != nil {
+		// and to the http response
+		var infos []string
+		from := m.from
+		from.infos = &infos
+		defer func() {
+			from.infos = nil
+			m.reply <- infos
+		}()
+	}
+
+	if m.toName != "" {
+		to, err := s.findRecipient(m.toName)
+		if err != nil {
+			sendInfo(m.from, err.Error())
+			return
+		}
+		m.to = to
+	}
+
+	cmd, arg := splitCommand(m.text)
+	if cmd == "" {
+		if strings.HasPrefix(m.text, "//") {
+			m.text = m.text[1:]
+		}
+		s.broadcastMessage(m)
+		return
+	}
+
+	c, ok := commands[cmd]
+	if !ok {
+		sendInfo(m.from, "unknown command "+cmd+". Type /help for the list of commands")
+		return
+	}
+
+	if !s.allowed(c, m.from) {
+		log.Println("command:", m.from.ua.Name, "not allowed to run", cmd)
+		sendInfo(m.from, cmd+": permission denied")
+		return
+	}
+
+	c.run(s, m, arg)
+}
+
+func init() {
+	for _, c := range []*command{
+		{name: "/help", help: "print this help", run: func(s *Server, m *message, arg string) { sendInfo(m.from, s.helpText(m.from)) }},
+		{name: "/roster", help: "refresh user list", run: func(s *Server, m *message, arg string) { s.sendRoster(m.from) }},
+		{name: "/replay", hidden: true, run: func(s *Server, m *message, arg string) { replayHistory(m.from) }},
+		{name: "/unread", hidden: true, run: func(s *Server, m *message, arg string) { s.sendUnread(m.from.ua.Name) }},
+		{name: "/rooms", help: "list all rooms", run: func(s *Server, m *message, arg string) { s.sendRooms(m.from) }},
+		{name: "/join", args: "ROOM", help: "join the room and make it current", run: func(s *Server, m *message, arg string) { s.joinRoom(m.from, arg) }},
+		{name: "/leave", args: "[ROOM]", help: "leave current room", run: func(s *Server, m *message, arg string) { s.leaveRoom(m.from, arg) }},
+		{name: "/msg", args: "USER [TEXT]", help: "send private text to the user or show the conversation", run: func(s *Server, m *message, arg string) { s.sendPrivateCommand(m.from, arg) }},
+		{name: "/search", args: "QUERY", help: "search messages", run: func(s *Server, m *message, arg string) { s.searchCommand(m.from, arg) }},
+		{name: "/edit", args: "ID TEXT", help: "replace text of your message", run: func(s *Server, m *message, arg string) { s.editCommand(m.from, "/edit", arg) }},
+		{name: "/delete", args: "ID", help: "delete your message", run: func(s *Server, m *message, arg string) { s.editCommand(m.from, "/delete", arg) }},
+		{name: "/react", args: "ID EMOJI", help: "react to the message", run: func(s *Server, m *message, arg string) { s.reactCommand(m.from, "/react", arg) }},
+		{name: "/unreact", args: "ID EMOJI", help: "remove your reaction from the message", run: func(s *Server, m *message, arg string) { s.reactCommand(m.from, "/unreact", arg) }},
+		{name: "/reply", args: "ID TEXT", help: "reply in the thread of the message", run: (*Server).replyCommand},
+		{name: "/status", args: "[TEXT]", help: "set your status text", run: func(s *Server, m *message, arg string) { s.statusCommand(m.from, "/status", arg) }},
+		{name: "/dnd", args: "on|off", help: "turn do not disturb mode on or off", run: func(s *Server, m *message, arg string) { s.statusCommand(m.from, "/dnd", arg) }},
+		{name: "/poll", args: "Q | A | B", help: "start a poll with question Q and answers A, B", run: (*Server).pollCommand},
+	} {
+		registerCommand(c)
+	}
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/milla-v/chat/auth"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		text, cmd, arg string
+	}{
+		{"/help", "/help", ""},
+		{"/join dev", "/join", "dev"},
+		{"/msg bob  hello there ", "/msg", "bob  hello there"},
+		{"/status ", "/status", ""},
+		{"hello", "", ""},
+		{"", "", ""},
+		{"//not a command", "", ""},
+		{"/code\nline", "", ""},
+		{" /help", "", ""},
+	}
+
+	for _, tt := range tests {
+		if cmd, arg := splitCommand(tt.text); cmd != tt.cmd || arg != tt.arg {
+			t.Errorf("%q: got %q %q, want %q %q", tt.text, cmd, arg, tt.cmd, tt.arg)
+		}
+	}
+}
+
+func TestHelpCommand(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice", "T2": "root"}})
+	defer os.RemoveAll(dir)
+	c := *s.config()
+	c.Admins = []string{"root"}
+	s.cfg.Store(&c)
+	s.getRoom(defaultRoom)
+
+	for _, name := range []string{"alice", "root"} {
+		var infos []string
+		cli := &client{ua: &auth.UserAuth{Name: name}, infos: &infos}
+		s.processMessage(&message{from: cli, text: "/help"})
+		if len(infos) != 1 {
+			t.Fatalf("%s: infos %q", name, infos)
+		}
+
+		lines := map[string]bool{}
+		for _, line := range strings.Split(infos[0], "\n") {
+			if f := strings.Fields(line); len(f) > 0 {
+				lines[f[0]] = true
+			}
+		}
+		for _, c := range commands {
+			listed := !c.hidden && (c.perm == permUser || name == "root")
+			if lines[c.name] != listed {
+				t.Errorf("%s: %s listed %v, want %v", name, c.name, lines[c.name], listed)
+			}
+		}
+	}
+}
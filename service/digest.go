@@ -0,0 +1,232 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/milla-v/chat/mailer"
+	"github.com/milla-v/chat/prot"
+)
+
+const (
+	defaultDigestFrequency = "1h" // email frequency for users who did not choose it
+	digestOff              = "off"
+	maxDigestPending       = 100 // max messages in one digest
+)
+
+// digestFrequencies are email frequencies which users can choose.
+var digestFrequencies = map[string]time.Duration{
+	"10m": time.Minute * 10,
+	"1h":  time.Hour,
+	"1d":  time.Hour * 24,
+}
+
+// digest is a batch of email notifications about mentions and private messages
+// received while the user was offline or idle.
+type digest struct {
+	Frequency string    `json:"frequency,omitempty"` // chosen frequency or "off". Empty means default
+	Pending   []int64   `json:"pending,omitempty"`   // message ids to notify about
+	LastSent  time.Time `json:"last_sent"`           // time of the last email
+}
+
+func (s *Server) digestsFile() string {
+	cfg := s.config()
+	return cfg.WorkDir + privateDir + "digests.json"
+}
+
+func (s *Server) loadDigests() {
+	data, err := ioutil.ReadFile(s.digestsFile())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &s.digests)
+	}
+	if err != nil {
+		log.Println("digest: cannot load:", err)
+	}
+}
+
+func (s *Server) saveDigests() {
+	cfg := s.config()
+	data, err := json.Marshal(s.digests)
+	if err != nil {
+		log.Println("digest: cannot save:", err)
+		return
+	}
+
+	if err = os.MkdirAll(cfg.WorkDir+privateDir, 0700); err != nil {
+		log.Println("digest: cannot save:", err)
+		return
+	}
+
+	if err = ioutil.WriteFile(s.digestsFile(), data, 0600); err != nil {
+		log.Println("digest: cannot save:", err)
+	}
+}
+
+func (s *Server) userDigest(name string) *digest {
+	d, ok := s.digests[name]
+	if !ok {
+		d = &digest{}
+		s.digests[name] = d
+	}
+	return d
+}
+
+func (d *digest) frequency() string {
+	if d.Frequency == "" {
+		return defaultDigestFrequency
+	}
+	return d.Frequency
+}
+
+// queueNotification adds the message to the email digest of the user if the user is not online.
+func (s *Server) queueNotification(name string, msg *prot.Message) {
+	if name == msg.Name || !s.users.UserExists(name) {
+		return
+	}
+
+	if s.userPresence(name).State == prot.PresenceOnline {
+		return
+	}
+
+	d := s.userDigest(name)
+	if d.frequency() == digestOff || len(d.Pending) >= maxDigestPending {
+		return
+	}
+
+	d.Pending = append(d.Pending, msg.ID)
+	s.saveDigests()
+}
+
+// messageLink returns web client url which opens the message conversation.
+func (s *Server) messageLink(msg *prot.Message, user string) string {
+	cfg := s.config()
+	q := url.Values{}
+	if msg.To != "" {
+		peer := msg.To
+		if peer == user {
+			peer = msg.Name
+		}
+		q.Set("to", peer)
+	} else {
+		q.Set("room", msg.Room)
+	}
+	return "https://" + cfg.Address + "/?" + q.Encode() + "#m" + fmt.Sprint(msg.ID)
+}
+
+// isRead checks if the user has read the message in the web client.
+func (s *Server) isRead(name string, msg *prot.Message) bool {
+	key := msg.Room
+	if msg.To != "" {
+		key = "@" + msg.To
+		if msg.To == name {
+			key = "@" + msg.Name
+		}
+	}
+	return s.userReadMarkers(name)[key] >= msg.ID
+}
+
+// digestMail composes email about unread messages.
+func (s *Server) digestMail(to, name string, list []*prot.Message) *mailer.Message {
+	var b bytes.Buffer
+	for _, msg := range list {
+		where := "#" + msg.Room
+		if msg.To != "" {
+			where = "private"
+		}
+		text := html.UnescapeString(msg.Text)
+		fmt.Fprintf(&b, "%s %s %s:\n%s\n%s\n\n", msg.Ts.Format("2006-01-02 15:04"), where, msg.Name, text, s.messageLink(msg, name))
+	}
+
+	fmt.Fprintf(&b, "To change email frequency type /email 10m|1h|1d|off in the chat.\n")
+
+	return &mailer.Message{
+		To:      []string{to},
+		Subject: fmt.Sprintf("chat: %d new messages for %s", len(list), name),
+		Body:    b.String(),
+	}
+}
+
+// sendDigests emails pending notifications to the users whose frequency interval has passed.
+func (s *Server) sendDigests(now time.Time) {
+	var names []string
+	for name := range s.digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	changed := false
+	for _, name := range names {
+		d := s.digests[name]
+		if len(d.Pending) == 0 || now.Sub(d.LastSent) < digestFrequencies[d.frequency()] {
+			continue
+		}
+
+		var list []*prot.Message
+		for _, id := range d.Pending {
+			if msg, ok := s.index.messages[id]; ok && !msg.Deleted && !s.isRead(name, msg) {
+				list = append(list, msg)
+			}
+		}
+		d.Pending = nil
+		changed = true
+		if len(list) == 0 {
+			continue
+		}
+
+		to, err := s.users.UserEmail(name)
+		if err != nil {
+			log.Println("digest:", err)
+			continue
+		}
+
+		if s.outbox == nil {
+			log.Println("digest: mail is not configured")
+			continue
+		}
+
+		d.LastSent = now
+		if err = s.outbox.Send(s.digestMail(to, name, list)); err != nil {
+			log.Println("digest:", err)
+		}
+	}
+
+	if changed {
+		s.saveDigests()
+	}
+}
+
+// emailCommand handles "/email [10m|1h|1d|off]" command.
+func (s *Server) emailCommand(m *message, arg string) {
+	d := s.userDigest(m.from.ua.Name)
+	if arg == "" {
+		sendInfo(m.from, "email notifications: "+d.frequency())
+		return
+	}
+
+	if _, ok := digestFrequencies[arg]; !ok && arg != digestOff {
+		sendInfo(m.from, "usage: /email 10m|1h|1d|off")
+		return
+	}
+
+	d.Frequency = arg
+	if arg == digestOff {
+		d.Pending = nil
+	}
+	s.saveDigests()
+	sendInfo(m.from, "email notifications: "+arg)
+}
+
+func init() {
+	registerCommand(&command{name: "/email", args: "[10m|1h|1d|off]", help: "set frequency of email about mentions and private messages while you are away", run: (*Server).emailCommand})
+}
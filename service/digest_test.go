@@ -0,0 +1,84 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/milla-v/chat/mailer"
+)
+
+type testMailer chan *mailer.Message
+
+func (c testMailer) Send(m *mailer.Message) error {
+	c <- m
+	return nil
+}
+
+func TestDigest(t *testing.T) {
+	s, dir := newTestServer(t, Options{})
+	defer os.RemoveAll(dir)
+	cfg := s.config()
+	if err := ioutil.WriteFile(cfg.WorkDir+"user-bob.txt", []byte("bob secret bob@example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mail := make(chan *mailer.Message, 10)
+	s.outbox = testMailer(mail)
+
+	texts := []string{"@bob hi", "@bob read", "@bob\n.\nbye"}
+	for i, text := range texts {
+		e := testEnvelope("general", text, time.Now())
+		e.Message.ID = int64(i + 1)
+		e.Message.Name = "alice"
+		s.index.add(e.Message)
+		s.queueNotification("bob", e.Message)
+		s.queueNotification("alice", e.Message)
+		s.queueNotification("nobody", e.Message)
+	}
+	s.userReadMarkers("bob")["general"] = 2
+	s.index.messages[1].Deleted = true
+
+	if len(s.digests) != 1 || len(s.digests["bob"].Pending) != 3 {
+		t.Fatalf("s.digests: %+v", s.digests)
+	}
+
+	now := time.Now()
+	s.sendDigests(now)
+	var m *mailer.Message
+	select {
+	case m = <-mail:
+	default:
+		t.Fatal("no mail")
+	}
+
+	if len(m.To) != 1 || m.To[0] != "bob@example.com" || m.Subject != "chat: 1 new messages for bob" {
+		t.Errorf("mail: %+v", m)
+	}
+	if !strings.Contains(m.Body, "@bob\n.\nbye\nhttps://"+cfg.Address+"/?room=general#m3\n") || strings.Contains(m.Body, "#m2") {
+		t.Errorf("mail body:\n%s", m.Body)
+	}
+
+	e := testEnvelope("general", "@bob again", now)
+	e.Message.ID = 4
+	s.index.add(e.Message)
+	s.queueNotification("bob", e.Message)
+	s.sendDigests(now.Add(time.Minute))
+	if len(mail) != 0 || len(s.digests["bob"].Pending) != 1 {
+		t.Error("digest is sent before the frequency interval")
+	}
+
+	s.digests["bob"].Frequency = digestOff
+	s.queueNotification("bob", e.Message)
+	if len(s.digests["bob"].Pending) != 1 {
+		t.Error("message queued with email off")
+	}
+
+	s.digests = map[string]*digest{}
+	s.loadDigests()
+	if d := s.digests["bob"]; d == nil || d.Frequency != "" || !d.LastSent.Equal(now) {
+		t.Errorf("loaded digest: %+v", d)
+	}
+}
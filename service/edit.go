@@ -0,0 +1,194 @@
+package service
+
+import (
+	"errors"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/milla-v/chat/prot"
+)
+
+// editRequest is an edit, delete or reaction request passed to the worker.
+type editRequest struct {
+	cli   *client
+	edit  *prot.Edit
+	del   *prot.Delete
+	react *prot.Reaction
+}
+
+func (s *Server) isAdmin(name string) bool {
+	cfg := s.config()
+	for _, a := range cfg.Admins {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// editableMessage finds the message which the user is allowed to change.
+func (s *Server) editableMessage(cli *client, id int64) (*prot.Message, error) {
+	msg, ok := s.index.messages[id]
+	if !ok {
+		return nil, errors.New("no such message: " + strconv.FormatInt(id, 10))
+	}
+
+	if msg.Deleted {
+		return nil, errors.New("message is deleted")
+	}
+
+	if msg.Name != cli.ua.Name && !s.isAdmin(cli.ua.Name) {
+		return nil, errors.New("only author can change the message")
+	}
+
+	return msg, nil
+}
+
+// nameAbbrev returns up to 3 first bytes of the name in title case shown in message html.
+func nameAbbrev(name string) string {
+	if len(name) > 3 {
+		name = name[:3]
+	}
+	return strings.Title(name)
+}
+
+// messageHTML renders message html for browsers.
+func messageHTML(msg *prot.Message, body string) string {
+	capname := `<span class="smallcaps">` + nameAbbrev(msg.Name) + "</span>"
+	if msg.To != "" {
+		capname += " &rarr; " + msg.To
+	}
+	if msg.Webhook {
+		capname += ` <span class="ts">bot</span>`
+	}
+	ts := msg.Ts.Format("15:04")
+	if msg.Edited {
+		ts += ", edited"
+	}
+	return "<p>" + capname + ".\n" + body + ` <span class="ts">(` + ts + ")</span></p>\n"
+}
+
+func (s *Server) applyEdit(msg *prot.Message, ed *prot.Edit) {
+	s.index.remove(msg)
+	msg.Text = ed.Text
+	msg.Edited = true
+	msg.HTML = messageHTML(msg, formatHTML(msg.Text))
+	ed.HTML = msg.HTML
+	s.index.add(msg)
+}
+
+func (s *Server) applyDelete(msg *prot.Message, del *prot.Delete) {
+	s.index.remove(msg)
+	msg.Text = ""
+	msg.Deleted = true
+	msg.Preview = nil
+	msg.HTML = messageHTML(msg, "<i>message deleted</i>")
+	del.HTML = msg.HTML
+	s.index.messages[msg.ID] = msg
+}
+
+// sendToParticipants sends the envelope to the clients which can see the message.
+func (s *Server) sendToParticipants(msg *prot.Message, e *prot.Envelope) {
+	list := s.clients
+	if msg.To == "" {
+		r, ok := s.rooms[msg.Room]
+		if !ok {
+			return
+		}
+		list = r.clients
+	}
+
+	for _, cli := range list {
+		if cli.ws == nil {
+			continue
+		}
+		if msg.To != "" && cli.ua.Name != msg.To && cli.ua.Name != msg.Name {
+			continue
+		}
+
+		err := websocket.JSON.Send(cli.ws, e)
+		if err != nil {
+			log.Println("cannot send to", cli.ua.Name, err)
+		}
+	}
+}
+
+func (s *Server) processEditRequest(req *editRequest) {
+	if req.react != nil {
+		s.processReaction(req.cli, req.react)
+		return
+	}
+
+	var id int64
+	if req.edit != nil {
+		id = req.edit.ID
+	} else {
+		id = req.del.ID
+	}
+
+	msg, err := s.editableMessage(req.cli, id)
+	if err != nil {
+		log.Println("edit:", req.cli.ua.Name, err)
+		sendInfo(req.cli, err.Error())
+		return
+	}
+
+	e := prot.Envelope{Room: msg.Room}
+	if req.edit != nil {
+		e.Edit = &prot.Edit{ID: id, Ts: time.Now(), Name: req.cli.ua.Name, Text: req.edit.Text}
+		s.applyEdit(msg, e.Edit)
+	} else {
+		e.Delete = &prot.Delete{ID: id, Ts: time.Now(), Name: req.cli.ua.Name}
+		s.applyDelete(msg, e.Delete)
+	}
+
+	s.storeEnvelope(&e)
+	s.sendToParticipants(msg, &e)
+}
+
+// editCommand handles "/edit ID TEXT" and "/delete ID" commands.
+func (s *Server) editCommand(cli *client, cmd, arg string) {
+	fields := strings.SplitN(arg, " ", 2)
+	id, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		sendInfo(cli, "usage: /edit ID TEXT or /delete ID")
+		return
+	}
+
+	if cmd == "/delete" {
+		s.processEditRequest(&editRequest{cli: cli, del: &prot.Delete{ID: id}})
+		return
+	}
+
+	if len(fields) < 2 || strings.TrimSpace(fields[1]) == "" {
+		sendInfo(cli, "usage: /edit ID TEXT")
+		return
+	}
+
+	s.processEditRequest(&editRequest{cli: cli, edit: &prot.Edit{ID: id, Text: strings.TrimSpace(fields[1])}})
+}
+
+// loadEdit applies stored edit or delete to the loaded history.
+func (s *Server) loadEdit(e *prot.Envelope) {
+	if e.Edit != nil {
+		if msg, ok := s.index.messages[e.Edit.ID]; ok {
+			s.applyEdit(msg, e.Edit)
+		}
+	}
+
+	if e.Delete != nil {
+		if msg, ok := s.index.messages[e.Delete.ID]; ok {
+			s.applyDelete(msg, e.Delete)
+		}
+	}
+}
+
+// escapeEdit escapes the text received from the client.
+func escapeEdit(ed *prot.Edit) {
+	ed.Text = html.EscapeString(strings.TrimSpace(ed.Text))
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/milla-v/chat/auth"
+	"github.com/milla-v/chat/prot"
+)
+
+func TestProcessEditRequest(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice", "T2": "bob", "T3": "root"}})
+	defer os.RemoveAll(dir)
+	c := *s.config()
+	c.Admins = []string{"root"}
+	s.cfg.Store(&c)
+
+	s.getRoom(defaultRoom)
+	var infos []string
+	alice := &client{ua: &auth.UserAuth{Name: "alice", Token: "T1"}, infos: &infos}
+	bob := &client{ua: &auth.UserAuth{Name: "bob", Token: "T2"}, infos: &infos}
+	root := &client{ua: &auth.UserAuth{Name: "root", Token: "T3"}, infos: &infos}
+	s.clients = []*client{alice, bob, root}
+
+	s.processMessage(&message{from: alice, text: "hello"})
+	msg := s.index.messages[s.lastID]
+	if msg == nil {
+		t.Fatal("message is not posted")
+	}
+
+	edit := func(cli *client, text string) *editRequest {
+		return &editRequest{cli: cli, edit: &prot.Edit{ID: msg.ID, Text: text}}
+	}
+	del := func(cli *client) *editRequest {
+		return &editRequest{cli: cli, del: &prot.Delete{ID: msg.ID}}
+	}
+
+	tests := []struct {
+		req     *editRequest
+		info    string
+		text    string
+		deleted bool
+	}{
+		{edit(alice, "edited by alice"), "", "edited by alice", false},
+		{edit(bob, "edited by bob"), "only author can change the message", "edited by alice", false},
+		{del(bob), "only author can change the message", "edited by alice", false},
+		{edit(root, "edited by root"), "", "edited by root", false},
+		{del(root), "", "", true},
+		{edit(alice, "after delete"), "message is deleted", "", true},
+		{del(alice), "message is deleted", "", true},
+		{&editRequest{cli: alice, edit: &prot.Edit{ID: msg.ID + 1, Text: "missing"}}, "no such message", "", true},
+	}
+
+	for i, tt := range tests {
+		infos = nil
+		s.processEditRequest(tt.req)
+		if tt.info == "" && len(infos) != 0 || tt.info != "" && (len(infos) != 1 || !strings.HasPrefix(infos[0], tt.info)) {
+			t.Errorf("%d: infos %q, want %q", i, infos, tt.info)
+		}
+		if msg.Text != tt.text || msg.Deleted != tt.deleted {
+			t.Errorf("%d: message %q deleted %v, want %q %v", i, msg.Text, msg.Deleted, tt.text, tt.deleted)
+		}
+	}
+}
+
+func TestNameAbbrev(t *testing.T) {
+	tests := []struct {
+		name, abbrev string
+	}{
+		{"alice", "Ali"},
+		{"bob", "Bob"},
+		{"al", "Al"},
+		{"x", "X"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := nameAbbrev(tt.name); got != tt.abbrev {
+			t.Errorf("%q: got %q, want %q", tt.name, got, tt.abbrev)
+		}
+	}
+
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "al"}})
+	defer os.RemoveAll(dir)
+	s.getRoom(defaultRoom)
+	al := &client{ua: &auth.UserAuth{Name: "al", Token: "T1"}}
+	s.processMessage(&message{from: al, text: "hi"})
+	msg := s.index.messages[s.lastID]
+	if msg == nil || !strings.Contains(msg.HTML, `<span class="smallcaps">Al</span>`) {
+		t.Fatalf("message of short name: %+v", msg)
+	}
+	s.processEditRequest(&editRequest{cli: al, edit: &prot.Edit{ID: msg.ID, Text: "edited"}})
+	if !strings.Contains(msg.HTML, `<span class="smallcaps">Al</span>`) || !strings.Contains(msg.HTML, "edited") {
+		t.Errorf("edited message html: %s", msg.HTML)
+	}
+}
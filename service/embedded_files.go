@@ -19,7 +19,18 @@ p {text-indent: 3%; }
 p.noindent { text-indent: 0%; }
 .smallcaps { font-variant: small-caps; }
 .ts { color: gray; font-size: small; }
+.reactions { margin-left: 3%; font-size: small; }
+.reply { margin-left: 3%; }
+.buttons { margin-left: 3%; }
+.idle { color: gray; }
+.away { color: silver; }
+.thread { margin-left: 3%; border-left: solid 2px #DDDDDD; }
 pre { margin-left: 6%; background-color: #EEEEEE; padding: 4px 4px 4px 4px; }
+code { background-color: #EEEEEE; }
+.mention { background-color: #FFF8DD; }
+.preview { margin-left: 3%; padding-left: 4px; border-left: solid 2px #DDDDFF; font-size: small; }
+.preview img { max-height: 120px; max-width: 240px; }
+blockquote { margin-left: 3%; padding-left: 4px; border-left: solid 2px #CCCCCC; color: #444444; }
 </style>
 <script>
 
@@ -51,6 +62,12 @@ function notify(s)
 
 var ws;
 var count = 0;
+var currentRoom = 'general';
+var firstId = 0;
+var lastId = 0;
+var unread = null;
+var lastTyping = 0;
+var typingTimer = null;
 
 function ws_onclose(e)
 {
@@ -67,6 +84,12 @@ function restoreTitle() {
 	setTitle('Chat');
 }
 
+// escapeHTML escapes text which is not escaped by the server.
+function escapeHTML(s) {
+	return String(s).replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;')
+		.replace(/"/g, '&quot;').replace(/'/g, '&#39;');
+}
+
 function ws_onmessage(e)
 {
 	console.log(e.data);
@@ -76,26 +99,315 @@ function ws_onmessage(e)
 		e.ping.pong = e.ping.ping;
 		ws.send(JSON.stringify(e));
 	} else if (e.roster != null){
-		roster.innerHTML = e.roster.html;
+		if (e.roster.room != currentRoom) {
+			switchRoom(e.roster.room);
+		}
+		roster.innerHTML = rosterHTML(e.roster);
+		updateRoomList(e.roster.rooms);
 	} else if (e.message != null){
 		if (e.message.notification.length > 0) {
 			notify(e.message.notification);
 			setTitle('Chat [NEW]');
-			window.onfocus = restoreTitle;
+			window.onfocus = focused;
+		}
+		if (e.message.room == '' || e.message.room == currentRoom || e.message.to != null) {
+			if (e.message.id > 0 && (firstId == 0 || e.message.id < firstId)) {
+				firstId = e.message.id;
+			}
+			if (e.message.id > lastId && e.message.to == null) {
+				lastId = e.message.id;
+				if (document.hasFocus()) {
+					markRead();
+				}
+			}
+			msglog.innerHTML += messageDiv(e.message);
+			showLinked(e.message.id);
+		} else {
+			markRoom(e.message.room);
+		}
+	} else if (e.edit != null) {
+		updateMessage(e.edit.id, e.edit.html);
+		return;
+	} else if (e.delete != null) {
+		updateMessage(e.delete.id, e.delete.html);
+		updatePreview(e.delete.id, '');
+		return;
+	} else if (e.preview != null) {
+		updatePreview(e.preview.id, e.preview.html);
+		return;
+	} else if (e.reaction != null) {
+		updateReactions(e.reaction.id, e.reaction.reactions);
+		return;
+	} else if (e.unread != null) {
+		unread = e.unread;
+		updateRoomList(null);
+		if (document.hasFocus()) {
+			markRead();
 		}
-		msglog.innerHTML += e.message.html;
+		return;
+	} else if (e.action != null) {
+		updateResult(e.action);
+		return;
+	} else if (e.typing != null) {
+		showTyping(e.typing);
+		return;
+	} else if (e.thread != null) {
+		updateThread(e.thread);
+		return;
+	} else if (e.history_page != null) {
+		showHistoryPage(e.history_page);
+		return;
 	}
 
 	msglog.scrollTop = msglog.scrollHeight;
 }
 
+function messageDiv(m)
+{
+	if (m.id == null) {
+		return m.html;
+	}
+	var cls = (m.parent > 0) ? ' class="reply"' : '';
+	if (m.mentions != null && m.notification != '') {
+		// server sends notification only to the mentioned users
+		cls = (m.parent > 0) ? ' class="reply mention"' : ' class="mention"';
+	}
+	var marker = (m.parent > 0) ? '<span class="ts">&#8627; #' + m.parent + '</span>' : '';
+	return '<div id="m' + m.id + '" title="#' + m.id + '"' + cls + '>' + marker + m.html + '</div>' +
+		'<div id="v' + m.id + '">' + (m.preview != null ? m.preview.html : '') + '</div>' +
+		buttonsHTML(m) +
+		'<div class="reactions">' +
+		'<a href="javascript:replyTo(' + (m.parent > 0 ? m.parent : m.id) + ')">&#8617;</a> ' +
+		'<span id="t' + m.id + '">' + threadHTML(m.id, m.replies, m.last_reply) + '</span> ' +
+		'<span id="r' + m.id + '">' + reactionsHTML(m.id, m.reactions) + '</span></div>';
+}
+
+function threadHTML(id, replies, lastReply)
+{
+	if (replies == null || replies == 0) {
+		return '';
+	}
+	var t = new Date(lastReply);
+	return '<a href="javascript:loadThread(' + id + ')">' + replies + ' replies, last ' +
+		t.toTimeString().substring(0, 5) + '</a>';
+}
+
+function updateThread(th)
+{
+	var d = document.getElementById('t' + th.id);
+	if (d != null) {
+		d.innerHTML = threadHTML(th.id, th.replies, th.last_reply);
+	}
+}
+
+function replyTo(id)
+{
+	textbox.value = '/reply ' + id + ' ';
+	textbox.focus();
+}
+
+function loadThread(id)
+{
+	ws.send(JSON.stringify({ history_request: { parent: id }}));
+}
+
+function reactionsHTML(id, reactions)
+{
+	var html = '';
+	for (var emoji in reactions) {
+		html += '<a href="#" onclick="return reactClick(this)" data-id="' + id + '" data-emoji="' +
+			escapeHTML(emoji) + '" title="' + escapeHTML(reactions[emoji].join(', ')) + '">' +
+			escapeHTML(emoji) + reactions[emoji].length + '</a> ';
+	}
+	return html;
+}
+
+function updateReactions(id, reactions)
+{
+	var d = document.getElementById('r' + id);
+	if (d != null) {
+		d.innerHTML = reactionsHTML(id, reactions);
+	}
+}
+
+function react(id, emoji)
+{
+	ws.send(JSON.stringify({ reaction: { id: id, emoji: emoji }}));
+}
+
+function reactClick(a)
+{
+	react(Number(a.dataset.id), a.dataset.emoji);
+	return false;
+}
+
+function updatePreview(id, html)
+{
+	var d = document.getElementById('v' + id);
+	if (d != null) {
+		d.innerHTML = html;
+	}
+}
+
+function updateMessage(id, html)
+{
+	var d = document.getElementById('m' + id);
+	if (d != null) {
+		d.innerHTML = html;
+	}
+}
+
+function showHistoryPage(page)
+{
+	if (page.parent > 0) {
+		var html = '<div class="thread"><p class="noindent">thread #' + page.parent + ':</p>';
+		for (var i = 0; i < page.messages.length; i++) {
+			html += page.messages[i].html;
+		}
+		msglog.innerHTML += html + '</div>';
+		msglog.scrollTop = msglog.scrollHeight;
+		return;
+	}
+
+	if (page.room != currentRoom) {
+		return;
+	}
+
+	var html = '';
+	for (var i = 0; i < page.messages.length; i++) {
+		html += messageDiv(page.messages[i]);
+	}
+	if (page.messages.length > 0) {
+		firstId = page.messages[0].id;
+	}
+
+	msglog.innerHTML = html + msglog.innerHTML;
+	olderlink.style.display = page.more ? '' : 'none';
+}
+
+function loadOlder()
+{
+	if (firstId == 0) {
+		return;
+	}
+
+	ws.send(JSON.stringify({ history_request: { room: currentRoom, before: firstId }}));
+}
+
+// showLinked highlights the message opened by the link from notification email.
+function showLinked(id)
+{
+	if (location.hash != '#m' + id) {
+		return;
+	}
+	var d = document.getElementById('m' + id);
+	if (d != null) {
+		d.className += ' mention';
+		window.setTimeout(function() {
+			var d = document.getElementById('m' + id);
+			if (d != null) {
+				d.scrollIntoView();
+			}
+		}, 1000);
+	}
+}
+
 function ws_onopen()
 {
 	setTitle('Chat');
 	msglog.innerHTML += '<p>(type /help then ENTER)</p>\n';
+	var q = /[?&](room|to)=([A-Za-z0-9_.\-]+)/.exec(location.search);
+	if (q != null) {
+		ws.send(JSON.stringify({ message: { text: (q[1] == 'room' ? '/join ' : '/msg ') + q[2] }}));
+	}
 	msglog.scrollTop = msglog.scrollHeight;
 }
 
+function switchRoom(name)
+{
+	currentRoom = name;
+	firstId = 0;
+	lastId = 0;
+	olderlink.style.display = '';
+	msglog.innerHTML = '';
+	historylink.href = (name == 'general') ? '/history.html' : '/history-' + name + '.html';
+}
+
+var roomNames = [];
+
+function updateRoomList(list)
+{
+	if (list != null) {
+		roomNames = list;
+	}
+
+	roomlist.innerHTML = '';
+	for (var i = 0; i < roomNames.length; i++) {
+		var o = document.createElement('option');
+		o.value = roomNames[i];
+		o.text = '#' + roomNames[i];
+		if (unread != null && unread.rooms[roomNames[i]] > 0) {
+			o.text += ' (' + unread.rooms[roomNames[i]] + ')';
+		}
+		o.selected = (roomNames[i] == currentRoom);
+		roomlist.add(o);
+	}
+}
+
+function rosterHTML(r)
+{
+	var list = [];
+	for (var i = 0; i < r.users.length; i++) {
+		var u = r.users[i];
+		var s = '<span class="' + escapeHTML(u.state) + '" title="' + escapeHTML(u.state) + '">' + escapeHTML(u.name);
+		if (u.dnd) {
+			s += ' &#128277;';
+		}
+		if (u.status != null) {
+			s += ' <span class="ts">' + u.status + '</span>';
+		}
+		list.push(s + '</span>');
+	}
+	return 'in #' + r.room + ': ' + list.join(', ');
+}
+
+function setStatus()
+{
+	var s = prompt('status', '');
+	if (s != null) {
+		ws.send(JSON.stringify({ presence: { status: s }}));
+	}
+}
+
+function markRead()
+{
+	if (lastId == 0 || unread == null || unread.last_read[currentRoom] >= lastId) {
+		return;
+	}
+	ws.send(JSON.stringify({ mark_read: { room: currentRoom, id: lastId }}));
+}
+
+function focused()
+{
+	restoreTitle();
+	markRead();
+}
+
+function markRoom(name)
+{
+	for (var i = 0; i < roomlist.options.length; i++) {
+		var o = roomlist.options[i];
+		if (o.value == name) {
+			o.text = '#' + name + ' *';
+		}
+	}
+}
+
+function selectRoom()
+{
+	ws.send(JSON.stringify({ message: { text: '/join ' + roomlist.value }}));
+}
+
 function reconnect()
 {
 	setTitle('Chat [off]');
@@ -111,6 +423,8 @@ function reconnect()
 function connect()
 {
 	msglog.innerHTML = '';
+	firstId = 0;
+	lastId = 0;
 
 	ws = new WebSocket("wss://localhost:8085/ws");
 	ws.onclose = ws_onclose;
@@ -138,7 +452,7 @@ function sendText()
 		return;
 	}
 
-	m = { message: { text: t }};
+	m = { room: currentRoom, message: { text: t }};
 	ws.send(JSON.stringify(m));
 	textbox.value = '';
 }
@@ -148,18 +462,63 @@ function toggleSendFile()
 	sendfilepad.style.display = (sendfilepad.style.display == '') ? 'none' : '';
 }
 
-function msgclick(o)
+function msgclick(id, n)
 {
-	m = { action: { id: id, click: 1 }};
+	m = { action: { id: id, click: n }};
 	ws.send(JSON.stringify(m));
 }
 
+function buttonsHTML(m)
+{
+	if (m.buttons == null) {
+		return '';
+	}
+
+	var html = '<div class="buttons">';
+	for (var i = 0; i < m.buttons.length; i++) {
+		html += '<button onclick="msgclick(' + m.id + ', ' + (i + 1) + ')">' + m.buttons[i] + '</button> ';
+	}
+	html += '<span class="ts" id="a' + m.id + '">' + (m.result != null ? m.result : '') + '</span></div>';
+	return html;
+}
+
+function updateResult(a)
+{
+	var d = document.getElementById('a' + a.id);
+	if (d != null) {
+		d.innerHTML = a.result;
+	}
+}
+
 function keypress(event)
 {
 	if (event.target === textbox && event.keyCode === 13) {
 		sendText();
 		event.returnValue = false;
+		return;
+	}
+
+	var now = Date.now();
+	if (now - lastTyping > 3000) {
+		lastTyping = now;
+		ws.send(JSON.stringify({ typing: { room: currentRoom }}));
+	}
+}
+
+function showTyping(t)
+{
+	if (t.room != null && t.room != currentRoom) {
+		return;
+	}
+
+	typingspan.textContent = t.name + ' is typing...';
+	if (typingTimer != null) {
+		window.clearTimeout(typingTimer);
 	}
+	typingTimer = window.setTimeout(function() {
+		typingspan.textContent = '';
+		typingTimer = null;
+	}, Math.min(Math.max(new Date(t.expires) - new Date(), 1000), 10000));
 }
 
 function sendFile() {
@@ -171,7 +530,7 @@ function sendFile() {
 	var formData = new FormData();
 	formData.append('uploadfile', window.uploadfile.files[0]);
 
-	req.open('POST', 'https://localhost:8085/upload', true);
+	req.open('POST', 'https://localhost:8085/upload?room=' + currentRoom, true);
 	req.onload = function(e) {
 		console.log(this.response);
 	};
@@ -184,6 +543,7 @@ function sendFile() {
 </script>
 </head>
 <body onload="connect()">
+<a href="javascript:loadOlder()" id="olderlink">older messages</a>
 <div id="msglog"></div>
 <br>
 <textarea id="textbox" onkeypress="keypress(event)"></textarea>
@@ -199,10 +559,13 @@ function sendFile() {
 </table>
 
 <div>
-	<a target="chaturls" href="/history.html">history</a>
+	<select id="roomlist" onchange="selectRoom()"></select>
+	<a target="chaturls" id="historylink" href="/history.html">history</a>
 	<a href="/login.html">relogin</a>
 	<button onclick="toggleSendFile()">File...</button>
+	<a href="javascript:setStatus()">status</a>
 	<span id="roster">nobody in the room</span>
+	<span id="typingspan" class="ts"></span>
 </div>
 </body>
 </html>
@@ -0,0 +1,232 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/milla-v/chat/prot"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// historyQuery is a history page request passed to the worker.
+// If reply is nil the page is sent to the client websocket.
+type historyQuery struct {
+	cli   *client
+	req   prot.HistoryRequest
+	reply chan *historyResult
+}
+
+// historyResult is a reply to the http request. The page is encoded by the worker
+// because the messages are changed by edits and reactions.
+type historyResult struct {
+	page *prot.HistoryPage
+	data []byte // json encoded page
+	err  error
+}
+
+func (s *Server) nextID() int64 {
+	s.lastID++
+	return s.lastID
+}
+
+// historyFor returns the room or private conversation history requested by the client.
+func (s *Server) historyFor(cli *client, req *prot.HistoryRequest) ([]prot.Envelope, error) {
+	if req.Parent != 0 {
+		parent, ok := s.index.messages[req.Parent]
+		if !ok || parent.To != "" && parent.To != cli.ua.Name && parent.Name != cli.ua.Name {
+			return nil, errors.New("no such thread: " + strconv.FormatInt(req.Parent, 10))
+		}
+		req.Room = parent.Room
+		req.To = ""
+		if parent.To != "" {
+			req.To = parent.To
+			if req.To == cli.ua.Name {
+				req.To = parent.Name
+			}
+		}
+	}
+
+	if req.To != "" {
+		return s.privateHistory[privateKey(cli.ua.Name, req.To)], nil
+	}
+
+	name := req.Room
+	if name == "" {
+		name = defaultRoom
+		if cli.room != nil {
+			name = cli.room.name
+		}
+	}
+
+	r, ok := s.rooms[name]
+	if !ok {
+		return nil, errors.New("no such room: " + name)
+	}
+	req.Room = r.name
+	return r.history, nil
+}
+
+// historyPage cuts the page from history h which is sorted by message id.
+func historyPage(h []prot.Envelope, req *prot.HistoryRequest) *prot.HistoryPage {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	var list []prot.Envelope
+	for _, e := range h {
+		if e.Message == nil || e.Message.ID == 0 {
+			continue
+		}
+		if req.Before > 0 && e.Message.ID >= req.Before {
+			continue
+		}
+		if req.After > 0 && e.Message.ID <= req.After {
+			continue
+		}
+		if e.Message.Parent != req.Parent {
+			continue
+		}
+		list = append(list, e)
+	}
+
+	page := &prot.HistoryPage{Room: req.Room, To: req.To, Parent: req.Parent, Messages: []*prot.Message{}}
+
+	if len(list) > limit {
+		page.More = true
+		if req.After > 0 && req.Before == 0 {
+			list = list[:limit]
+		} else {
+			list = list[len(list)-limit:]
+		}
+	}
+
+	for _, e := range list {
+		page.Messages = append(page.Messages, e.Message)
+	}
+
+	return page
+}
+
+func (s *Server) processHistoryQuery(q *historyQuery) {
+	res := &historyResult{}
+	h, err := s.historyFor(q.cli, &q.req)
+	if err != nil {
+		res.err = err
+	} else {
+		res.page = historyPage(h, &q.req)
+	}
+
+	if q.reply != nil {
+		if res.err == nil {
+			res.data, res.err = json.Marshal(res.page)
+			res.page = nil
+		}
+		q.reply <- res
+		return
+	}
+
+	if res.err != nil {
+		sendInfo(q.cli, res.err.Error())
+		return
+	}
+
+	if q.cli.ws == nil {
+		return
+	}
+
+	e := prot.Envelope{Room: res.page.Room, HistoryPage: res.page}
+	err = websocket.JSON.Send(q.cli.ws, &e)
+	if err != nil {
+		log.Println("send error:", err)
+	}
+}
+
+// historyHandler returns a page of the room history as json.
+//
+//	GET /api/history?room=ROOM&to=USER&parent=ID&before=ID&after=ID&limit=N
+//
+// If parent is set returns replies of the thread.
+func (s *Server) historyHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := getToken(r)
+	if err != nil {
+		http.Error(w, "no token "+err.Error(), http.StatusUnauthorized)
+		log.Println("history: no token.", err)
+		return
+	}
+
+	ua, err := s.users.GetAuthUser(token)
+	if err != nil {
+		http.Error(w, "no auth user", http.StatusUnauthorized)
+		log.Println("history: no auth user.", err)
+		return
+	}
+
+	q := r.URL.Query()
+	req := prot.HistoryRequest{
+		Room: q.Get("room"),
+		To:   q.Get("to"),
+	}
+
+	if q.Get("parent") != "" {
+		if req.Parent, err = strconv.ParseInt(q.Get("parent"), 10, 64); err != nil {
+			http.Error(w, "invalid parent", http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *int64
+	}{{"before", &req.Before}, {"after", &req.After}} {
+		if q.Get(p.name) == "" {
+			continue
+		}
+		if *p.dst, err = strconv.ParseInt(q.Get(p.name), 10, 64); err != nil {
+			http.Error(w, "invalid "+p.name, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if q.Get("limit") != "" {
+		if req.Limit, err = strconv.Atoi(q.Get("limit")); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	done := s.workerDone()
+	reply := make(chan *historyResult, 1)
+	var res *historyResult
+	select {
+	case s.historyChan <- &historyQuery{cli: &client{ua: ua}, req: req, reply: reply}:
+	case <-done:
+	}
+	select {
+	case res = <-reply:
+	case <-done:
+		http.Error(w, errNotRunning.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if res.err != nil {
+		http.Error(w, res.err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(append(res.data, '\n')); err != nil {
+		log.Println("history: cannot write page.", err)
+	}
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/milla-v/chat/prot"
+)
+
+func TestHistoryPage(t *testing.T) {
+	var h []prot.Envelope
+	for id := int64(1); id <= 10; id++ {
+		e := testEnvelope("general", "", time.Now())
+		e.Message.ID = id
+		h = append(h, *e)
+	}
+
+	tests := []struct {
+		req   prot.HistoryRequest
+		first int64
+		last  int64
+		more  bool
+	}{
+		{prot.HistoryRequest{Limit: 3}, 8, 10, true},
+		{prot.HistoryRequest{Before: 8, Limit: 3}, 5, 7, true},
+		{prot.HistoryRequest{Before: 3, Limit: 3}, 1, 2, false},
+		{prot.HistoryRequest{After: 2, Limit: 3}, 3, 5, true},
+		{prot.HistoryRequest{After: 8, Limit: 3}, 9, 10, false},
+	}
+
+	for _, tt := range tests {
+		page := historyPage(h, &tt.req)
+		n := len(page.Messages)
+		if n == 0 || page.Messages[0].ID != tt.first || page.Messages[n-1].ID != tt.last || page.More != tt.more {
+			t.Errorf("%+v: unexpected page %+v", tt.req, page)
+		}
+	}
+}
+
+func TestHistoryHandlerWhileEditing(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice"}})
+	defer os.RemoveAll(dir)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	c := newTestClient(t, s.Handler())
+	defer c.ts.Close()
+
+	c.do("POST", "/m", "hello", "T1")
+	if c.history("T1", "hello") == "" {
+		t.Fatal("no message")
+	}
+
+	done := c.editLoop("T1", "1 hello")
+	for i := 0; i < 20; i++ {
+		if code, body := c.do("GET", "/api/history?room=general", "", "T1"); code != http.StatusOK {
+			t.Fatalf("history: %d %s", code, body)
+		}
+	}
+	<-done
+}
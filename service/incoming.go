@@ -0,0 +1,274 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/milla-v/chat/auth"
+	"github.com/milla-v/chat/prot"
+)
+
+const maxHookBody = 64 * 1024 // max incoming webhook request size
+
+// incomingHook is an admin created webhook which posts messages into the room.
+type incomingHook struct {
+	Name    string    `json:"name"`            // bot display name
+	Room    string    `json:"room"`            // target room
+	Color   string    `json:"color,omitempty"` // RGB color
+	Token   string    `json:"token"`           // secret token, part of the hook url
+	Creator string    `json:"creator"`         // admin who created the hook
+	Created time.Time `json:"created"`         // creation time
+}
+
+// hookPost is an incoming webhook request passed to the worker.
+type hookPost struct {
+	token string
+	text  string
+	reply chan error
+}
+
+var colorRe = regexp.MustCompile("^[0-9A-Fa-f]{6}$")
+
+func (s *Server) incomingHooksFile() string {
+	cfg := s.config()
+	return cfg.WorkDir + privateDir + "webhooks.json"
+}
+
+func (s *Server) loadIncomingHooks() {
+	data, err := ioutil.ReadFile(s.incomingHooksFile())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &s.incomingHooks)
+	}
+	if err != nil {
+		log.Println("webhooks: cannot load:", err)
+	}
+}
+
+func (s *Server) saveIncomingHooks() {
+	cfg := s.config()
+	data, err := json.MarshalIndent(s.incomingHooks, "", "\t")
+	if err != nil {
+		log.Println("webhooks: cannot save:", err)
+		return
+	}
+
+	if err = os.MkdirAll(cfg.WorkDir+privateDir, 0700); err != nil {
+		log.Println("webhooks: cannot save:", err)
+		return
+	}
+
+	if err = ioutil.WriteFile(s.incomingHooksFile(), data, 0600); err != nil {
+		log.Println("webhooks: cannot save:", err)
+	}
+}
+
+func (s *Server) hookURL(h *incomingHook) string {
+	cfg := s.config()
+	return "https://" + cfg.Address + "/hook/" + h.Token
+}
+
+func newHookToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// findHook finds incoming webhook by token.
+func (s *Server) findHook(token string) *incomingHook {
+	for _, h := range s.incomingHooks {
+		if subtle.ConstantTimeCompare([]byte(h.Token), []byte(token)) == 1 {
+			return h
+		}
+	}
+	return nil
+}
+
+// addIncomingHook creates a webhook posting into the room under the name.
+func (s *Server) addIncomingHook(creator, room, name, color string) (*incomingHook, error) {
+	r, err := s.getRoom(room)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(name) < 3 {
+		return nil, errors.New("name should be at least 3 characters")
+	}
+
+	if _, ok := s.incomingHooks[name]; ok || s.users.UserExists(name) || s.isOutgoingBot(name) {
+		return nil, errors.New("name is already taken: " + name)
+	}
+
+	if color != "" && !colorRe.MatchString(color) {
+		return nil, errors.New("color should be RRGGBB: " + color)
+	}
+
+	token, err := newHookToken()
+	if err != nil {
+		return nil, err
+	}
+
+	h := &incomingHook{
+		Name:    name,
+		Room:    r.name,
+		Color:   strings.ToUpper(color),
+		Token:   token,
+		Creator: creator,
+		Created: time.Now(),
+	}
+	s.incomingHooks[name] = h
+	s.saveIncomingHooks()
+	return h, nil
+}
+
+func (s *Server) processHookPost(p *hookPost) {
+	h := s.findHook(p.token)
+	if h == nil {
+		p.reply <- errors.New("no such webhook")
+		return
+	}
+
+	r, err := s.getRoom(h.Room)
+	if err != nil {
+		p.reply <- err
+		return
+	}
+
+	bot := &client{ua: &auth.UserAuth{Name: h.Name}}
+	s.sendToRoom(r, &message{from: bot, text: p.text, room: r.name, color: h.Color, webhook: true})
+	p.reply <- nil
+}
+
+// webhookCommand handles "/webhook add ROOM NAME [COLOR]", "/webhook list" and "/webhook revoke NAME" commands.
+func (s *Server) webhookCommand(m *message, arg string) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		fields = []string{"list"}
+	}
+
+	switch {
+	case fields[0] == "add" && (len(fields) == 3 || len(fields) == 4):
+		color := ""
+		if len(fields) == 4 {
+			color = fields[3]
+		}
+		h, err := s.addIncomingHook(m.from.ua.Name, fields[1], fields[2], color)
+		if err != nil {
+			sendInfo(m.from, err.Error())
+			return
+		}
+		log.Println("webhooks:", m.from.ua.Name, "added", h.Name, "to", h.Room)
+		sendInfo(m.from, "webhook "+h.Name+" posts to #"+h.Room+"\n"+s.hookURL(h))
+
+	case fields[0] == "list" && len(fields) == 1:
+		var names []string
+		for name := range s.incomingHooks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		text := "webhooks:\n"
+		for _, name := range names {
+			h := s.incomingHooks[name]
+			text += fmt.Sprintf("%s #%s by %s %s\n\t%s\n", h.Name, h.Room, h.Creator, h.Created.Format("2006-01-02"), s.hookURL(h))
+		}
+		sendInfo(m.from, text)
+
+	case fields[0] == "revoke" && len(fields) == 2:
+		if _, ok := s.incomingHooks[fields[1]]; !ok {
+			sendInfo(m.from, "no such webhook: "+fields[1])
+			return
+		}
+		delete(s.incomingHooks, fields[1])
+		s.saveIncomingHooks()
+		log.Println("webhooks:", m.from.ua.Name, "revoked", fields[1])
+		sendInfo(m.from, "webhook "+fields[1]+" revoked")
+
+	default:
+		sendInfo(m.from, "usage: /webhook add ROOM NAME [RRGGBB] | list | revoke NAME")
+	}
+}
+
+func init() {
+	registerCommand(&command{name: "/webhook", args: "add ROOM NAME [RRGGBB] | list | revoke NAME", help: "manage incoming webhooks", perm: permAdmin, run: (*Server).webhookCommand})
+}
+
+// incomingHookText reads message text from plain text or JSON request body.
+func incomingHookText(r *http.Request) (string, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxHookBody))
+	if err != nil {
+		return "", err
+	}
+
+	text := string(body)
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/json" {
+		var wm prot.WebhookResponse
+		if err = json.Unmarshal(body, &wm); err != nil {
+			return "", err
+		}
+		text = wm.Text
+	}
+
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", errors.New("text is empty")
+	}
+	return html.EscapeString(text), nil
+}
+
+// incomingHookHandler posts the request text to the room of the webhook. URL is /hook/TOKEN.
+func (s *Server) incomingHookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST method allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, "/hook/")
+	if token == "" {
+		http.Error(w, "no token", http.StatusUnauthorized)
+		return
+	}
+
+	text, err := incomingHookText(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Println("webhooks:", err)
+		return
+	}
+
+	done := s.workerDone()
+	p := &hookPost{token: token, text: text, reply: make(chan error, 1)}
+	select {
+	case s.hookChan <- p:
+	case <-done:
+	}
+	select {
+	case err = <-p.reply:
+	case <-done:
+		http.Error(w, errNotRunning.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		log.Println("webhooks:", err)
+	}
+}
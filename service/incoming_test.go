@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIncomingHookText(t *testing.T) {
+	tests := []struct {
+		ctype string
+		body  string
+		text  string
+		ok    bool
+	}{
+		{"text/plain", "build <ok>\n", "build &lt;ok&gt;", true},
+		{"", "deployed", "deployed", true},
+		{"application/json; charset=utf-8", `{"text": "tests failed"}`, "tests failed", true},
+		{"application/json", `{"text": 1}`, "", false},
+		{"application/json", `{}`, "", false},
+		{"text/plain", "  ", "", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/hook/token", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", tt.ctype)
+		text, err := incomingHookText(r)
+		if text != tt.text || (err == nil) != tt.ok {
+			t.Errorf("%s %q: got %q %v", tt.ctype, tt.body, text, err)
+		}
+	}
+}
+
+func TestIncomingHookHandler(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "admin", "T2": "bob"}})
+	defer os.RemoveAll(dir)
+	c := *s.config()
+	c.Admins = []string{"admin"}
+	s.cfg.Store(&c)
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	tc := newTestClient(t, s.Handler())
+	defer tc.ts.Close()
+
+	// savedHooks waits until the saved hooks have or do not have the name.
+	savedHooks := func(name string, saved bool) map[string]*incomingHook {
+		for i := 0; i < 50; i++ {
+			hooks := map[string]*incomingHook{}
+			data, _ := ioutil.ReadFile(s.incomingHooksFile())
+			json.Unmarshal(data, &hooks)
+			if _, ok := hooks[name]; ok == saved {
+				return hooks
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("hook %s saved: %v", name, !saved)
+		return nil
+	}
+
+	tc.do("POST", "/m", "/webhook add general cibot 00ff00", "T1")
+	token := savedHooks("cibot", true)["cibot"].Token
+
+	if code, body := tc.do("POST", "/hook/"+token, "build ok", ""); code != http.StatusOK {
+		t.Fatalf("post: %d %s", code, body)
+	}
+	if tc.history("T1", "build ok") == "" {
+		t.Error("hook message is not in the history")
+	}
+
+	tests := []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/hook/" + token, http.StatusMethodNotAllowed},
+		{"POST", "/hook/", http.StatusUnauthorized},
+		{"POST", "/hook/wrong" + token, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if code, _ := tc.do(tt.method, tt.path, "text", ""); code != tt.code {
+			t.Errorf("%s %s: %d, want %d", tt.method, tt.path, code, tt.code)
+		}
+	}
+
+	// commands are processed in order, so the last added hook is saved after the rejected ones
+	tc.do("POST", "/m", "/webhook add general bob", "T1")
+	tc.do("POST", "/m", "/webhook add general evil", "T2")
+	tc.do("POST", "/m", "/webhook add general cibot2", "T1")
+	hooks := savedHooks("cibot2", true)
+	if hooks["bob"] != nil || hooks["evil"] != nil {
+		t.Errorf("hooks: %v", hooks)
+	}
+
+	// hooks are loaded on start
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := tc.do("POST", "/hook/"+token, "after restart", ""); code != http.StatusOK {
+		t.Errorf("post after restart: %d %s", code, body)
+	}
+
+	tc.do("POST", "/m", "/webhook revoke cibot", "T1")
+	savedHooks("cibot", false)
+	if code, _ := tc.do("POST", "/hook/"+token, "revoked", ""); code != http.StatusNotFound {
+		t.Errorf("revoked hook: %d", code)
+	}
+}
+
+func TestIncomingHookEmptyRoom(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "admin"}})
+	defer os.RemoveAll(dir)
+	c := *s.config()
+	c.Admins = []string{"admin"}
+	s.cfg.Store(&c)
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	tc := newTestClient(t, s.Handler())
+	defer tc.ts.Close()
+
+	tc.do("POST", "/m", "/webhook add builds cibot", "T1")
+	var token string
+	for i := 0; i < 50 && token == ""; i++ {
+		hooks := map[string]*incomingHook{}
+		data, _ := ioutil.ReadFile(s.incomingHooksFile())
+		json.Unmarshal(data, &hooks)
+		if h := hooks["cibot"]; h != nil {
+			token = h.Token
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if token == "" {
+		t.Fatal("hook is not saved")
+	}
+
+	// the room has no history, so it is not loaded on start
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, body := tc.do("POST", "/hook/"+token, "build ok", ""); code != http.StatusOK {
+		t.Fatalf("post after restart: %d %s", code, body)
+	}
+	if _, body := tc.do("GET", "/api/history?room=builds", "", "T1"); !strings.Contains(body, "build ok") {
+		t.Errorf("history: %s", body)
+	}
+}
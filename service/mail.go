@@ -0,0 +1,49 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/milla-v/chat/mailer"
+)
+
+// newTransport creates the mailer configured by cfg.Mail.
+func (s *Server) newTransport() (mailer.Mailer, error) {
+	cfg := s.config()
+	mc := cfg.Mail
+	switch mc.Transport {
+	case "smtp", "":
+		if mc.SMTPAddr == "" {
+			return nil, fmt.Errorf("mail: smtp_addr is not set")
+		}
+		return &mailer.SMTP{
+			Addr:       mc.SMTPAddr,
+			From:       mc.From,
+			Username:   mc.Username,
+			Password:   mc.Password,
+			RequireTLS: mc.RequireTLS,
+		}, nil
+	case "maildir":
+		dir := mc.Maildir
+		if dir == "" {
+			dir = cfg.WorkDir + privateDir + "maildir/"
+		}
+		return &mailer.Maildir{Dir: dir, From: mc.From}, nil
+	}
+	return nil, fmt.Errorf("mail: unknown transport %q", mc.Transport)
+}
+
+// openMail starts the outgoing mail queue and sets it as the server outbox.
+func (s *Server) openMail() error {
+	cfg := s.config()
+	transport, err := s.newTransport()
+	if err != nil {
+		return err
+	}
+
+	if s.mailQueue, err = mailer.NewQueue(cfg.WorkDir+privateDir+"mailq/", transport); err != nil {
+		return err
+	}
+
+	s.outbox = s.mailQueue
+	return nil
+}
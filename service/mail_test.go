@@ -0,0 +1,31 @@
+package service
+
+import (
+	"os"
+	"testing"
+
+	"github.com/milla-v/chat/mailer"
+)
+
+func TestNewTransport(t *testing.T) {
+	s, dir := newTestServer(t, Options{})
+	defer os.RemoveAll(dir)
+
+	m, err := s.newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.(*mailer.SMTP); !ok {
+		t.Errorf("default transport: %T", m)
+	}
+
+	c := *s.config()
+	c.Mail.Transport = "maildir"
+	s.cfg.Store(&c)
+	if m, err = s.newTransport(); err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := m.(*mailer.Maildir); !ok || d.Dir != dir+"/"+privateDir+"maildir/" {
+		t.Errorf("maildir transport: %+v", m)
+	}
+}
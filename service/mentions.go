@@ -0,0 +1,232 @@
+package service
+
+import (
+	"encoding/json"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/milla-v/chat/prot"
+)
+
+const (
+	maxInbox           = 500 // max message ids in the mentions inbox
+	defaultInboxLimit  = 20  // default number of messages returned from the inbox
+	maxMentionsPerText = 20  // max mentions parsed from one message
+)
+
+var mentionRe = regexp.MustCompile(`(?:^|[^\w@])@([A-Za-z0-9_.\-]+)`)
+
+// parseMentions returns unique mentioned usernames which exist in the user store and "all" or "here".
+// Text is escaped.
+func (s *Server) parseMentions(text string) []string {
+	var list []string
+	seen := map[string]bool{}
+	for _, m := range mentionRe.FindAllStringSubmatch(html.UnescapeString(text), maxMentionsPerText) {
+		name := strings.TrimRight(m[1], ".-")
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if name == prot.MentionAll || name == prot.MentionHere || s.users.UserExists(name) {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// mentionTargets resolves message mentions into the names of room users who should be notified.
+// @all notifies all room members including offline ones, @here only online members.
+func (s *Server) mentionTargets(r *room, mentions []string) map[string]bool {
+	targets := map[string]bool{}
+	for _, name := range mentions {
+		switch name {
+		case prot.MentionAll:
+			for name := range r.members {
+				targets[name] = true
+			}
+		case prot.MentionHere:
+			for _, c := range r.clients {
+				if c.ws != nil && s.userPresence(c.ua.Name).State == prot.PresenceOnline {
+					targets[c.ua.Name] = true
+				}
+			}
+		default:
+			targets[name] = true
+		}
+	}
+	return targets
+}
+
+func (s *Server) inboxFile(name string) string {
+	cfg := s.config()
+	return cfg.WorkDir + privateDir + "mentions-" + name + ".json"
+}
+
+// userInbox returns mentioned message ids of the user. Loads them from the file on first use.
+func (s *Server) userInbox(name string) []int64 {
+	if ids, ok := s.inboxes[name]; ok {
+		return ids
+	}
+
+	var ids []int64
+	data, err := ioutil.ReadFile(s.inboxFile(name))
+	if err == nil {
+		err = json.Unmarshal(data, &ids)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("mentions:", name, err)
+	}
+
+	s.inboxes[name] = ids
+	return ids
+}
+
+func (s *Server) saveInbox(name string) {
+	cfg := s.config()
+	data, err := json.Marshal(s.inboxes[name])
+	if err != nil {
+		log.Println("mentions:", name, err)
+		return
+	}
+
+	if err = os.MkdirAll(cfg.WorkDir+privateDir, 0700); err != nil {
+		log.Println("mentions:", name, err)
+		return
+	}
+
+	if err = ioutil.WriteFile(s.inboxFile(name), data, 0600); err != nil {
+		log.Println("mentions:", name, err)
+	}
+}
+
+// addMentions adds the message to the inboxes of the mentioned users.
+func (s *Server) addMentions(msg *prot.Message, targets map[string]bool) {
+	for name := range targets {
+		if name == msg.Name {
+			continue
+		}
+		ids := append(s.userInbox(name), msg.ID)
+		if len(ids) > maxInbox {
+			ids = ids[len(ids)-maxInbox:]
+		}
+		s.inboxes[name] = ids
+		s.saveInbox(name)
+	}
+}
+
+// inboxFor returns messages which mention the user, newest first.
+func (s *Server) inboxFor(name string, limit int) *prot.Inbox {
+	if limit <= 0 || limit > maxInbox {
+		limit = defaultInboxLimit
+	}
+
+	inbox := &prot.Inbox{Name: name, Messages: []*prot.Message{}}
+	ids := s.userInbox(name)
+	for i := len(ids) - 1; i >= 0 && len(inbox.Messages) < limit; i-- {
+		if msg, ok := s.index.messages[ids[i]]; ok && !msg.Deleted {
+			inbox.Messages = append(inbox.Messages, msg)
+		}
+	}
+	return inbox
+}
+
+// mentionsQuery is a mentions inbox request passed to the worker.
+// The worker replies with json encoded prot.Inbox or nil on error.
+type mentionsQuery struct {
+	user  string
+	limit int
+	reply chan []byte
+}
+
+// processMentionsQuery encodes the inbox in the worker because the messages are changed by edits and reactions.
+func (s *Server) processMentionsQuery(q *mentionsQuery) {
+	data, err := json.Marshal(s.inboxFor(q.user, q.limit))
+	if err != nil {
+		log.Println("mentions: cannot encode inbox.", err)
+	}
+	q.reply <- data
+}
+
+// mentionsCommand handles "/mentions [N]" command.
+func (s *Server) mentionsCommand(m *message, arg string) {
+	limit := 0
+	if arg != "" {
+		var err error
+		if limit, err = strconv.Atoi(arg); err != nil {
+			sendInfo(m.from, "usage: /mentions [N]")
+			return
+		}
+	}
+
+	inbox := s.inboxFor(m.from.ua.Name, limit)
+	if len(inbox.Messages) == 0 {
+		sendInfo(m.from, "no mentions")
+		return
+	}
+
+	text := ""
+	for _, msg := range inbox.Messages {
+		text += formatSearchHit(msg) + "\n"
+	}
+	sendInfo(m.from, text)
+}
+
+func init() {
+	registerCommand(&command{name: "/mentions", args: "[N]", help: "show last messages which mention you", run: (*Server).mentionsCommand})
+}
+
+// mentionsHandler returns messages which mention the user as json.
+//
+//	GET /api/mentions?limit=N
+func (s *Server) mentionsHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := getToken(r)
+	if err != nil {
+		http.Error(w, "no token "+err.Error(), http.StatusUnauthorized)
+		log.Println("mentions: no token.", err)
+		return
+	}
+
+	ua, err := s.users.GetAuthUser(token)
+	if err != nil {
+		http.Error(w, "no auth user", http.StatusUnauthorized)
+		log.Println("mentions: no auth user.", err)
+		return
+	}
+
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	done := s.workerDone()
+	reply := make(chan []byte, 1)
+	var data []byte
+	select {
+	case s.mentionsChan <- &mentionsQuery{user: ua.Name, limit: limit, reply: reply}:
+	case <-done:
+	}
+	select {
+	case data = <-reply:
+	case <-done:
+		http.Error(w, errNotRunning.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if data == nil {
+		http.Error(w, "cannot encode inbox", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(append(data, '\n')); err != nil {
+		log.Println("mentions: cannot write inbox.", err)
+	}
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/milla-v/chat/auth"
+	"github.com/milla-v/chat/prot"
+)
+
+func TestMentions(t *testing.T) {
+	s, dir := newTestServer(t, Options{})
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"alice", "bob"} {
+		if err := ioutil.WriteFile(dir+"/user-"+name+".txt", nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		text     string
+		mentions []string
+	}{
+		{"@alice hi", []string{"alice"}},
+		{"hi @bob, @alice and @bob.", []string{"bob", "alice"}},
+		{"mail alice@example.com", nil},
+		{"@nobody @all", []string{"all"}},
+		{"(@here) @../alice", []string{"here"}},
+	}
+	for _, tt := range tests {
+		if m := s.parseMentions(tt.text); !reflect.DeepEqual(m, tt.mentions) {
+			t.Errorf("%q: got %v, want %v", tt.text, m, tt.mentions)
+		}
+	}
+
+	r := &room{name: "test"}
+	clients := map[string]*client{}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		clients[name] = &client{ua: &auth.UserAuth{Name: name}}
+		r.join(clients[name])
+	}
+	r.leave(clients["carol"]) // carol disconnects and stays a member
+
+	targets := s.mentionTargets(r, []string{"bob", "dave"})
+	if !reflect.DeepEqual(targets, map[string]bool{"bob": true, "dave": true}) {
+		t.Errorf("targets: %v", targets)
+	}
+
+	targets = s.mentionTargets(r, []string{"all"})
+	if len(targets) != 3 || !targets["carol"] {
+		t.Errorf("all targets: %v", targets)
+	}
+
+	if targets = s.mentionTargets(r, []string{"here"}); len(targets) != 0 {
+		t.Errorf("here targets of disconnected clients: %v", targets)
+	}
+
+	for i := int64(1); i <= 3; i++ {
+		e := testEnvelope("test", "@all", time.Now())
+		e.Message.ID = i
+		e.Message.Name = "alice"
+		s.index.add(e.Message)
+		s.addMentions(e.Message, s.mentionTargets(r, []string{"all"}))
+	}
+	s.index.messages[2].Deleted = true
+
+	if inbox := s.inboxFor("alice", 0); len(inbox.Messages) != 0 {
+		t.Errorf("own messages in inbox: %d", len(inbox.Messages))
+	}
+
+	delete(s.inboxes, "bob") // reload from the file
+	inbox := s.inboxFor("bob", 0)
+	if len(inbox.Messages) != 2 || inbox.Messages[0].ID != 3 || inbox.Messages[1].ID != 1 {
+		t.Errorf("inbox: %+v", inbox.Messages)
+	}
+}
+
+func TestMentionsHandlerWhileEditing(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice", "T2": "bob"}})
+	defer os.RemoveAll(dir)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	c := newTestClient(t, s.Handler())
+	defer c.ts.Close()
+
+	c.do("POST", "/m", "@bob hello", "T1")
+	if c.history("T1", "hello") == "" {
+		t.Fatal("no message")
+	}
+
+	done := c.editLoop("T1", "1 @bob hello")
+	for i := 0; i < 20; i++ {
+		code, body := c.do("GET", "/api/mentions", "", "T2")
+		var inbox prot.Inbox
+		if err := json.Unmarshal([]byte(body), &inbox); code != http.StatusOK || err != nil || len(inbox.Messages) != 1 {
+			t.Fatalf("mentions: %d %s", code, body)
+		}
+	}
+	<-done
+}
+
+func TestMentionAllOffline(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice", "T2": "bob", "T3": "carol"}})
+	defer os.RemoveAll(dir)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	c := newTestClient(t, s.Handler())
+	defer c.ts.Close()
+
+	for _, token := range []string{"T1", "T2"} {
+		ws := c.dial(token)
+		c.do("POST", "/m", "/join dev", token)
+		ws.Close()
+	}
+	c.dial("T3").Close()
+
+	// members are kept after disconnect and restart
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, body := c.do("POST", "/m?room=dev", "@all standup", "T1"); code != http.StatusOK || body != "" {
+		t.Fatalf("post: %d %q", code, body)
+	}
+	for _, tt := range []struct {
+		token string
+		n     int
+	}{{"T1", 0}, {"T2", 1}, {"T3", 0}} {
+		var inbox prot.Inbox
+		_, body := c.do("GET", "/api/mentions", "", tt.token)
+		if err := json.Unmarshal([]byte(body), &inbox); err != nil || len(inbox.Messages) != tt.n {
+			t.Errorf("%s mentions: %s", tt.token, body)
+		}
+	}
+}
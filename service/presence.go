@@ -0,0 +1,192 @@
+package service
+
+import (
+	"encoding/json"
+	"html"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/milla-v/chat/prot"
+)
+
+const (
+	idleTimeout     = time.Minute * 5  // no activity time after which user is idle
+	awayTimeout     = time.Minute * 30 // no activity time after which user is away
+	maxStatusLength = 64               // max status text length in runes
+)
+
+var (
+	pingInterval      = time.Minute      // clients are pinged and the roster is broadcast every interval
+	pongTimeout       = pingInterval * 3 // no pong time after which user is away. Exceeds ping interval and round trip
+	disconnectTimeout = time.Minute * 12 // no pong time after which the client is disconnected
+)
+
+// userStatus is a status set by the user.
+type userStatus struct {
+	Status string `json:"status,omitempty"`
+	DND    bool   `json:"dnd,omitempty"`
+}
+
+func (s *Server) statusesFile() string {
+	cfg := s.config()
+	return cfg.WorkDir + privateDir + "presence.json"
+}
+
+func (s *Server) loadStatuses() {
+	data, err := ioutil.ReadFile(s.statusesFile())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &s.statuses)
+	}
+	if err != nil {
+		log.Println("presence: cannot load statuses:", err)
+	}
+}
+
+func (s *Server) saveStatuses() {
+	cfg := s.config()
+	data, err := json.Marshal(s.statuses)
+	if err != nil {
+		log.Println("presence: cannot save statuses:", err)
+		return
+	}
+
+	if err = os.MkdirAll(cfg.WorkDir+privateDir, 0700); err != nil {
+		log.Println("presence: cannot save statuses:", err)
+		return
+	}
+
+	if err = ioutil.WriteFile(s.statusesFile(), data, 0600); err != nil {
+		log.Println("presence: cannot save statuses:", err)
+	}
+}
+
+// presenceState calculates presence state from the user connection times.
+func presenceState(connected bool, lastActive, lastPong, now time.Time) string {
+	switch {
+	case !connected:
+		return prot.PresenceOffline
+	case now.Sub(lastPong) > pongTimeout || now.Sub(lastActive) > awayTimeout:
+		return prot.PresenceAway
+	case now.Sub(lastActive) > idleTimeout:
+		return prot.PresenceIdle
+	}
+	return prot.PresenceOnline
+}
+
+// userPresence aggregates presence of all user connections.
+func (s *Server) userPresence(name string) *prot.Presence {
+	p := &prot.Presence{Name: name}
+	if st, ok := s.statuses[name]; ok {
+		p.Status = st.Status
+		p.DND = st.DND
+	}
+
+	connected := false
+	var lastPong time.Time
+	for _, c := range s.clients {
+		if c.ua.Name != name || c.ws == nil {
+			continue
+		}
+		connected = true
+		if c.lastMessageTime.After(p.LastActive) {
+			p.LastActive = c.lastMessageTime
+		}
+		if c.connectTime.After(p.LastActive) {
+			p.LastActive = c.connectTime
+		}
+		if c.lastPongTime.After(lastPong) {
+			lastPong = c.lastPongTime
+		}
+	}
+
+	p.State = presenceState(connected, p.LastActive, lastPong, time.Now())
+	return p
+}
+
+// roomPresence returns presence of room users sorted by name.
+func (s *Server) roomPresence(r *room) []*prot.Presence {
+	seen := map[string]bool{}
+	list := []*prot.Presence{}
+	for _, c := range r.clients {
+		if seen[c.ua.Name] {
+			continue
+		}
+		seen[c.ua.Name] = true
+		list = append(list, s.userPresence(c.ua.Name))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (s *Server) isDND(name string) bool {
+	st, ok := s.statuses[name]
+	return ok && st.DND
+}
+
+// broadcastRoster sends roster to every connected client.
+func (s *Server) broadcastRoster() {
+	for _, c := range s.clients {
+		if c.ws != nil {
+			s.sendRoster(c)
+		}
+	}
+}
+
+func (s *Server) setStatus(cli *client, p *prot.Presence) {
+	text := strings.TrimSpace(p.Status)
+	if utf8.RuneCountInString(text) > maxStatusLength {
+		text = cutRunes(text, maxStatusLength)
+	}
+
+	s.statuses[cli.ua.Name] = &userStatus{Status: text, DND: p.DND}
+	s.saveStatuses()
+	s.broadcastRoster()
+}
+
+// statusCommand handles "/status TEXT" and "/dnd on|off" commands.
+func (s *Server) statusCommand(cli *client, cmd, arg string) {
+	p := s.userPresence(cli.ua.Name)
+	switch cmd {
+	case "/status":
+		p.Status = arg
+	case "/dnd":
+		switch arg {
+		case "on":
+			p.DND = true
+		case "off":
+			p.DND = false
+		default:
+			sendInfo(cli, "usage: /dnd on|off")
+			return
+		}
+	}
+	s.setStatus(cli, p)
+}
+
+// presenceUpdate is a status update passed to the worker.
+type presenceUpdate struct {
+	cli      *client
+	presence prot.Presence
+}
+
+// escapePresence escapes the status received from the client.
+func escapePresence(p *prot.Presence) {
+	p.Status = html.EscapeString(p.Status)
+}
+
+// withoutNotification returns a copy of the message envelope without notification for DND users.
+func withoutNotification(e *prot.Envelope) *prot.Envelope {
+	c := *e
+	m := *e.Message
+	m.Notification = ""
+	c.Message = &m
+	return &c
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/milla-v/chat/prot"
+)
+
+func TestPresenceState(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		connected  bool
+		lastActive time.Duration
+		lastPong   time.Duration
+		state      string
+	}{
+		{false, 0, 0, prot.PresenceOffline},
+		{true, time.Minute, time.Minute, prot.PresenceOnline},
+		{true, time.Minute * 10, time.Minute, prot.PresenceIdle},
+		{true, time.Hour, time.Minute, prot.PresenceAway},
+		{true, time.Minute, time.Minute * 15, prot.PresenceAway},
+	}
+
+	for _, tt := range tests {
+		state := presenceState(tt.connected, now.Add(-tt.lastActive), now.Add(-tt.lastPong), now)
+		if state != tt.state {
+			t.Errorf("%+v: got %s", tt, state)
+		}
+	}
+}
+
+func TestPingTick(t *testing.T) {
+	defer func(ping, pong time.Duration) { pingInterval, pongTimeout = ping, pong }(pingInterval, pongTimeout)
+	pingInterval = 100 * time.Millisecond
+	pongTimeout = pingInterval * 3
+
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice"}})
+	defer os.RemoveAll(dir)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	wc, err := websocket.NewConfig(strings.Replace(ts.URL, "http", "ws", 1)+"/ws", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc.Header.Set("Token", "T1")
+	ws, err := websocket.DialConfig(wc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// healthy client answers pings. Rosters after the first tick must show it online.
+	pings, rosters := 0, 0
+	ws.SetReadDeadline(time.Now().Add(pingInterval*5 + pingInterval/2))
+	for {
+		var e prot.Envelope
+		if err = websocket.JSON.Receive(ws, &e); err != nil {
+			break
+		}
+		switch {
+		case e.Ping != nil:
+			pings++
+			e.Ping.Pong = e.Ping.Ping
+			if err = websocket.JSON.Send(ws, &e); err != nil {
+				t.Fatal(err)
+			}
+		case e.Roster != nil && pings > 0:
+			rosters++
+			if len(e.Roster.Users) != 1 || e.Roster.Users[0].State != prot.PresenceOnline {
+				t.Errorf("roster after %d pings: %+v", pings, e.Roster.Users)
+			}
+		}
+	}
+	if pings < 3 || rosters < 3 {
+		t.Errorf("pings: %d, rosters: %d", pings, rosters)
+	}
+}
+
+func TestPresenceWhilePinging(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice"}})
+	defer os.RemoveAll(dir)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	tc := newTestClient(t, s.Handler())
+	defer tc.ts.Close()
+
+	wc, err := websocket.NewConfig(strings.Replace(tc.ts.URL, "http", "ws", 1)+"/ws", tc.ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc.Header.Set("Token", "T1")
+	ws, err := websocket.DialConfig(wc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	go func() {
+		for {
+			var e prot.Envelope
+			if websocket.JSON.Receive(ws, &e) != nil {
+				return
+			}
+		}
+	}()
+
+	// the client pongs and posts while the worker calculates presence for the roster and status
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 50; i++ {
+			websocket.JSON.Send(ws, &prot.Envelope{Ping: &prot.Ping{Ping: i, Pong: i}})
+			websocket.JSON.Send(ws, &prot.Envelope{Message: &prot.Message{Text: "hi"}})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		tc.do("POST", "/m", "/status busy", "T1")
+	}
+	<-done
+
+	if body := tc.history("T1", "hi"); body == "" {
+		t.Error("messages are not posted")
+	}
+}
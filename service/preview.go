@@ -0,0 +1,344 @@
+package service
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/milla-v/chat/markdown"
+	"github.com/milla-v/chat/prot"
+)
+
+const (
+	previewTimeout      = time.Second * 5  // page fetch timeout
+	maxPreviewBody      = 256 * 1024       // max page size read for the preview
+	maxPreviewRedirects = 3                // max number of redirects
+	previewCacheTTL     = time.Hour * 24   // preview cache time
+	maxPreviewTitle     = 120              // max title length in runes
+	maxPreviewText      = 300              // max description length in runes
+	previewUserAgent    = "chat-preview/1" // user agent of the preview fetcher
+)
+
+var (
+	metaRe  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	attrRe  = regexp.MustCompile(`(?is)([a-z:_-]+)\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+)`)
+	titleRe = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	spaceRe = regexp.MustCompile(`\s+`)
+
+	privateNets = parseCIDRs(
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "::1/128", "fc00::/7", "fe80::/10",
+	)
+)
+
+func parseCIDRs(list ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range list {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// blockedIP checks if the address is private, loopback or link local.
+func blockedIP(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreviewAddr is called before connecting to the resolved address of the page.
+func (s *Server) checkPreviewAddr(network, address string, c syscall.RawConn) error {
+	if s.config().PreviewAllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || blockedIP(ip) {
+		return errors.New("preview: blocked address " + host)
+	}
+	return nil
+}
+
+// newPreviewClient creates the page fetcher which does not connect to blocked addresses.
+func (s *Server) newPreviewClient() *http.Client {
+	return &http.Client{
+		Timeout: previewTimeout,
+		Transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: previewTimeout, Control: s.checkPreviewAddr}).DialContext,
+			TLSHandshakeTimeout: previewTimeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxPreviewRedirects {
+				return errors.New("preview: too many redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// previewLink returns the first link of the escaped message text.
+func previewLink(text string) string {
+	links := markdown.Links(markdown.Parse(html.UnescapeString(text)))
+	for _, u := range links {
+		if strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
+			return u
+		}
+	}
+	return ""
+}
+
+// cleanText unescapes page text, removes control characters and collapses spaces.
+func cleanText(s string, max int) string {
+	s = spaceRe.ReplaceAllString(html.UnescapeString(s), " ")
+	s = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s))
+	if utf8.RuneCountInString(s) > max {
+		s = cutRunes(s, max)
+	}
+	return s
+}
+
+// parsePreview extracts OpenGraph or html meta preview from the page.
+func parsePreview(page string, base *url.URL) *prot.Preview {
+	if n := strings.Index(strings.ToLower(page), "</head>"); n > 0 {
+		page = page[:n]
+	}
+
+	meta := map[string]string{}
+	for _, tag := range metaRe.FindAllString(page, -1) {
+		attrs := map[string]string{}
+		for _, a := range attrRe.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(a[1])] = strings.Trim(a[2], `"'`)
+		}
+		key := attrs["property"]
+		if key == "" {
+			key = attrs["name"]
+		}
+		key = strings.ToLower(key)
+		if _, ok := meta[key]; key != "" && !ok {
+			meta[key] = attrs["content"]
+		}
+	}
+
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := meta[k]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	p := &prot.Preview{
+		URL:         base.String(),
+		Title:       first("og:title", "twitter:title"),
+		Description: first("og:description", "twitter:description", "description"),
+		SiteName:    first("og:site_name"),
+	}
+
+	if p.Title == "" {
+		if m := titleRe.FindStringSubmatch(page); m != nil {
+			p.Title = m[1]
+		}
+	}
+
+	p.Title = cleanText(p.Title, maxPreviewTitle)
+	p.Description = cleanText(p.Description, maxPreviewText)
+	p.SiteName = cleanText(p.SiteName, maxPreviewTitle)
+
+	if img := first("og:image", "og:image:url", "twitter:image"); img != "" {
+		if u, err := base.Parse(html.UnescapeString(strings.TrimSpace(img))); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			p.Image = u.String()
+		}
+	}
+
+	return p
+}
+
+// fetchPreview downloads the beginning of the page and parses its preview.
+func (s *Server) fetchPreview(link string) (*prot.Preview, error) {
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", previewUserAgent)
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := s.previewClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("preview: " + resp.Status)
+	}
+
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if ct != "text/html" && ct != "application/xhtml+xml" {
+		return nil, errors.New("preview: not html: " + ct)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPreviewBody))
+	if err != nil {
+		return nil, err
+	}
+
+	p := parsePreview(string(data), resp.Request.URL)
+	p.URL = link
+	return p, nil
+}
+
+func (s *Server) previewCacheFile(link string) string {
+	cfg := s.config()
+	sum := sha1.Sum([]byte(link))
+	return cfg.WorkDir + privateDir + "previews/" + hex.EncodeToString(sum[:]) + ".json"
+}
+
+// cachedPreview returns fresh cached preview. Failed fetches are cached as previews without title.
+func (s *Server) cachedPreview(link string) (*prot.Preview, bool) {
+	fname := s.previewCacheFile(link)
+	st, err := os.Stat(fname)
+	if err != nil || time.Since(st.ModTime()) > previewCacheTTL {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, false
+	}
+
+	var p prot.Preview
+	if err = json.Unmarshal(data, &p); err != nil || p.URL != link {
+		return nil, false
+	}
+	return &p, true
+}
+
+func (s *Server) cachePreview(p *prot.Preview) {
+	cfg := s.config()
+	data, err := json.Marshal(p)
+	if err != nil {
+		log.Println("preview: cannot cache:", err)
+		return
+	}
+
+	if err = os.MkdirAll(cfg.WorkDir+privateDir+"previews/", 0700); err != nil {
+		log.Println("preview: cannot cache:", err)
+		return
+	}
+
+	if err = ioutil.WriteFile(s.previewCacheFile(p.URL), data, 0600); err != nil {
+		log.Println("preview: cannot cache:", err)
+	}
+}
+
+// linkPreview returns cached or fetched preview of the link.
+func (s *Server) linkPreview(link string) *prot.Preview {
+	if p, ok := s.cachedPreview(link); ok {
+		return p
+	}
+
+	p, err := s.fetchPreview(link)
+	if err != nil {
+		log.Println("preview:", link, err)
+		p = &prot.Preview{URL: link}
+	}
+	s.cachePreview(p)
+	return p
+}
+
+// startPreview fetches preview of the first message link in the background.
+func (s *Server) startPreview(msg *prot.Message) {
+	cfg := s.config()
+	if !cfg.Previews {
+		return
+	}
+
+	link := previewLink(msg.Text)
+	if link == "" {
+		return
+	}
+
+	go func(id int64) {
+		p := s.linkPreview(link)
+		if p.Title == "" {
+			return
+		}
+		p.ID = id
+		p.Ts = time.Now()
+		select {
+		case s.previewChan <- p:
+		case <-s.workerDone():
+		}
+	}(msg.ID)
+}
+
+// previewHTML renders the preview for browsers.
+func previewHTML(p *prot.Preview) string {
+	s := `<div class="preview"><a target="chaturls" rel="noopener noreferrer" href="` + html.EscapeString(p.URL) + `">` +
+		html.EscapeString(p.Title) + "</a>"
+	if p.SiteName != "" {
+		s += ` <span class="ts">` + html.EscapeString(p.SiteName) + "</span>"
+	}
+	if p.Description != "" {
+		s += "<br>\n" + html.EscapeString(p.Description)
+	}
+	if p.Image != "" {
+		s += `<br>` + "\n" + `<img src="` + html.EscapeString(p.Image) + `" referrerpolicy="no-referrer" alt="">`
+	}
+	return s + "</div>"
+}
+
+// processPreview attaches fetched preview to the message and sends it to the participants.
+func (s *Server) processPreview(p *prot.Preview) {
+	msg, ok := s.index.messages[p.ID]
+	if !ok || msg.Deleted {
+		return
+	}
+
+	p.HTML = previewHTML(p)
+	msg.Preview = p
+	e := prot.Envelope{Room: msg.Room, Preview: p}
+	s.storeEnvelope(&e)
+	s.sendToParticipants(msg, &e)
+}
+
+// loadPreview applies stored preview to the loaded history.
+func (s *Server) loadPreview(e *prot.Envelope) {
+	if msg, ok := s.index.messages[e.Preview.ID]; ok && !msg.Deleted {
+		msg.Preview = e.Preview
+	}
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+const testPage = `<!DOCTYPE html>
+<html><head>
+<title>Fallback title</title>
+<meta property="og:title" content="Go &amp; chat">
+<meta content='A  small
+	chat server' property='og:description'>
+<meta name="description" content="ignored">
+<meta property="og:image" content="/img/logo.png">
+<meta property="og:site_name" content="Example">
+</head><body><meta property="og:title" content="body meta"></body></html>`
+
+func TestParsePreview(t *testing.T) {
+	base, _ := url.Parse("https://example.com/post/1")
+	p := parsePreview(testPage, base)
+	if p.Title != "Go & chat" {
+		t.Errorf("title: %q", p.Title)
+	}
+	if p.Description != "A small chat server" {
+		t.Errorf("description: %q", p.Description)
+	}
+	if p.Image != "https://example.com/img/logo.png" {
+		t.Errorf("image: %q", p.Image)
+	}
+	if p.SiteName != "Example" {
+		t.Errorf("site name: %q", p.SiteName)
+	}
+
+	p = parsePreview("<html><head><TITLE>\n Plain\x1b[31m page </TITLE><meta name=description content=short>"+
+		`<meta property="og:image" content="javascript:alert(1)"></head>`, base)
+	if p.Title != "Plain[31m page" || p.Description != "short" || p.Image != "" {
+		t.Errorf("plain page: %+v", p)
+	}
+}
+
+func TestPreviewLink(t *testing.T) {
+	tests := []struct {
+		text string
+		link string
+	}{
+		{"see https://example.com/a.", "https://example.com/a"},
+		{"[docs](http://example.com/docs) and https://example.com/b", "http://example.com/docs"},
+		{"`https://example.com/code`", ""},
+		{"mail [me](mailto:a@example.com)", ""},
+		{"no links", ""},
+	}
+
+	for _, tt := range tests {
+		if link := previewLink(tt.text); link != tt.link {
+			t.Errorf("%q: got %q, want %q", tt.text, link, tt.link)
+		}
+	}
+}
+
+func TestBlockedIP(t *testing.T) {
+	for _, s := range []string{"127.0.0.1", "10.1.2.3", "172.20.0.1", "192.168.1.1", "169.254.169.254", "::1", "fd00::1", "0.0.0.0"} {
+		if !blockedIP(net.ParseIP(s)) {
+			t.Errorf("%s is not blocked", s)
+		}
+	}
+	for _, s := range []string{"8.8.8.8", "93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946"} {
+		if blockedIP(net.ParseIP(s)) {
+			t.Errorf("%s is blocked", s)
+		}
+	}
+}
+
+func TestFetchPreview(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, testPage)
+		case "/redirect":
+			http.Redirect(w, r, "/page", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+		}
+	}))
+	defer srv.Close()
+
+	s, dir := newTestServer(t, Options{})
+	defer os.RemoveAll(dir)
+
+	if _, err := s.fetchPreview(srv.URL + "/page"); err == nil {
+		t.Error("loopback address is not blocked")
+	}
+
+	c := *s.config()
+	c.PreviewAllowPrivate = true
+	s.cfg.Store(&c)
+	p, err := s.fetchPreview(srv.URL + "/redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Title != "Go & chat" || p.URL != srv.URL+"/redirect" || p.Image != srv.URL+"/img/logo.png" {
+		t.Errorf("preview: %+v", p)
+	}
+
+	if _, err = s.fetchPreview(srv.URL + "/image.png"); err == nil {
+		t.Error("no error for image")
+	}
+
+	if _, err = s.fetchPreview(srv.URL + "/loop"); err == nil {
+		t.Error("no error for redirect loop")
+	}
+}
+
+func TestPreviewHTML(t *testing.T) {
+	p := parsePreview(`<title>&lt;script&gt;</title><meta property="og:image" content="https://example.com/a.png?&quot;onerror=&quot;x">`,
+		&url.URL{Scheme: "https", Host: "example.com"})
+	s := previewHTML(p)
+	want := `<div class="preview"><a target="chaturls" rel="noopener noreferrer" href="https://example.com">&lt;script&gt;</a><br>` + "\n" +
+		`<img src="https://example.com/a.png?&#34;onerror=&#34;x" referrerpolicy="no-referrer" alt=""></div>`
+	if s != want {
+		t.Errorf("html:\n%s\nwant:\n%s", s, want)
+	}
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/milla-v/chat/auth"
+	"github.com/milla-v/chat/prot"
+	"github.com/milla-v/chat/util"
+)
+
+// privateDir is a work dir subdirectory for private conversation archives.
+// File server does not serve it.
+const privateDir = "private/"
+
+// privateKey returns conversation key which is the same for both participants.
+// Usernames cannot contain "/" because they are a part of user file names.
+func privateKey(a, b string) string {
+	names := []string{a, b}
+	sort.Strings(names)
+	return names[0] + "/" + names[1]
+}
+
+// archiveName returns file name of the conversation archive for privateKey.
+func archiveName(key string) string {
+	names := strings.SplitN(key, "/", 2)
+	return url.QueryEscape(names[0]) + "," + url.QueryEscape(names[1]) + ".html"
+}
+
+// findRecipient finds connected client by user name. If user is not connected
+// but registered returns a client without connection.
+func (s *Server) findRecipient(name string) (*client, error) {
+	for _, c := range s.clients {
+		if c.ua.Name == name {
+			return c, nil
+		}
+	}
+
+	if !s.users.UserExists(name) {
+		return nil, errors.New("no such user: " + name)
+	}
+
+	return &client{ua: &auth.UserAuth{Name: name}}, nil
+}
+
+// sendPrivateCommand handles "/msg user text" command. Without text replays
+// the conversation with the user.
+func (s *Server) sendPrivateCommand(from *client, arg string) {
+	fields := strings.SplitN(arg, " ", 2)
+	if fields[0] == "" {
+		sendInfo(from, "usage: /msg USER TEXT")
+		return
+	}
+
+	to, err := s.findRecipient(fields[0])
+	if err != nil {
+		sendInfo(from, err.Error())
+		return
+	}
+
+	if len(fields) < 2 || strings.TrimSpace(fields[1]) == "" {
+		s.replayPrivate(from, to.ua.Name)
+		return
+	}
+
+	s.sendPrivate(&message{from: from, to: to, text: strings.TrimSpace(fields[1])})
+}
+
+func (s *Server) replayPrivate(cli *client, name string) {
+	if cli.ws == nil {
+		return
+	}
+
+	h := s.privateHistory[privateKey(cli.ua.Name, name)]
+	if len(h) > 100 {
+		h = h[len(h)-100:]
+	}
+	for _, e := range h {
+		err := websocket.JSON.Send(cli.ws, e)
+		if err != nil {
+			log.Println("send error:", err)
+		}
+	}
+}
+
+// sendPrivate delivers the message to all recipient connections and to all sender connections.
+func (s *Server) sendPrivate(m *message) {
+	from, to, text, label := m.from, m.to, m.text, m.label
+	e := prot.Envelope{}
+	now := time.Now()
+	e.Message = new(prot.Message)
+	msg := e.Message
+	msg.ID = s.nextID()
+	msg.Ts = now
+	msg.Name = from.ua.Name
+	msg.To = to.ua.Name
+	msg.Parent = m.parent
+	msg.Buttons = m.buttons
+	msg.Bot = m.bot
+	msg.Text = autoreplaceText(text)
+	msg.Color, _ = colors[strings.ToLower(msg.Name)]
+	msg.ColorXterm256 = util.RGB2xterm(msg.Color)
+
+	msg.HTML = messageHTML(msg, formatHTML(msg.Text))
+
+	for _, cli := range s.clients {
+		if cli.ws == nil {
+			continue
+		}
+
+		switch cli.ua.Name {
+		case msg.To:
+			msg.Notification = label
+			if label == "" {
+				msg.Notification = msg.Name + ": " + cutRunes(msg.Text, 64)
+			}
+			if s.isDND(cli.ua.Name) {
+				msg.Notification = ""
+			}
+		case msg.Name:
+			msg.Notification = ""
+		default:
+			continue
+		}
+
+		err := websocket.JSON.Send(cli.ws, &e)
+		if err != nil {
+			log.Println("cannot send private to", cli.ua.Name, err)
+		}
+	}
+
+	msg.Notification = ""
+	key := privateKey(msg.Name, msg.To)
+	s.privateHistory[key] = s.trimHistory(append(s.privateHistory[key], e))
+	s.storeEnvelope(&e)
+	s.index.add(msg)
+	s.sendThreadSummary(msg)
+	s.startPreview(msg)
+	s.queueNotification(msg.To, msg)
+	s.archivePrivate(key, now, msg)
+}
+
+func (s *Server) archivePrivate(key string, now time.Time, msg *prot.Message) {
+	cfg := s.config()
+	err := os.MkdirAll(cfg.WorkDir+privateDir, 0700)
+	if err != nil {
+		log.Println("archive private:", err)
+		return
+	}
+
+	f, err := os.OpenFile(cfg.WorkDir+privateDir+archiveName(key), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Println("archive private:", err)
+		return
+	}
+	defer f.Close()
+
+	fmt.Fprintln(f, "<p>"+`<span class="ts">`+now.Format("2006-01-02 15:04:05")+"</span> "+msg.Name+" &rarr; "+msg.To+": "+msg.Text+"</p>")
+}
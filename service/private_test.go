@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrivateKey(t *testing.T) {
+	if privateKey("a-b", "c") == privateKey("a", "b-c") {
+		t.Error("keys of different conversations are equal")
+	}
+	if privateKey("bob", "alice") != privateKey("alice", "bob") {
+		t.Error("keys of the participants differ")
+	}
+	if name := archiveName(privateKey("bob", "alice")); name != "alice,bob.html" {
+		t.Errorf("archive name: %s", name)
+	}
+	if archiveName(privateKey("a,b", "c")) == archiveName(privateKey("a", "b,c")) {
+		t.Error("archive names of different conversations are equal")
+	}
+}
+
+func TestPrivateMessage(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice", "T2": "bob", "T3": "carol"}})
+	defer os.RemoveAll(dir)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	c := newTestClient(t, s.Handler())
+	defer c.ts.Close()
+
+	if code, _ := c.do("POST", "/m?to=nobody", "hi", "T1"); code != http.StatusBadRequest {
+		t.Errorf("unknown recipient: %d", code)
+	}
+	if code, body := c.do("POST", "/m?to=bob", "secret", "T1"); code != http.StatusOK {
+		t.Fatalf("post: %d %s", code, body)
+	}
+
+	var body string
+	for i := 0; i < 50 && !strings.Contains(body, "secret"); i++ {
+		time.Sleep(10 * time.Millisecond)
+		_, body = c.do("GET", "/api/history?to=alice", "", "T2")
+	}
+	if !strings.Contains(body, `"to":"bob"`) {
+		t.Errorf("private history: %s", body)
+	}
+	if _, body = c.do("GET", "/api/history?to=alice", "", "T3"); strings.Contains(body, "secret") {
+		t.Errorf("private message is visible to other user: %s", body)
+	}
+	if _, body = c.do("GET", "/api/history?room=general", "", "T3"); strings.Contains(body, "secret") {
+		t.Errorf("private message is in the room: %s", body)
+	}
+	if _, err := os.Stat(dir + "/" + privateDir + "alice,bob.html"); err != nil {
+		t.Error(err)
+	}
+}
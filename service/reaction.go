@@ -0,0 +1,124 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/milla-v/chat/prot"
+)
+
+const maxEmojiLen = 8 // max emoji length in runes
+
+func validEmoji(emoji string) error {
+	if emoji == "" || utf8.RuneCountInString(emoji) > maxEmojiLen {
+		return errors.New("invalid reaction")
+	}
+	if strings.ContainsAny(emoji, " \t\n<>&\"'") {
+		return errors.New("invalid reaction")
+	}
+	return nil
+}
+
+// applyReaction updates reactions of the message. Returns false if nothing changed.
+func applyReaction(msg *prot.Message, re *prot.Reaction) bool {
+	names := msg.Reactions[re.Emoji]
+	pos := -1
+	for i, name := range names {
+		if name == re.Name {
+			pos = i
+			break
+		}
+	}
+
+	switch {
+	case re.Remove && pos >= 0:
+		names = append(names[:pos], names[pos+1:]...)
+	case !re.Remove && pos < 0:
+		names = append(names, re.Name)
+	default:
+		return false
+	}
+
+	if msg.Reactions == nil {
+		msg.Reactions = map[string][]string{}
+	}
+	if len(names) == 0 {
+		delete(msg.Reactions, re.Emoji)
+	} else {
+		msg.Reactions[re.Emoji] = names
+	}
+	re.Reactions = msg.Reactions
+	return true
+}
+
+// reactionsText returns compact text of reactions like "👍2 ❤1".
+func reactionsText(reactions map[string][]string) string {
+	var list []string
+	for emoji, names := range reactions {
+		list = append(list, emoji+strconv.Itoa(len(names)))
+	}
+	sort.Strings(list)
+	return strings.Join(list, " ")
+}
+
+func (s *Server) processReaction(cli *client, re *prot.Reaction) {
+	cfg := s.config()
+	msg, ok := s.index.messages[re.ID]
+	if !ok || msg.Deleted {
+		sendInfo(cli, fmt.Sprintf("no such message: %d", re.ID))
+		return
+	}
+
+	if msg.To != "" && msg.To != cli.ua.Name && msg.Name != cli.ua.Name {
+		sendInfo(cli, fmt.Sprintf("no such message: %d", re.ID))
+		return
+	}
+
+	if err := validEmoji(re.Emoji); err != nil {
+		sendInfo(cli, err.Error())
+		return
+	}
+
+	r := &prot.Reaction{ID: re.ID, Ts: time.Now(), Name: cli.ua.Name, Emoji: re.Emoji, Remove: re.Remove}
+	if !applyReaction(msg, r) {
+		return
+	}
+
+	if cfg.Debug {
+		log.Printf("reaction %s %d: %s", cli.ua.Name, r.ID, reactionsText(msg.Reactions))
+	}
+
+	e := prot.Envelope{Room: msg.Room, Reaction: r}
+	s.storeEnvelope(&e)
+	s.sendToParticipants(msg, &e)
+}
+
+// reactCommand handles "/react ID EMOJI" and "/unreact ID EMOJI" commands.
+func (s *Server) reactCommand(cli *client, cmd, arg string) {
+	fields := strings.Fields(arg)
+	if len(fields) != 2 {
+		sendInfo(cli, "usage: "+cmd+" ID EMOJI")
+		return
+	}
+
+	id, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		sendInfo(cli, "usage: "+cmd+" ID EMOJI")
+		return
+	}
+
+	s.processReaction(cli, &prot.Reaction{ID: id, Emoji: fields[1], Remove: cmd == "/unreact"})
+}
+
+// loadReaction applies stored reaction to the loaded history.
+func (s *Server) loadReaction(e *prot.Envelope) {
+	if msg, ok := s.index.messages[e.Reaction.ID]; ok {
+		applyReaction(msg, e.Reaction)
+	}
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/milla-v/chat/auth"
+	"github.com/milla-v/chat/prot"
+)
+
+func TestProcessReaction(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice", "T2": "bob", "T3": "carol"}})
+	defer os.RemoveAll(dir)
+
+	s.getRoom(defaultRoom)
+	var infos []string
+	alice := &client{ua: &auth.UserAuth{Name: "alice", Token: "T1"}, infos: &infos}
+	bob := &client{ua: &auth.UserAuth{Name: "bob", Token: "T2"}, infos: &infos}
+	carol := &client{ua: &auth.UserAuth{Name: "carol", Token: "T3"}, infos: &infos}
+	s.clients = []*client{alice, bob, carol}
+
+	s.processMessage(&message{from: alice, text: "hello"})
+	msg := s.index.messages[s.lastID]
+	s.processMessage(&message{from: alice, toName: "bob", text: "secret"})
+	private := s.index.messages[s.lastID]
+	if msg == nil || private == nil || private.To != "bob" {
+		t.Fatalf("messages: %+v %+v", msg, private)
+	}
+
+	tests := []struct {
+		cli       *client
+		msg       *prot.Message
+		emoji     string
+		remove    bool
+		info      string
+		reactions map[string][]string
+	}{
+		{alice, msg, "+1", false, "", map[string][]string{"+1": {"alice"}}},
+		{bob, msg, "+1", false, "", map[string][]string{"+1": {"alice", "bob"}}},
+		{bob, msg, "+1", false, "", map[string][]string{"+1": {"alice", "bob"}}},
+		{alice, msg, "+1", true, "", map[string][]string{"+1": {"bob"}}},
+		{bob, msg, "+1", true, "", map[string][]string{}},
+		{bob, msg, "+1", true, "", map[string][]string{}},
+		{alice, msg, "<b>", false, "invalid reaction", map[string][]string{}},
+		{alice, msg, "", false, "invalid reaction", map[string][]string{}},
+		{alice, msg, "too long emoji", false, "invalid reaction", map[string][]string{}},
+		{carol, private, "+1", false, "no such message", nil},
+		{bob, private, "ok", false, "", map[string][]string{"ok": {"bob"}}},
+	}
+
+	for i, tt := range tests {
+		infos = nil
+		s.processReaction(tt.cli, &prot.Reaction{ID: tt.msg.ID, Emoji: tt.emoji, Remove: tt.remove})
+		if tt.info == "" && len(infos) != 0 || tt.info != "" && (len(infos) != 1 || !strings.HasPrefix(infos[0], tt.info)) {
+			t.Errorf("%d: infos %q, want %q", i, infos, tt.info)
+		}
+		if got := tt.msg.Reactions; !reflect.DeepEqual(got, tt.reactions) {
+			t.Errorf("%d: reactions %v, want %v", i, got, tt.reactions)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/milla-v/chat/prot"
+)
+
+// defaultRoom is joined by every client on connect and cannot be left.
+const defaultRoom = "general"
+
+type room struct {
+	name        string
+	clients     []*client       // clients joined the room
+	members     map[string]bool // users joined the room. Users stay members when they disconnect until they leave
+	history     []prot.Envelope // recent history for replay to connected client
+	historyFile *os.File        // file for saving all room history
+}
+
+var roomNameRe = regexp.MustCompile(`^[a-z0-9_\-]{1,32}$`)
+
+func historyFileName(name string) string {
+	if name == defaultRoom {
+		return "history.html"
+	}
+	return "history-" + name + ".html"
+}
+
+// getRoom finds the room by name or creates a new one.
+func (s *Server) getRoom(name string) (*room, error) {
+	cfg := s.config()
+	name = strings.ToLower(name)
+	if r, ok := s.rooms[name]; ok {
+		return r, nil
+	}
+
+	if !roomNameRe.MatchString(name) {
+		return nil, errors.New("invalid room name: " + name)
+	}
+
+	f, err := os.OpenFile(cfg.WorkDir+historyFileName(name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &room{name: name, members: map[string]bool{}, historyFile: f}
+	s.rooms[name] = r
+	log.Println("room created:", name)
+	return r, nil
+}
+
+func (r *room) has(cli *client) bool {
+	for _, c := range r.clients {
+		if c == cli {
+			return true
+		}
+	}
+	return false
+}
+
+// joinedBy checks if the user joined the room. All users are in the default room.
+func (r *room) joinedBy(name string) bool {
+	return r.name == defaultRoom || r.members[name]
+}
+
+// join adds the client to the room and makes the room current. Returns true if the user is a new member.
+func (r *room) join(cli *client) bool {
+	if !r.has(cli) {
+		r.clients = append(r.clients, cli)
+	}
+	cli.room = r
+
+	if r.members[cli.ua.Name] {
+		return false
+	}
+	if r.members == nil {
+		r.members = map[string]bool{}
+	}
+	r.members[cli.ua.Name] = true
+	return true
+}
+
+// removeMember removes the user from the members if no client of the user is in the room.
+// Returns true if the user is removed.
+func (r *room) removeMember(name string) bool {
+	for _, c := range r.clients {
+		if c.ua.Name == name {
+			return false
+		}
+	}
+	if !r.members[name] {
+		return false
+	}
+	delete(r.members, name)
+	return true
+}
+
+func (r *room) leave(cli *client) {
+	for idx, c := range r.clients {
+		if c == cli {
+			r.clients = append(r.clients[:idx], r.clients[idx+1:]...)
+			break
+		}
+	}
+	if cli.room == r {
+		cli.room = nil
+	}
+}
+
+// joinedRooms returns sorted names of the rooms joined by the client.
+func (s *Server) joinedRooms(cli *client) []string {
+	var list []string
+	for _, r := range s.rooms {
+		if r.has(cli) {
+			list = append(list, r.name)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (s *Server) roomsFile() string {
+	cfg := s.config()
+	return cfg.WorkDir + privateDir + "rooms.json"
+}
+
+// loadRooms creates the rooms saved by saveRooms and restores their members.
+func (s *Server) loadRooms() {
+	data, err := ioutil.ReadFile(s.roomsFile())
+	if os.IsNotExist(err) {
+		return
+	}
+	members := map[string][]string{}
+	if err == nil {
+		err = json.Unmarshal(data, &members)
+	}
+	if err != nil {
+		log.Println("rooms: cannot load:", err)
+		return
+	}
+
+	for name, list := range members {
+		r, err := s.getRoom(name)
+		if err != nil {
+			log.Println("rooms: cannot load:", err)
+			continue
+		}
+		for _, m := range list {
+			r.members[m] = true
+		}
+	}
+}
+
+// saveRooms saves the room members.
+func (s *Server) saveRooms() {
+	cfg := s.config()
+	members := map[string][]string{}
+	for name, r := range s.rooms {
+		list := []string{}
+		for m := range r.members {
+			list = append(list, m)
+		}
+		sort.Strings(list)
+		members[name] = list
+	}
+
+	data, err := json.MarshalIndent(members, "", "\t")
+	if err != nil {
+		log.Println("rooms: cannot save:", err)
+		return
+	}
+
+	if err = os.MkdirAll(cfg.WorkDir+privateDir, 0700); err != nil {
+		log.Println("rooms: cannot save:", err)
+		return
+	}
+
+	if err = ioutil.WriteFile(s.roomsFile(), data, 0600); err != nil {
+		log.Println("rooms: cannot save:", err)
+	}
+}
+
+// roomNames returns sorted names of all rooms.
+func (s *Server) roomNames() []string {
+	var list []string
+	for name := range s.rooms {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// resolveRoom returns the room where a message should go. Falls back to the current room
+// of the client and then to the default room.
+func (s *Server) resolveRoom(cli *client, name string) (*room, error) {
+	if name == "" {
+		if cli.room != nil {
+			return cli.room, nil
+		}
+		return s.rooms[defaultRoom], nil
+	}
+
+	r, ok := s.rooms[strings.ToLower(name)]
+	if !ok {
+		return nil, errors.New("no such room: " + name)
+	}
+
+	joined := r.has(cli)
+	if cli.ws == nil {
+		// http sender without a connection posts to the rooms joined by the user
+		joined = r.joinedBy(cli.ua.Name)
+	}
+	if r.name != defaultRoom && !joined {
+		return nil, errors.New("not joined to room: " + name)
+	}
+
+	return r, nil
+}
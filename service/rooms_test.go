@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRooms(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice", "T2": "bob", "T3": "alice"}})
+	defer os.RemoveAll(dir)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	tc := newTestClient(t, s.Handler())
+	defer tc.ts.Close()
+
+	ws := tc.dial("T1")
+	defer ws.Close()
+
+	// roomHas waits for the text in the room history.
+	roomHas := func(room, text string) bool {
+		for i := 0; i < 20; i++ {
+			if _, body := tc.do("GET", "/api/history?room="+room, "", "T1"); strings.Contains(body, text) {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	tests := []struct {
+		path, text, token string
+		reply             string
+		posted            bool
+	}{
+		// alice joins over http with the token of her connection
+		{"/m", "/join dev", "T1", "", false},
+		{"/m?room=dev", "alice in dev", "T1", "", true},
+		// http sender with another session of the joined user
+		{"/m?room=dev", "alice over http", "T3", "", true},
+		// bob has no connection in the room
+		{"/m?room=dev", "bob in dev", "T2", "not joined to room: dev", false},
+		{"/m?room=nosuch", "nowhere", "T1", "no such room: nosuch", false},
+		{"/m?room=general", "bob in general", "T2", "", true},
+		{"/m", "/leave general", "T1", "cannot leave general", false},
+		{"/m", "/leave dev", "T1", "", false},
+		{"/m?room=dev", "alice after leave", "T1", "not joined to room: dev", false},
+		{"/m?room=dev", "alice over http after leave", "T3", "not joined to room: dev", false},
+		{"/m", "/leave dev", "T1", "cannot leave: not joined to room: dev", false},
+	}
+
+	for _, tt := range tests {
+		code, body := tc.do("POST", tt.path, tt.text, tt.token)
+		if code != 200 || strings.TrimSpace(body) != tt.reply {
+			t.Errorf("%s %q: %d %q, want %q", tt.path, tt.text, code, body, tt.reply)
+		}
+		room := "general"
+		if i := strings.Index(tt.path, "room="); i >= 0 {
+			room = tt.path[i+5:]
+		}
+		if !strings.HasPrefix(tt.text, "/") && roomHas(room, tt.text) != tt.posted {
+			t.Errorf("%s %q: posted %v", tt.path, tt.text, !tt.posted)
+		}
+	}
+}
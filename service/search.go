@@ -0,0 +1,258 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/milla-v/chat/prot"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 200
+	minPrefixLen       = 3 // min query token length for prefix matching
+)
+
+// searchIndex is an inverted index of message tokens.
+type searchIndex struct {
+	postings map[string]map[int64]bool // token to message ids
+	messages map[int64]*prot.Message   // indexed messages by id
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: map[string]map[int64]bool{},
+		messages: map[int64]*prot.Message{},
+	}
+}
+
+// tokenize splits text into lowercase words. Works for any alphabet including cyrillic.
+func tokenize(text string) []string {
+	text = strings.ToLower(html.UnescapeString(text))
+	text = strings.Replace(text, "ё", "е", -1)
+
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var tokens []string
+	seen := map[string]bool{}
+	for _, w := range words {
+		if seen[w] {
+			continue
+		}
+		seen[w] = true
+		tokens = append(tokens, w)
+	}
+	return tokens
+}
+
+func (idx *searchIndex) add(msg *prot.Message) {
+	if msg.ID == 0 {
+		return
+	}
+
+	idx.messages[msg.ID] = msg
+	for _, t := range tokenize(msg.Text) {
+		ids := idx.postings[t]
+		if ids == nil {
+			ids = map[int64]bool{}
+			idx.postings[t] = ids
+		}
+		ids[msg.ID] = true
+	}
+}
+
+func (idx *searchIndex) remove(msg *prot.Message) {
+	if _, ok := idx.messages[msg.ID]; !ok {
+		return
+	}
+
+	delete(idx.messages, msg.ID)
+	for _, t := range tokenize(msg.Text) {
+		delete(idx.postings[t], msg.ID)
+		if len(idx.postings[t]) == 0 {
+			delete(idx.postings, t)
+		}
+	}
+}
+
+// lookup returns ids of messages having the token or, for long enough tokens,
+// the words starting with the token.
+func (idx *searchIndex) lookup(token string) map[int64]bool {
+	if len([]rune(token)) < minPrefixLen {
+		return idx.postings[token]
+	}
+
+	ids := map[int64]bool{}
+	for t, list := range idx.postings {
+		if !strings.HasPrefix(t, token) {
+			continue
+		}
+		for id := range list {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// search returns the latest messages having all query tokens. Private messages are returned
+// only to the participants.
+func (idx *searchIndex) search(user, query, room string, limit int) []*prot.Message {
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	found := idx.lookup(tokens[0])
+	for _, t := range tokens[1:] {
+		ids := idx.lookup(t)
+		matched := map[int64]bool{}
+		for id := range found {
+			if ids[id] {
+				matched[id] = true
+			}
+		}
+		found = matched
+	}
+
+	var list []*prot.Message
+	for id := range found {
+		msg := idx.messages[id]
+		if msg.To != "" && msg.To != user && msg.Name != user {
+			continue
+		}
+		if room != "" && msg.Room != room {
+			continue
+		}
+		list = append(list, msg)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID > list[j].ID })
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// searchQuery is a search request passed to the worker.
+// The worker replies with json encoded prot.SearchResult or nil on error.
+type searchQuery struct {
+	user  string
+	query string
+	room  string
+	limit int
+	reply chan []byte
+}
+
+// processSearchQuery encodes the result in the worker because the messages are changed by edits and reactions.
+func (s *Server) processSearchQuery(q *searchQuery) {
+	res := prot.SearchResult{Query: q.query, Messages: s.index.search(q.user, q.query, q.room, q.limit)}
+	if res.Messages == nil {
+		res.Messages = []*prot.Message{}
+	}
+	data, err := json.Marshal(&res)
+	if err != nil {
+		log.Println("search: cannot encode result.", err)
+	}
+	q.reply <- data
+}
+
+func formatSearchHit(msg *prot.Message) string {
+	where := "#" + msg.Room
+	if msg.To != "" {
+		where = msg.Name + " -> " + msg.To
+	}
+	return fmt.Sprintf("%s [%d] %s %s: %s", msg.Ts.Format("2006-01-02 15:04"), msg.ID, where, msg.Name, msg.Text)
+}
+
+// searchCommand handles "/search QUERY" command.
+func (s *Server) searchCommand(cli *client, query string) {
+	if query == "" {
+		sendInfo(cli, "usage: /search QUERY")
+		return
+	}
+
+	list := s.index.search(cli.ua.Name, query, "", defaultSearchLimit)
+	if len(list) == 0 {
+		sendInfo(cli, "nothing found: "+query)
+		return
+	}
+
+	text := ""
+	for _, msg := range list {
+		text += formatSearchHit(msg) + "\n"
+	}
+	sendInfo(cli, text)
+}
+
+// searchHandler returns messages matching the query as json.
+//
+//	GET /api/search?q=QUERY&room=ROOM&limit=N
+func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := getToken(r)
+	if err != nil {
+		http.Error(w, "no token "+err.Error(), http.StatusUnauthorized)
+		log.Println("search: no token.", err)
+		return
+	}
+
+	ua, err := s.users.GetAuthUser(token)
+	if err != nil {
+		http.Error(w, "no auth user", http.StatusUnauthorized)
+		log.Println("search: no auth user.", err)
+		return
+	}
+
+	q := r.URL.Query()
+	query := q.Get("q")
+	if query == "" {
+		http.Error(w, "empty query", http.StatusBadRequest)
+		return
+	}
+
+	limit := 0
+	if q.Get("limit") != "" {
+		if limit, err = strconv.Atoi(q.Get("limit")); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	done := s.workerDone()
+	reply := make(chan []byte, 1)
+	var data []byte
+	select {
+	case s.searchChan <- &searchQuery{user: ua.Name, query: query, room: q.Get("room"), limit: limit, reply: reply}:
+	case <-done:
+	}
+	select {
+	case data = <-reply:
+	case <-done:
+		http.Error(w, errNotRunning.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if data == nil {
+		http.Error(w, "cannot encode result", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(append(data, '\n')); err != nil {
+		log.Println("search: cannot write result.", err)
+	}
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/milla-v/chat/prot"
+)
+
+func TestSearch(t *testing.T) {
+	idx := newSearchIndex()
+	texts := []string{
+		"Встреча завтра в 10, ссылка https://example.com/meeting",
+		"meeting notes are in the wiki",
+		"завтра не могу",
+		"Ёлка &amp; подарки",
+	}
+	for i, text := range texts {
+		e := testEnvelope("general", text, time.Now())
+		e.Message.ID = int64(i + 1)
+		idx.add(e.Message)
+	}
+
+	private := testEnvelope("", "secret meeting", time.Now())
+	private.Message.ID = 10
+	private.Message.To = "other"
+	idx.add(private.Message)
+
+	tests := []struct {
+		user  string
+		query string
+		ids   []int64
+	}{
+		{"test", "meeting", []int64{10, 2, 1}},
+		{"someone", "meeting", []int64{2, 1}},
+		{"someone", "ЗАВТРА", []int64{3, 1}},
+		{"someone", "завтра встреч", []int64{1}},
+		{"someone", "елка", []int64{4}},
+		{"someone", "example.com", []int64{1}},
+		{"someone", "absent", nil},
+	}
+
+	for _, tt := range tests {
+		list := idx.search(tt.user, tt.query, "", 0)
+		if len(list) != len(tt.ids) {
+			t.Errorf("%s: expected %v, got %d messages", tt.query, tt.ids, len(list))
+			continue
+		}
+		for i, msg := range list {
+			if msg.ID != tt.ids[i] {
+				t.Errorf("%s: expected %v, got %d at %d", tt.query, tt.ids, msg.ID, i)
+			}
+		}
+	}
+
+	idx.remove(private.Message)
+	if list := idx.search("test", "secret", "", 0); len(list) != 0 {
+		t.Errorf("removed message found")
+	}
+}
+
+func TestSearchHandlerWhileEditing(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice"}})
+	defer os.RemoveAll(dir)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	c := newTestClient(t, s.Handler())
+	defer c.ts.Close()
+
+	c.do("POST", "/m", "hello", "T1")
+	if c.history("T1", "hello") == "" {
+		t.Fatal("no message")
+	}
+
+	done := c.editLoop("T1", "1 hello")
+	for i := 0; i < 20; i++ {
+		code, body := c.do("GET", "/api/search?q=hello", "", "T1")
+		var res prot.SearchResult
+		if err := json.Unmarshal([]byte(body), &res); code != http.StatusOK || err != nil || res.Query != "hello" || len(res.Messages) != 1 {
+			t.Fatalf("search: %d %s", code, body)
+		}
+	}
+	<-done
+}
@@ -0,0 +1,308 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/milla-v/chat/auth"
+	"github.com/milla-v/chat/config"
+	"github.com/milla-v/chat/mailer"
+	"github.com/milla-v/chat/prot"
+)
+
+// Authenticator resolves session tokens and user profiles.
+type Authenticator interface {
+	GetAuthUser(token string) (*auth.UserAuth, error) // user by session token
+	UserExists(name string) bool                      // checks if the user exists
+	UserEmail(name string) (string, error)            // email for notifications
+}
+
+// Options configure the Server. Zero value options use the service defaults.
+type Options struct {
+	Config *config.ServiceConfig // config. Nil means config.Config. The server keeps a copy
+	Auth   Authenticator         // users. Nil means user files in the work directory and /auth, /register, /create handlers
+	Store  Store                 // persistent history, closed on Shutdown. Nil means log store in the private work directory
+	Mailer mailer.Mailer         // outgoing mail. Nil means the queue to the cfg.Mail transport
+
+	// Reload is called on SIGHUP to load a new config before certificates, users and pages
+	// are reloaded. It must not change the config in use. Nil keeps the config.
+	Reload func() (*config.ServiceConfig, error)
+}
+
+// Server is a chat service which can be mounted into an http server.
+// Several servers can run in one process if they have different work directories.
+type Server struct {
+	opts  Options
+	mux   *http.ServeMux
+	cfg   atomic.Value  // current *config.ServiceConfig
+	users Authenticator // user lookups
+	files *auth.Files   // user files. Nil if Options.Auth is set
+
+	mu   sync.Mutex
+	done chan struct{} // closed when the worker is not running
+
+	executable string                  // binary path at start. Upgrade executes the file at this path
+	inherited  map[string]net.Listener // listeners passed by the old process
+
+	// hub state owned by the worker routine
+	clients        []*client                   // list of active clients (connected and recently disconnected)
+	rooms          map[string]*room            // rooms by name
+	privateHistory map[string][]prot.Envelope  // private conversations by privateKey
+	index          *searchIndex                // search index and messages by id
+	lastID         int64                       // last assigned message id
+	statuses       map[string]*userStatus      // user statuses by name
+	readMarkers    map[string]map[string]int64 // last read message id by user and by room or "@user"
+	incomingHooks  map[string]*incomingHook    // incoming webhooks by name
+	inboxes        map[string][]int64          // mentioned message ids by username, oldest first
+	digests        map[string]*digest          // email digests by username
+	actionHandlers map[string]ActionHandler    // action handlers by name
+	store          Store                       // persistent history
+	outbox         mailer.Mailer               // sends user emails
+	mailQueue      *mailer.Queue               // persistent outgoing mail queue if Options.Mailer is not set
+	certs          *certReloader               // certificate of static and selfsigned tls modes
+	previewClient  *http.Client                // link preview fetcher
+
+	connectChan    chan *connectRequest // channel to register new client in the list
+	disconnectChan chan *client         // channel to deregister the client
+	broadcastChan  chan *message        // channel to pass message to the worker
+	historyChan    chan *historyQuery   // channel to request history page from the worker
+	searchChan     chan *searchQuery    // channel to search messages in the worker
+	editChan       chan *editRequest    // channel to pass edit, delete and reaction requests to the worker
+	markReadChan   chan *markRead       // channel to pass read markers to the worker
+	typingChan     chan *typing         // channel to pass typing notifications to the worker
+	presenceChan   chan *presenceUpdate // channel to pass status updates to the worker
+	actionChan     chan *actionRequest  // channel to pass button clicks to the worker
+	hookChan       chan *hookPost       // channel to pass incoming webhook requests to the worker
+	previewChan    chan *prot.Preview   // channel to pass fetched previews to the worker
+	mentionsChan   chan *mentionsQuery  // channel to request mentions inbox from the worker
+	clickChan      chan *webhookClick   // channel to pass webhook replies to button clicks to the worker
+	stopChan       chan *stopRequest    // stops the worker
+	reloadChan     chan chan error      // reloads config and data in the worker
+}
+
+// errNotRunning is returned to requests which come when the worker is not running.
+var errNotRunning = errors.New("service is not running")
+
+// New creates the server. Options.Config is copied, so the server does not change config.Config.
+func New(opts Options) (*Server, error) {
+	c := config.Config
+	if opts.Config != nil {
+		c = opts.Config
+	}
+	cc := *c
+
+	s := &Server{
+		opts:           opts,
+		mux:            http.NewServeMux(),
+		users:          opts.Auth,
+		done:           make(chan struct{}),
+		inherited:      map[string]net.Listener{},
+		connectChan:    make(chan *connectRequest),
+		disconnectChan: make(chan *client, 100),
+		broadcastChan:  make(chan *message, 100),
+		historyChan:    make(chan *historyQuery, 100),
+		searchChan:     make(chan *searchQuery, 100),
+		editChan:       make(chan *editRequest, 100),
+		markReadChan:   make(chan *markRead, 100),
+		typingChan:     make(chan *typing, 100),
+		presenceChan:   make(chan *presenceUpdate, 100),
+		actionChan:     make(chan *actionRequest, 100),
+		hookChan:       make(chan *hookPost, 100),
+		previewChan:    make(chan *prot.Preview, 100),
+		mentionsChan:   make(chan *mentionsQuery, 100),
+		clickChan:      make(chan *webhookClick, 100),
+		stopChan:       make(chan *stopRequest),
+		reloadChan:     make(chan chan error),
+	}
+	close(s.done)
+	s.cfg.Store(&cc)
+	var err error
+	if s.executable, err = os.Executable(); err != nil {
+		s.executable = os.Args[0]
+	}
+	s.previewClient = s.newPreviewClient()
+	s.actionHandlers = map[string]ActionHandler{}
+	s.RegisterActionHandler("poll", &poll{})
+	s.resetState()
+
+	if s.users == nil {
+		s.files = &auth.Files{Config: s.config, Mail: serverMail{s}}
+		s.users = s.files
+	}
+
+	s.mux.HandleFunc("/", s.createFileServer())
+	s.mux.Handle("/ws", websocket.Handler(s.onWebsocketConnection))
+	s.mux.HandleFunc("/m", s.messageReceiver)
+	s.mux.HandleFunc("/upload", s.uploadHandler)
+	s.mux.HandleFunc("/hook/", s.incomingHookHandler)
+	s.mux.HandleFunc("/ver", versionHandler)
+	s.mux.HandleFunc("/api/history", s.historyHandler)
+	s.mux.HandleFunc("/api/search", s.searchHandler)
+	s.mux.HandleFunc("/api/mentions", s.mentionsHandler)
+	if s.files != nil {
+		s.mux.HandleFunc("/auth", s.files.AuthenticateHandler)
+		s.mux.HandleFunc("/register", s.files.RegisterHandler)
+		s.mux.HandleFunc("/create", s.files.CreateHandler)
+	}
+
+	return s, nil
+}
+
+// config returns the current config. Returned config is not changed, reload replaces it.
+func (s *Server) config() *config.ServiceConfig {
+	return s.cfg.Load().(*config.ServiceConfig)
+}
+
+// workerDone returns a channel which is closed when the worker is not running.
+// Requests to the worker should select on it to not block after shutdown.
+func (s *Server) workerDone() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done
+}
+
+// Handler returns the http handler of the web client, websocket and api.
+// It responds with 503 Service Unavailable if the server is not started.
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-s.workerDone():
+			http.Error(w, errNotRunning.Error(), http.StatusServiceUnavailable)
+		default:
+			s.mux.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Start loads history and data from the work directory and starts the worker.
+// It does not listen. Mount Handler into an http server.
+func (s *Server) Start() error {
+	select {
+	case <-s.workerDone():
+	default:
+		return errors.New("service: server is already started")
+	}
+
+	cfg := s.config()
+	if err := s.generatePages(); err != nil {
+		return err
+	}
+	if _, err := s.getRoom(defaultRoom); err != nil {
+		return err
+	}
+
+	s.store = s.opts.Store
+	if s.store == nil {
+		retention := Retention{
+			MaxCount: cfg.HistoryMaxCount,
+			MaxAge:   time.Duration(cfg.HistoryMaxDays) * 24 * time.Hour,
+		}
+		dir := cfg.WorkDir + privateDir + "store/"
+		if err := moveStore(cfg.WorkDir+"store/", dir); err != nil {
+			return err
+		}
+		var err error
+		if s.store, err = OpenLogStore(dir, retention); err != nil {
+			return err
+		}
+	}
+	s.compactStore()
+	if err := s.loadHistory(); err != nil {
+		return err
+	}
+	s.loadRooms()
+	s.loadStatuses()
+	s.loadIncomingHooks()
+	s.loadDigests()
+
+	s.restoreUpgrade()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opts.Mailer != nil {
+		s.outbox = s.opts.Mailer
+	} else if err := s.openMail(); err != nil {
+		return err
+	}
+	s.done = make(chan struct{})
+	go s.workerRoutine(s.done)
+	return nil
+}
+
+// stop stops the worker and flushes the data. It returns the worker snapshot if forUpgrade is set.
+func (s *Server) stop(ctx context.Context, forUpgrade bool) (*upgradeState, error) {
+	done := s.workerDone()
+	req := &stopRequest{upgrade: forUpgrade, done: make(chan struct{})}
+	select {
+	case s.stopChan <- req:
+	case <-done:
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case <-req.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return req.state, nil
+}
+
+// Shutdown notifies and disconnects clients, flushes history and stops the worker.
+// It does not stop the http server which serves Handler. The server can be started again.
+func (s *Server) Shutdown(ctx context.Context) error {
+	_, err := s.stop(ctx, false)
+	return err
+}
+
+// send passes the message to the worker. It returns errNotRunning if the worker is stopped.
+func (s *Server) send(m *message) error {
+	select {
+	case s.broadcastChan <- m:
+		return nil
+	case <-s.workerDone():
+		return errNotRunning
+	}
+}
+
+// resetState clears the hub state. Called before the start and after the worker stops.
+func (s *Server) resetState() {
+	s.clients = []*client{}
+	s.rooms = map[string]*room{}
+	s.privateHistory = map[string][]prot.Envelope{}
+	s.index = newSearchIndex()
+	s.lastID = 0
+	s.statuses = map[string]*userStatus{}
+	s.readMarkers = map[string]map[string]int64{}
+	s.incomingHooks = map[string]*incomingHook{}
+	s.inboxes = map[string][]int64{}
+	s.digests = map[string]*digest{}
+	s.store = nil
+	if p, ok := s.actionHandlers["poll"].(*poll); ok {
+		p.votes = map[int64]map[string]int{}
+	}
+}
+
+// serverMail sends registration emails of the auth handlers through the server outbox.
+type serverMail struct {
+	s *Server
+}
+
+func (m serverMail) Send(msg *mailer.Message) error {
+	m.s.mu.Lock()
+	outbox := m.s.outbox
+	m.s.mu.Unlock()
+	if outbox == nil {
+		return errNotRunning
+	}
+	return outbox.Send(msg)
+}
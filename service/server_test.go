@@ -0,0 +1,282 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/milla-v/chat/auth"
+	"github.com/milla-v/chat/config"
+	"github.com/milla-v/chat/mailer"
+	"github.com/milla-v/chat/prot"
+)
+
+type testAuth map[string]string // usernames by token
+
+func (a testAuth) GetAuthUser(token string) (*auth.UserAuth, error) {
+	if name, ok := a[token]; ok {
+		return &auth.UserAuth{Name: name, Token: token}, nil
+	}
+	return nil, errors.New("unknown token")
+}
+
+func (a testAuth) UserExists(name string) bool {
+	for _, n := range a {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (a testAuth) UserEmail(name string) (string, error) {
+	return name + "@example.com", nil
+}
+
+// newTestServer creates a server which is not started. The caller removes the work directory.
+func newTestServer(t *testing.T, opts Options) (*Server, string) {
+	dir, err := ioutil.TempDir("", "chattest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := *config.Config
+	c.WorkDir = dir + "/"
+	c.Previews = false
+	opts.Config = &c
+	s, err := New(opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+// testClient calls the server handler with the token cookie.
+type testClient struct {
+	t  *testing.T
+	ts *httptest.Server
+	hc *http.Client
+}
+
+func newTestClient(t *testing.T, h http.Handler) *testClient {
+	return &testClient{
+		t:  t,
+		ts: httptest.NewServer(h),
+		hc: &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }},
+	}
+}
+
+func (c *testClient) do(method, path, body, token string) (int, string) {
+	req, _ := http.NewRequest(method, c.ts.URL+path, strings.NewReader(body))
+	if token != "" {
+		req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+// dial connects the websocket of the user and waits for the first envelope,
+// so the user is in the roster when dial returns.
+func (c *testClient) dial(token string) *websocket.Conn {
+	wc, err := websocket.NewConfig(strings.Replace(c.ts.URL, "http", "ws", 1)+"/ws", c.ts.URL)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	wc.Header.Set("Token", token)
+	ws, err := websocket.DialConfig(wc)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var e prot.Envelope
+	if err = websocket.JSON.Receive(ws, &e); err != nil {
+		c.t.Fatal(err)
+	}
+	return ws
+}
+
+// history waits for the text in the history of the general room.
+func (c *testClient) history(token, text string) string {
+	for i := 0; i < 50; i++ {
+		_, body := c.do("GET", "/api/history?room=general", "", token)
+		if strings.Contains(body, text) {
+			return body
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return ""
+}
+
+// editLoop edits and reacts to the message "ID TEXT" in background, so the worker changes
+// the message while handlers encode it. Returned channel is closed at the end.
+func (c *testClient) editLoop(token, idText string) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		id := strings.Fields(idText)[0]
+		for i := 0; i < 20; i++ {
+			c.do("POST", "/m", "/edit "+idText+" "+strconv.Itoa(i), token)
+			c.do("POST", "/m", "/react "+id+" +1", token)
+		}
+	}()
+	return done
+}
+
+func TestServer(t *testing.T) {
+	opts := Options{
+		Auth:   testAuth{"T1": "alice"},
+		Mailer: testMailer(make(chan *mailer.Message, 10)),
+	}
+	s, dir := newTestServer(t, opts)
+	defer os.RemoveAll(dir)
+
+	c := newTestClient(t, s.Handler())
+	defer c.ts.Close()
+
+	if code, _ := c.do("POST", "/m", "hello", "T1"); code != http.StatusServiceUnavailable {
+		t.Errorf("not started: %d", code)
+	}
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err == nil {
+		t.Error("server is started twice")
+	}
+
+	if code, _ := c.do("POST", "/m", "hello", "bad"); code != http.StatusUnauthorized {
+		t.Errorf("unknown token: %d", code)
+	}
+	if code, _ := c.do("GET", "/auth", "", ""); code != http.StatusFound {
+		t.Errorf("auth handler is mounted with custom auth: %d", code)
+	}
+	if code, body := c.do("POST", "/m", "hello *world*", "T1"); code != http.StatusOK {
+		t.Fatalf("post: %d %s", code, body)
+	}
+	if code, body := c.do("POST", "/m", "/nosuch <x>", "T1"); code != http.StatusOK || !strings.HasPrefix(body, "unknown command /nosuch") {
+		t.Errorf("command error: %d %q", code, body)
+	}
+	if _, body := c.do("POST", "/m", "/webhook list", "T1"); body != "/webhook: permission denied\n" {
+		t.Errorf("command error: %q", body)
+	}
+
+	if body := c.history("T1", "hello"); !strings.Contains(body, `"name":"alice"`) {
+		t.Fatalf("history: %s", body)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.rooms) != 0 || s.index.messages[1] != nil {
+		t.Error("state is not reset")
+	}
+	if code, _ := c.do("GET", "/api/history?room=general", "", "T1"); code != http.StatusServiceUnavailable {
+		t.Errorf("stopped: %d", code)
+	}
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if body := c.history("T1", "hello"); body == "" {
+		t.Error("history is not loaded after restart")
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTwoServers(t *testing.T) {
+	opts := Options{
+		Auth:   testAuth{"T1": "alice"},
+		Mailer: testMailer(make(chan *mailer.Message, 10)),
+	}
+	s1, dir1 := newTestServer(t, opts)
+	defer os.RemoveAll(dir1)
+	s2, dir2 := newTestServer(t, opts)
+	defer os.RemoveAll(dir2)
+
+	workDir := config.Config.WorkDir
+	for _, s := range []*Server{s1, s2} {
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Shutdown(context.Background())
+	}
+	if config.Config.WorkDir != workDir {
+		t.Error("global config is changed")
+	}
+
+	c1 := newTestClient(t, s1.Handler())
+	defer c1.ts.Close()
+	c2 := newTestClient(t, s2.Handler())
+	defer c2.ts.Close()
+
+	c1.do("POST", "/m", "one", "T1")
+	c2.do("POST", "/m", "two", "T1")
+	if body := c1.history("T1", "one"); body == "" || strings.Contains(body, "two") {
+		t.Errorf("first server history: %s", body)
+	}
+	if body := c2.history("T1", "two"); body == "" || strings.Contains(body, "one") {
+		t.Errorf("second server history: %s", body)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice"}})
+	defer os.RemoveAll(dir)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	c := newTestClient(t, s.Handler())
+	defer c.ts.Close()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="file"; filename="my *notes* (1).txt"`)
+	h.Set("Content-Type", "text/plain")
+	pw, _ := mw.CreatePart(h)
+	pw.Write([]byte("notes"))
+	mw.Close()
+
+	req, _ := http.NewRequest("POST", c.ts.URL+"/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.AddCookie(&http.Cookie{Name: "token", Value: "T1"})
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	page := c.history("T1", "notes")
+	var p prot.HistoryPage
+	if err = json.Unmarshal([]byte(page), &p); err != nil || len(p.Messages) != 1 {
+		t.Fatalf("history: %s %v", page, err)
+	}
+	re := regexp.MustCompile(`\nfile: <a target="chaturls" rel="noopener noreferrer" href="https://` + regexp.QuoteMeta(s.config().Address) +
+		`/\d{14}-my%20%2Anotes%2A%20%281%29.txt">my \*notes\* \(1\)\.txt</a> `)
+	if html := p.Messages[0].HTML; !re.MatchString(html) {
+		t.Errorf("upload notice: %s", html)
+	}
+}
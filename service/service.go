@@ -4,8 +4,6 @@ package service
 //go:generate go run ../cmd/chatembed/chatembed.go
 
 import (
-	"bytes"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"html"
@@ -15,20 +13,17 @@ import (
 	"mime"
 	"mime/multipart"
 	"net/http"
-	"net/textproto"
+	"net/url"
 	"os"
-	"regexp"
+	"path"
 	"strings"
 	"time"
 	"unicode/utf8"
 
-	"github.com/serge-v/toolbox/common"
-
-	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/net/websocket"
 
 	"github.com/milla-v/chat/auth"
-	"github.com/milla-v/chat/config"
+	"github.com/milla-v/chat/markdown"
 	"github.com/milla-v/chat/prot"
 	"github.com/milla-v/chat/util"
 )
@@ -36,52 +31,52 @@ import (
 type client struct {
 	ua              *auth.UserAuth  // user authorization
 	ws              *websocket.Conn // websocket connection
-	lastMessageTime time.Time       // time of last message
-	lastPongTime    time.Time       // time of last pong
+	lastMessageTime time.Time       // time of last message. Set by the worker
+	lastPongTime    time.Time       // time of last pong. Set by the worker
+	lastTypingTime  time.Time       // time of last typing notification
+	connectTime     time.Time       // time of websocket connection
 	ping            int             // ping number
+	room            *room           // current room
+	infos           *[]string       // collects info texts for the http response while the worker processes the request
 }
 
 type message struct {
-	from  *client
-	to    *client
-	text  string
-	label string
+	from    *client
+	to      *client
+	toName  string // private recipient name. The worker resolves it to the client
+	text    string
+	label   string
+	room    string
+	parent  int64         // thread parent message id
+	buttons []string      // message button labels
+	bot     string        // action handler name for message buttons
+	color   string        // RGB color overriding the user color
+	webhook bool          // message is posted by a webhook bot
+	pong    bool          // the websocket client answered a ping. The worker updates the pong time
+	active  bool          // the websocket user sent the message. The worker updates the activity time
+	reply   chan []string // receives info texts sent to the user while the message is processed. Nil for websocket messages
 }
 
 var (
-	version          string
-	date             string
-	clients          = []*client{}   // list of active clients (connected and recently disconnected)
-	history          []prot.Envelope // recent history for replay to connected client
-	recentHistory    string          // recent history for emailing to the admin
-	connectChan      chan *client    // channel to register new client in the list
-	connectedChan    chan *client    // channel to start client routine
-	disconnectChan   chan *client    // channed to deregister the client
-	broadcastChan    chan *message   // channel to pass message to the worker
-	historyFile      *os.File        // file for saving all history
-	tenMinutesTicker = time.NewTicker(time.Minute * time.Duration(10))
-	cfg              = config.Config
+	version string
+	date    string
 )
 
-const helpText = `
-	/help   &mdash; print this help
-	/roster &mdash; refresh user list
-	f       &mdash; show/hide file send panel
-	n       &mdash; show/hide notifications
-	.       &mdash; answer да
-	!       &mdash; answer ДА!!!
-	,       &mdash; answer нет
-	`
-
 // PrintVersion prints service version to the stdout.
 func PrintVersion() {
 	fmt.Println("version:", version)
 	fmt.Println("date:   ", date)
 }
 
-func clientRoutine(cli *client) {
-	broadcastChan <- &message{cli, nil, "/replay", ""}
-	broadcastChan <- &message{cli, nil, "/roster", ""}
+func (s *Server) clientRoutine(cli *client, done <-chan struct{}) {
+	cfg := s.config()
+	for _, cmd := range []string{"/replay", "/roster", "/unread"} {
+		select {
+		case s.broadcastChan <- &message{from: cli, text: cmd}:
+		case <-done:
+			return
+		}
+	}
 	log.Printf("client routine: %+v", cli)
 	if cli.ws != nil {
 		log.Printf("ws addr: %+v", cli.ws.Request().RemoteAddr)
@@ -94,7 +89,10 @@ func clientRoutine(cli *client) {
 		err := websocket.JSON.Receive(cli.ws, &e)
 		if err != nil {
 			log.Printf("disconnecting %s because of %v", cli.ua.Name, err)
-			disconnectChan <- cli
+			select {
+			case s.disconnectChan <- cli:
+			case <-done:
+			}
 			log.Printf("client disconnected")
 			break
 		}
@@ -104,8 +102,11 @@ func clientRoutine(cli *client) {
 				if cfg.Debug {
 					log.Printf("ws pong. user: %s, pong: %d", cli.ua.Name, e.Ping.Pong)
 				}
-				cli.lastPongTime = time.Now()
-				broadcastChan <- &message{cli, nil, "/roster", ""}
+				select {
+				case s.broadcastChan <- &message{from: cli, text: "/roster", pong: true}:
+				case <-done:
+					return
+				}
 			}
 			continue
 		}
@@ -114,10 +115,81 @@ func clientRoutine(cli *client) {
 			if cfg.Debug {
 				log.Printf("ws msg. user: %s, text: %s", cli.ua.Name, e.Message.Text)
 			}
-			cli.lastMessageTime = time.Now()
-			cli.lastPongTime = cli.lastMessageTime
 			text := html.EscapeString(strings.TrimSpace(e.Message.Text))
-			broadcastChan <- &message{cli, nil, text, ""}
+			roomName := e.Room
+			if roomName == "" {
+				roomName = e.Message.Room
+			}
+			select {
+			case s.broadcastChan <- &message{from: cli, toName: e.Message.To, text: text, room: roomName, parent: e.Message.Parent, active: true}:
+			case <-done:
+				return
+			}
+			continue
+		}
+
+		var req *editRequest
+		switch {
+		case e.Edit != nil:
+			escapeEdit(e.Edit)
+			req = &editRequest{cli: cli, edit: e.Edit}
+		case e.Delete != nil:
+			req = &editRequest{cli: cli, del: e.Delete}
+		case e.Reaction != nil:
+			req = &editRequest{cli: cli, react: e.Reaction}
+		}
+		if req != nil {
+			select {
+			case s.editChan <- req:
+			case <-done:
+				return
+			}
+			continue
+		}
+
+		if e.Action != nil {
+			select {
+			case s.actionChan <- &actionRequest{cli: cli, action: *e.Action}:
+			case <-done:
+				return
+			}
+			continue
+		}
+
+		if e.Presence != nil {
+			escapePresence(e.Presence)
+			select {
+			case s.presenceChan <- &presenceUpdate{cli: cli, presence: *e.Presence}:
+			case <-done:
+				return
+			}
+			continue
+		}
+
+		if e.Typing != nil {
+			select {
+			case s.typingChan <- &typing{cli: cli, typing: *e.Typing}:
+			default:
+				// typing is transient. Drop it if the worker is busy.
+			}
+			continue
+		}
+
+		if e.MarkRead != nil {
+			select {
+			case s.markReadChan <- &markRead{cli: cli, mark: *e.MarkRead}:
+			case <-done:
+				return
+			}
+			continue
+		}
+
+		if e.HistoryRequest != nil {
+			select {
+			case s.historyChan <- &historyQuery{cli: cli, req: *e.HistoryRequest}:
+			case <-done:
+				return
+			}
 			continue
 		}
 
@@ -125,25 +197,30 @@ func clientRoutine(cli *client) {
 	}
 }
 
-func removeFromList(cli *client) {
+func (s *Server) removeFromList(cli *client) {
+	cfg := s.config()
 	if cfg.Debug {
 		log.Println("removing", cli.ua.Name, "remoteAddr:", cli.ws.Request().RemoteAddr)
 	}
-	for idx, c := range clients {
+	for idx, c := range s.clients {
 		if c != cli {
 			continue
 		}
-		clients = append(clients[:idx], clients[idx+1:]...)
+		s.clients = append(s.clients[:idx], s.clients[idx+1:]...)
 		cli.ws.Close()
 		break
 	}
+	for _, r := range s.rooms {
+		r.leave(cli)
+	}
+	s.broadcastRoster()
 	if cfg.Debug {
-		log.Printf("clients left: %d", len(clients))
+		log.Printf("clients left: %d", len(s.clients))
 	}
 }
 
-func findClient(token string) (*client, error) {
-	for _, c := range clients {
+func (s *Server) findClient(token string) (*client, error) {
+	for _, c := range s.clients {
 		if c.ua.Token == token {
 			return c, nil
 		}
@@ -151,8 +228,8 @@ func findClient(token string) (*client, error) {
 	return nil, http.ErrNoCookie
 }
 
-func findClientByEmail(email string) (*client, error) {
-	for _, c := range clients {
+func (s *Server) findClientByEmail(email string) (*client, error) {
+	for _, c := range s.clients {
 		if c.ua.Email == email {
 			return c, nil
 		}
@@ -160,12 +237,23 @@ func findClientByEmail(email string) (*client, error) {
 	return nil, http.ErrNoCookie
 }
 
-func onWebsocketConnection(ws *websocket.Conn) {
-	cli := &client{ws: ws}
-	connectChan <- cli
-	cli = <-connectedChan
-	if cli != nil {
-		clientRoutine(cli)
+// connectRequest registers the websocket connection in the worker. The worker replies
+// with the registered client or nil if the connection is not authorized.
+type connectRequest struct {
+	ws    *websocket.Conn
+	reply chan *client
+}
+
+func (s *Server) onWebsocketConnection(ws *websocket.Conn) {
+	done := s.workerDone()
+	req := &connectRequest{ws: ws, reply: make(chan *client, 1)}
+	select {
+	case s.connectChan <- req:
+	case <-done:
+		return
+	}
+	if cli := <-req.reply; cli != nil {
+		s.clientRoutine(cli, done)
 	}
 }
 
@@ -176,7 +264,17 @@ var colors = map[string]string{
 }
 
 func replayHistory(cli *client) {
-	h := history
+	if cli.room == nil {
+		return
+	}
+
+	// thread replies are not replayed. Parent messages have thread summary.
+	var h []prot.Envelope
+	for _, e := range cli.room.history {
+		if e.Message == nil || e.Message.Parent == 0 {
+			h = append(h, e)
+		}
+	}
 	if len(h) > 100 {
 		h = h[len(h)-100:]
 	}
@@ -218,36 +316,59 @@ func autoreplaceText(s string) string {
 	return s
 }
 
-func sendToAllClients(from *client, text, label string) {
-	e := prot.Envelope{}
+// formatHTML renders escaped message text as markdown.
+func formatHTML(text string) string {
+	return markdown.HTML(html.UnescapeString(text))
+}
+
+func (s *Server) sendToRoom(r *room, m *message) {
+	from, text, label := m.from, m.text, m.label
+	e := prot.Envelope{Room: r.name}
 	now := time.Now()
 	e.Message = new(prot.Message)
 	msg := e.Message
+	msg.ID = s.nextID()
 	msg.Ts = now
+	msg.Room = r.name
+	msg.Parent = m.parent
+	msg.Buttons = m.buttons
+	msg.Bot = m.bot
 	msg.Name = from.ua.Name
 	msg.Text = autoreplaceText(text)
 	msg.Notification = label
 	msg.Color, _ = colors[strings.ToLower(msg.Name)]
+	if m.color != "" {
+		msg.Color = m.color
+	}
+	msg.Webhook = m.webhook
+	msg.Mentions = s.parseMentions(msg.Text)
 	msg.ColorXterm256 = util.RGB2xterm(msg.Color)
 
 	if label == "" {
 		msg.Notification = cutRunes(text, 64)
 	}
 
-	re := regexp.MustCompile("https?://[^ \n]+")
-	text = re.ReplaceAllString(text, "<a target=\"chaturls\" href=\"$0\">$0</a>")
-	if strings.Contains(text, "\n") {
-		text = "<pre>" + msg.Text + "</pre>"
+	text = formatHTML(msg.Text)
+	capname := `<span class="smallcaps">` + nameAbbrev(from.ua.Name) + "</span>"
+	if m.webhook {
+		capname += ` <span class="ts">bot</span>`
 	}
-	capname := `<span class="smallcaps">` + strings.Title(from.ua.Name[:3]) + "</span>.\n"
-	msg.HTML = "<p>" + capname + msg.Text + ` <span class="ts">(` + now.Format("15:04") + ")</span></p>\n"
+	capname += ".\n"
+	msg.HTML = "<p>" + capname + text + ` <span class="ts">(` + now.Format("15:04") + ")</span></p>\n"
 
-	for _, cli := range clients {
+	// mentions notify only the mentioned users
+	targets := s.mentionTargets(r, msg.Mentions)
+	for _, cli := range r.clients {
 		if cli.ws == nil || from == cli {
 			continue
 		}
 
-		err := websocket.JSON.Send(cli.ws, &e)
+		ec := &e
+		if s.isDND(cli.ua.Name) || len(msg.Mentions) > 0 && !targets[cli.ua.Name] {
+			ec = withoutNotification(&e)
+		}
+
+		err := websocket.JSON.Send(cli.ws, ec)
 		if err != nil {
 			log.Println("cannot send to", cli.ua.Name, err)
 		}
@@ -263,29 +384,33 @@ func sendToAllClients(from *client, text, label string) {
 	}
 
 	msg.HTML = "<p>" + `<span class="ts">` + now.Format("2006-01-02 15:04:05") + "</span> " + msg.Name + ": " + text + "</p>\n"
-	recentHistory += msg.HTML + "\n"
-	fmt.Fprintln(historyFile, msg.HTML)
+	fmt.Fprintln(r.historyFile, msg.HTML)
 
 	msg.HTML = "<p>" + capname + text + ` <span class="ts">(` + now.Format("15:04") + ")</span></p>\n"
-	history = append(history, e)
+	r.history = s.trimHistory(append(r.history, e))
+	s.storeEnvelope(&e)
+	s.index.add(msg)
+	s.addMentions(msg, targets)
+	for name := range targets {
+		s.queueNotification(name, msg)
+	}
+	s.sendThreadSummary(msg)
+	s.dispatchWebhooks(msg)
+	s.startPreview(msg)
 }
 
-func pingClients() {
-	for _, cli := range clients {
+// pingClients pings every connected client and disconnects the clients which do not answer.
+func (s *Server) pingClients() {
+	cfg := s.config()
+	var lost []*client
+	for _, cli := range s.clients {
 		if cli.ws == nil {
 			continue
 		}
 
-		if time.Since(cli.lastPongTime) < time.Second*480 {
-			if cfg.Debug {
-				log.Printf("recent pong: %s\n", cli.ua.Name)
-			}
-			continue
-		}
-
-		if time.Since(cli.lastPongTime) > time.Second*720 {
-			log.Printf("no pong for 180 sec, disconnecting %s", cli.ua.Name)
-			disconnectChan <- cli
+		if time.Since(cli.lastPongTime) > disconnectTimeout {
+			log.Printf("no pong for %v, disconnecting %s", disconnectTimeout, cli.ua.Name)
+			lost = append(lost, cli)
 			continue
 		}
 
@@ -303,18 +428,30 @@ func pingClients() {
 			log.Printf("ping %s\n", cli.ua.Name)
 		}
 	}
+
+	for _, cli := range lost {
+		s.removeFromList(cli)
+	}
 }
 
-func sendHelp(cli *client) {
-	if len(clients) == 0 {
+// sendInfo sends preformatted service text to the client only.
+func sendInfo(cli *client, text string) {
+	if cli.infos != nil {
+		*cli.infos = append(*cli.infos, text)
+	}
+	if cli.ws == nil {
 		return
 	}
 
 	e := prot.Envelope{}
 	e.Message = new(prot.Message)
 	e.Message.Ts = time.Now()
+	if cli.room != nil {
+		e.Room = cli.room.name
+		e.Message.Room = cli.room.name
+	}
 
-	e.Message.Text = helpText
+	e.Message.Text = text
 	e.Message.HTML = "<p><pre>" + e.Message.Text + "</pre></p>\n"
 
 	err := websocket.JSON.Send(cli.ws, &e)
@@ -323,21 +460,71 @@ func sendHelp(cli *client) {
 	}
 }
 
-func sendRoster(cli *client) {
-	e := prot.Envelope{}
-	e.Roster = new(prot.Roster)
-	now := time.Now()
-	e.Roster.Ts = now
+func (s *Server) sendRooms(cli *client) {
+	sendInfo(cli, "rooms: "+strings.Join(s.roomNames(), ", "))
+}
 
-	for _, cli := range clients {
-		e.Roster.Text += cli.ua.Name + ", "
+func (s *Server) joinRoom(cli *client, name string) {
+	cfg := s.config()
+	r, err := s.getRoom(name)
+	if err != nil {
+		log.Println("join:", err)
+		sendInfo(cli, "cannot join: "+err.Error())
+		return
 	}
 
-	e.Roster.Text = strings.Trim(e.Roster.Text, ", ")
-	e.Roster.HTML = "in room: " + e.Roster.Text
+	if r.join(cli) {
+		s.saveRooms()
+	}
+	if cfg.Debug {
+		log.Println(cli.ua.Name, "joined", r.name)
+	}
+	s.sendRoster(cli)
+	replayHistory(cli)
+}
+
+func (s *Server) leaveRoom(cli *client, name string) {
+	cfg := s.config()
+	r, err := s.resolveRoom(cli, name)
+	if err != nil {
+		sendInfo(cli, "cannot leave: "+err.Error())
+		return
+	}
+
+	if r.name == defaultRoom {
+		sendInfo(cli, "cannot leave "+defaultRoom)
+		return
+	}
+
+	r.leave(cli)
+	if r.removeMember(cli.ua.Name) {
+		s.saveRooms()
+	}
+	if cli.room == nil {
+		cli.room = s.rooms[defaultRoom]
+	}
+	if cfg.Debug {
+		log.Println(cli.ua.Name, "left", r.name)
+	}
+	s.sendRoster(cli)
+}
+
+func (s *Server) sendRoster(cli *client) {
+	cfg := s.config()
+	if cli.ws == nil || cli.room == nil {
+		return
+	}
+
+	e := prot.Envelope{Room: cli.room.name}
+	e.Roster = new(prot.Roster)
+	now := time.Now()
+	e.Roster.Ts = now
+	e.Roster.Room = cli.room.name
+	e.Roster.Rooms = s.joinedRooms(cli)
+	e.Roster.Users = s.roomPresence(cli.room)
 
 	if cfg.Debug {
-		log.Printf("sending roster: %s", e.Roster.Text)
+		log.Printf("sending roster: %s %d users", cli.room.name, len(e.Roster.Users))
 	}
 
 	err := websocket.JSON.Send(cli.ws, &e)
@@ -360,119 +547,139 @@ func getToken(r *http.Request) (string, error) {
 	return "", errors.New("cannot get token from cookie or header")
 }
 
-func connectClient(cli *client) {
-
-	if cli.ws == nil {
-		return
-	}
+func (s *Server) connectClient(req *connectRequest) {
+	cfg := s.config()
 
 	var err error
 
 	if cfg.Debug {
-		log.Printf("websocket connection. remote addr: %s", cli.ws.Request().RemoteAddr)
+		log.Printf("websocket connection. remote addr: %s", req.ws.Request().RemoteAddr)
 	}
 
-	token, err := getToken(cli.ws.Request())
+	token, err := getToken(req.ws.Request())
 	if err != nil {
 		log.Println("connect client. get token error: ", err)
-		connectedChan <- nil
+		req.reply <- nil
 		return
 	}
 
-	newcli, err := findClient(token)
+	newcli, err := s.findClient(token)
 	if err == nil {
-		newcli.ws = cli.ws
+		newcli.ws = req.ws
 		newcli.lastPongTime = time.Now()
-		connectedChan <- newcli
+		newcli.connectTime = newcli.lastPongTime
+		req.reply <- newcli
+		s.broadcastRoster()
 		return
 	}
 
-	ua, err := auth.GetAuthUser(token)
+	ua, err := s.users.GetAuthUser(token)
 	if err != nil {
 		log.Println("connect client. get auth user error:", err)
-		connectedChan <- nil
+		req.reply <- nil
 		return
 	}
 
-	newcli = &client{ua: ua, ws: cli.ws, lastPongTime: time.Now()}
-	clients = append(clients, newcli)
-	connectedChan <- newcli
+	newcli = &client{ua: ua, ws: req.ws, lastPongTime: time.Now()}
+	newcli.connectTime = newcli.lastPongTime
+	s.clients = append(s.clients, newcli)
+	if s.rooms[defaultRoom].join(newcli) {
+		s.saveRooms()
+	}
+	req.reply <- newcli
+	s.broadcastRoster()
 	if cfg.Debug {
 		log.Println("connect client. connected:", ua.Name)
 	}
 }
 
-func emailRecentHistory() {
-	if len(recentHistory) == 0 {
-		return
-	}
-
-	var b bytes.Buffer
-
-	mwr := multipart.NewWriter(&b)
-
-	to := common.GetRcVar("MAILTO1")
-	fmt.Fprintf(&b, "To: %s\n", to)
-	fmt.Fprintf(&b, "Subject: chat conversations\n")
-	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%s\n\n", mwr.Boundary())
-	headers := make(textproto.MIMEHeader)
-	headers.Add("Content-Type", "text/html")
-	part, err := mwr.CreatePart(headers)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	fmt.Fprintln(part, recentHistory)
-	fmt.Fprintf(&b, ".\n")
-	common.Sendmail(to, b.Bytes())
-	recentHistory = ""
-}
+// workerRoutine owns the hub state and processes requests until the stop request.
+// It closes done when it returns.
+func (s *Server) workerRoutine(done chan struct{}) {
+	pingTicker := time.NewTicker(pingInterval)
+	defer pingTicker.Stop()
+	tenMinutesTicker := time.NewTicker(time.Minute * 10)
+	defer tenMinutesTicker.Stop()
+	compactTicker := time.NewTicker(time.Hour * 24)
+	defer compactTicker.Stop()
 
-func workerRoutine() {
 	for {
 		select {
+		case <-pingTicker.C:
+			// presence is calculated from the pongs to the previous ping
+			s.broadcastRoster()
+			s.pingClients()
 		case <-tenMinutesTicker.C:
-			pingClients()
-			emailRecentHistory()
-		case cli := <-connectChan:
-			connectClient(cli)
-		case cli := <-disconnectChan:
-			removeFromList(cli)
-		case msg := <-broadcastChan:
-			// log.Printf("%+v", msg)
-			switch msg.text {
-			case "/roster":
-				sendRoster(msg.from)
-			case "/help":
-				sendHelp(msg.from)
-			case "/replay":
-				replayHistory(msg.from)
-			default:
-				sendToAllClients(msg.from, msg.text, msg.label)
+			s.expireRestored()
+			s.sendDigests(time.Now())
+		case <-compactTicker.C:
+			s.compactStore()
+		case req := <-s.connectChan:
+			s.connectClient(req)
+		case cli := <-s.disconnectChan:
+			s.removeFromList(cli)
+		case q := <-s.historyChan:
+			s.processHistoryQuery(q)
+		case q := <-s.searchChan:
+			s.processSearchQuery(q)
+		case req := <-s.editChan:
+			s.processEditRequest(req)
+		case req := <-s.markReadChan:
+			s.processMarkRead(req)
+		case t := <-s.typingChan:
+			s.sendTyping(t)
+		case p := <-s.presenceChan:
+			s.setStatus(p.cli, &p.presence)
+		case req := <-s.actionChan:
+			s.processAction(req)
+		case p := <-s.hookChan:
+			s.processHookPost(p)
+		case p := <-s.previewChan:
+			s.processPreview(p)
+		case c := <-s.clickChan:
+			s.processWebhookClick(c)
+		case q := <-s.mentionsChan:
+			s.processMentionsQuery(q)
+		case reply := <-s.reloadChan:
+			reply <- s.reload()
+		case req := <-s.stopChan:
+			if req.upgrade {
+				req.state = s.snapshot()
 			}
+			s.stopWorker()
+			s.resetState()
+			close(done)
+			close(req.done)
+			return
+		case msg := <-s.broadcastChan:
+			// log.Printf("%+v", msg)
+			s.processMessage(msg)
 		}
 	}
 }
 
-func generatePage(source, fname string) {
-	s := "<!-- This file is generated from files/" + fname + ". Do not edit. -->\n\n" + string(source)
-	s = strings.Replace(s, "localhost:8085", cfg.Address, -1)
+func (s *Server) generatePage(source, fname string) error {
+	cfg := s.config()
+	page := "<!-- This file is generated from files/" + fname + ". Do not edit. -->\n\n" + string(source)
+	page = strings.Replace(page, "localhost:8085", cfg.Address, -1)
 
-	s = strings.Replace(s, "{version}", version, 1)
-	s = strings.Replace(s, "{date}", date, 1)
+	page = strings.Replace(page, "{version}", version, 1)
+	page = strings.Replace(page, "{date}", date, 1)
 
-	err := ioutil.WriteFile(cfg.WorkDir+fname, []byte(s), 0666)
-	if err != nil {
-		panic(err)
-	}
+	return ioutil.WriteFile(cfg.WorkDir+fname, []byte(page), 0666)
 }
 
-func generatePages() {
-	generatePage(indexHTML, "index.html")
-	generatePage(loginHTML, "login.html")
+func (s *Server) generatePages() error {
+	if err := s.generatePage(indexHTML, "index.html"); err != nil {
+		return err
+	}
+	return s.generatePage(loginHTML, "login.html")
 }
 
-func messageReceiver(w http.ResponseWriter, r *http.Request) {
+// messageReceiver posts the message or runs the command. Command output and errors
+// are returned in the response body as plain text.
+func (s *Server) messageReceiver(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
 	if r.Method != "POST" {
 		http.Error(w, "only POST method allowed", http.StatusMethodNotAllowed)
 		log.Println("receiver: no POST method")
@@ -486,7 +693,7 @@ func messageReceiver(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ua, err := auth.GetAuthUser(token)
+	ua, err := s.users.GetAuthUser(token)
 	if err != nil {
 		http.Error(w, "no auth user", http.StatusUnauthorized)
 		log.Println("receiver: no auth user.", err)
@@ -506,31 +713,53 @@ func messageReceiver(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cli, err := findClient(ua.Token)
-	if err != nil {
-		cli = &client{ua: ua}
-	}
-
 	text := html.EscapeString(string(body))
 	if cfg.Debug {
 		log.Println("message from", ua.Name, ":", text)
 	}
 
-	m := &message{cli, nil, text, ""}
-	broadcastChan <- m
+	to := r.URL.Query().Get("to")
+	if to != "" && !s.users.UserExists(to) {
+		http.Error(w, "no such user: "+to, http.StatusBadRequest)
+		log.Println("receiver: no such user:", to)
+		return
+	}
+
+	done := s.workerDone()
+	m := &message{from: &client{ua: ua}, toName: to, text: text, room: r.URL.Query().Get("room"), reply: make(chan []string, 1)}
+	if err := s.send(m); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// command output and errors
+	select {
+	case infos := <-m.reply:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, info := range infos {
+			fmt.Fprintln(w, html.UnescapeString(info))
+		}
+	case <-done:
+		http.Error(w, errNotRunning.Error(), http.StatusServiceUnavailable)
+	}
 }
 
 func versionHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "version: %s\ndate: %s\n", version, date)
 }
 
-func createFileServer() http.HandlerFunc {
-	generatePages()
+func (s *Server) createFileServer() http.HandlerFunc {
+	cfg := s.config()
 	dir := http.Dir(cfg.WorkDir)
 	fileserver := http.FileServer(dir)
 
 	f := func(w http.ResponseWriter, r *http.Request) {
 
+		if strings.HasPrefix(path.Clean(r.URL.Path)+"/", "/"+privateDir) {
+			http.NotFound(w, r)
+			return
+		}
+
 		if r.URL.Path != "/login.html" {
 			token, err := getToken(r)
 			if err == http.ErrNoCookie {
@@ -539,7 +768,7 @@ func createFileServer() http.HandlerFunc {
 				return
 			}
 
-			_, err = auth.GetAuthUser(token)
+			_, err = s.users.GetAuthUser(token)
 			if err != nil {
 				http.Redirect(w, r, "/login.html", http.StatusFound)
 				log.Println("redirect unknown user to /login.html")
@@ -556,7 +785,8 @@ func createFileServer() http.HandlerFunc {
 	return f
 }
 
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
 
 	token, err := getToken(r)
 	if err != nil {
@@ -565,7 +795,7 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ua, err := auth.GetAuthUser(token)
+	ua, err := s.users.GetAuthUser(token)
 	if err != nil {
 		http.Error(w, "no auth user", http.StatusUnauthorized)
 		log.Println("upload: no auth user.", err)
@@ -621,57 +851,78 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 
 		fmt.Fprintf(w, "%d bytes sent\n", written)
 
-		text := fmt.Sprintf("file: <a target=\"chaturls\" href=\"%s\">%s</a>", fname, part.FileName())
+		link := "https://" + cfg.Address + "/" + url.PathEscape(fname)
+		text := html.EscapeString("file: [" + markdown.Escape(part.FileName()) + "](" + link + ")")
 		if cfg.Debug {
 			log.Println("upload: file from", ua.Name, fname)
 		}
-		m := &message{&client{ua: ua}, nil, text, "file: " + fname}
-		broadcastChan <- m
+		m := &message{from: &client{ua: ua}, text: text, label: "file: " + fname, room: r.URL.Query().Get("room")}
+		if err := s.send(m); err != nil {
+			log.Println("upload:", err)
+		}
 	}
 	r.Body.Close()
 }
 
-// Run starts a chat http server on address (host:port)
-func Run() {
-	var err error
-
+// Run starts a chat http server with the options on the configured address (host:port).
+// It returns after graceful shutdown on SIGTERM or SIGINT or after the upgrade on SIGUSR2
+// and reloads on SIGHUP.
+func Run(opts Options) {
+	srv, err := New(opts)
+	if err != nil {
+		panic(err)
+	}
+	cfg := srv.config()
 	log.Printf("chat version: %s, date: %s\n", version, date)
 	log.Println("starting server on https://" + cfg.Address + "/")
 
-	connectChan = make(chan *client)
-	connectedChan = make(chan *client, 100)
-	disconnectChan = make(chan *client, 100)
-	broadcastChan = make(chan *message, 100)
-	historyFile, err = os.OpenFile(cfg.WorkDir+"history.html", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
-	if err != nil {
+	if err = srv.loadInherited(); err != nil {
+		panic(err)
+	}
+	if err = srv.Start(); err != nil {
 		panic(err)
 	}
+	mux := srv.Handler()
 
-	mux := http.NewServeMux()
+	tc, redirect, err := srv.setupTLS()
+	if err != nil {
+		panic(err)
+	}
 
-	mux.HandleFunc("/", createFileServer())
-	mux.Handle("/ws", websocket.Handler(onWebsocketConnection))
-	mux.HandleFunc("/m", messageReceiver)
-	mux.HandleFunc("/auth", auth.AuthenticateHandler)
-	mux.HandleFunc("/upload", uploadHandler)
-	mux.HandleFunc("/register", auth.RegisterHandler)
-	mux.HandleFunc("/create", auth.CreateHandler)
-	mux.HandleFunc("/ver", versionHandler)
+	s := &http.Server{
+		Addr:      cfg.HTTP,
+		TLSConfig: tc,
+		Handler:   mux,
+	}
 
-	go workerRoutine()
+	l, err := srv.listen("http", cfg.HTTP)
+	if err != nil {
+		panic(err)
+	}
+	listeners := []*listener{{name: "http", l: l, server: s, tls: tc != nil}}
 
-	m := &autocert.Manager{
-		Cache:      autocert.DirCache(cfg.CertPath),
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist("mx.voilokov.com"),
+	if tc == nil {
+		if s.Handler, err = newProxyHandler(cfg.TLS.TrustedProxies, mux); err != nil {
+			panic(err)
+		}
+		log.Println("starting plain http on", l.Addr())
+	} else {
+		if cfg.TLS.Redirect != "" {
+			rl, err := srv.listen("redirect", cfg.TLS.Redirect)
+			if err != nil {
+				panic(err)
+			}
+			listeners = append(listeners, &listener{name: "redirect", l: rl, server: &http.Server{Handler: redirect}})
+			log.Println("starting http redirect on", rl.Addr())
+		}
+		log.Println("starting on", l.Addr(), "tls mode:", cfg.TLS.Mode)
 	}
 
-	s := &http.Server{
-		Addr:      ":8085",
-		TLSConfig: &tls.Config{GetCertificate: m.GetCertificate},
-		Handler:   mux,
+	serveErr := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go l.serve(serveErr)
 	}
 
-	log.Println("starting on :8085")
-	log.Fatal(s.ListenAndServeTLS("", ""))
+	notifyReady()
+	srv.handleSignals(serveErr, listeners)
 }
@@ -0,0 +1,271 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/milla-v/chat/config"
+)
+
+const (
+	shutdownTimeout = time.Second * 10 // max wait for active http requests on shutdown
+	restartNotice   = "server restarting"
+)
+
+// stopRequest stops the worker. The worker closes done when the data is flushed.
+type stopRequest struct {
+	upgrade bool          // take the snapshot for the new process
+	state   *upgradeState // snapshot taken by the worker
+	done    chan struct{}
+}
+
+// listener is a named server listener which can be passed to the upgraded process.
+type listener struct {
+	name   string
+	l      net.Listener
+	server *http.Server
+	tls    bool // serve https. Not taken from server.TLSConfig which Serve sets for http2
+}
+
+// serve serves the listener until the server is shut down. Other errors are sent to serveErr.
+func (l *listener) serve(serveErr chan error) {
+	var err error
+	if l.tls {
+		err = l.server.ServeTLS(l.l, "", "")
+	} else {
+		err = l.server.Serve(l.l)
+	}
+	if err != http.ErrServerClosed {
+		serveErr <- err
+	}
+}
+
+// drainWorker processes requests accepted before the stop.
+func (s *Server) drainWorker() {
+	for {
+		select {
+		case msg := <-s.broadcastChan:
+			s.processMessage(msg)
+		case req := <-s.editChan:
+			s.processEditRequest(req)
+		case p := <-s.hookChan:
+			s.processHookPost(p)
+		case p := <-s.previewChan:
+			s.processPreview(p)
+		case c := <-s.clickChan:
+			s.processWebhookClick(c)
+		default:
+			return
+		}
+	}
+}
+
+// stopWorker notifies and disconnects clients, processes accepted requests
+// and flushes history files, store and mail queue.
+func (s *Server) stopWorker() {
+	for _, cli := range s.clients {
+		if cli.ws != nil {
+			sendInfo(cli, restartNotice)
+			cli.ws.Close()
+		}
+	}
+	s.clients = nil
+	for _, r := range s.rooms {
+		r.clients = nil
+	}
+
+	s.drainWorker()
+
+	for _, r := range s.rooms {
+		if err := r.historyFile.Sync(); err != nil {
+			log.Println("shutdown: history:", err)
+		}
+		if err := r.historyFile.Close(); err != nil {
+			log.Println("shutdown: history:", err)
+		}
+	}
+
+	if s.store != nil {
+		if err := s.store.Close(); err != nil {
+			log.Println("shutdown: store:", err)
+		}
+		s.store = nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mailQueue != nil {
+		s.mailQueue.Close()
+		s.mailQueue = nil
+	}
+	s.outbox = nil
+}
+
+// reload re-reads config, certificates, user profiles and pages.
+// Listen address, work directory and tls mode are kept until restart.
+// New config is validated and replaces the current one only if certificates are loaded.
+func (s *Server) reload() error {
+	old := s.config()
+	cfg := old
+
+	if s.opts.Reload != nil {
+		c, err := s.opts.Reload()
+		if err != nil {
+			return err
+		}
+		if c.HTTP != old.HTTP || c.WorkDir != old.WorkDir || c.TLS.Mode != old.TLS.Mode {
+			log.Println("reload: http, work_dir and tls.mode changes require restart")
+			c.HTTP, c.WorkDir, c.TLS.Mode = old.HTTP, old.WorkDir, old.TLS.Mode
+		}
+		if errs := c.Check(); len(errs) > 0 {
+			return fmt.Errorf("config: %v", errs)
+		}
+		cfg = c
+	}
+
+	if s.certs != nil {
+		certFile, keyFile := s.certs.certFile, s.certs.keyFile
+		if cfg.TLS.Mode == config.TLSStatic {
+			certFile, keyFile = cfg.TLS.CertFile, cfg.TLS.KeyFile
+		}
+		if err := s.certs.reload(certFile, keyFile); err != nil {
+			return err
+		}
+	}
+	s.cfg.Store(cfg)
+
+	if s.files != nil {
+		s.files.Reload()
+	}
+	return s.generatePages()
+}
+
+// handleSignals reloads on SIGHUP, upgrades on SIGUSR2 and shuts the servers down on SIGTERM or SIGINT.
+// It returns after shutdown or upgrade. Server failure shuts down and exits with an error.
+func (s *Server) handleSignals(serveErr chan error, listeners []*listener) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case err := <-serveErr:
+			s.shutdown(false, listeners)
+			log.Fatal("server: ", err)
+		case sig := <-sigs:
+			switch sig {
+			case syscall.SIGHUP:
+				log.Println("signal:", sig, "reloading")
+				reply := make(chan error)
+				s.reloadChan <- reply
+				if err := <-reply; err != nil {
+					log.Println("reload:", err)
+				} else {
+					log.Println("reload: done")
+				}
+			case syscall.SIGUSR2:
+				log.Println("signal:", sig, "upgrading")
+				if err := s.upgrade(listeners, serveErr); err != nil {
+					log.Println(err)
+					continue
+				}
+				log.Println("upgrade: done")
+				return
+			default:
+				log.Println("signal:", sig, "shutting down")
+				s.shutdown(false, listeners)
+				return
+			}
+		}
+	}
+}
+
+// shutdown stops accepting connections, waits for active requests and stops the worker.
+// It returns the worker snapshot if forUpgrade is set.
+func (s *Server) shutdown(forUpgrade bool, listeners []*listener) *upgradeState {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, l := range listeners {
+		if err := l.server.Shutdown(ctx); err != nil {
+			log.Println("shutdown:", err)
+		}
+	}
+
+	// worker flushes the data without timeout
+	st, err := s.stop(context.Background(), forUpgrade)
+	if err != nil {
+		log.Println("shutdown:", err)
+	}
+	log.Println("shutdown: done")
+	return st
+}
+
+// upgrade passes the listeners and the hub snapshot to the new binary and returns when it serves.
+// The old process keeps serving if the new binary cannot run. If the new process fails
+// after the worker is stopped, the worker is started again with the snapshot.
+func (s *Server) upgrade(listeners []*listener, serveErr chan error) error {
+	if err := s.checkExecutable(); err != nil {
+		return err
+	}
+
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		f, err := listenerFile(l.l)
+		if err != nil {
+			return err
+		}
+		names = append(names, l.name)
+		files = append(files, f)
+	}
+
+	st := s.shutdown(true, listeners)
+	if err := s.startUpgraded(st, names, files); err != nil {
+		if rerr := s.resume(st, listeners, files, serveErr); rerr != nil {
+			// cannot serve. Exit and let the service manager restart.
+			log.Fatal(err, "; resume: ", rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// resume starts the worker with the snapshot and serves the listener files again after a failed upgrade.
+func (s *Server) resume(st *upgradeState, listeners []*listener, files []*os.File, serveErr chan error) error {
+	if st != nil {
+		if err := s.writeUpgradeState(st); err != nil {
+			log.Println("upgrade: cannot save state:", err)
+		} else {
+			os.Setenv(upgradeStateEnv, s.upgradeStateFile())
+		}
+	}
+	if err := s.Start(); err != nil {
+		return err
+	}
+
+	for i, l := range listeners {
+		nl, err := net.FileListener(files[i])
+		if err != nil {
+			return err
+		}
+		// shut down server cannot serve again
+		l.l = nl
+		l.server = &http.Server{Addr: l.server.Addr, Handler: l.server.Handler, TLSConfig: l.server.TLSConfig}
+		go l.serve(serveErr)
+	}
+	log.Println("upgrade: old process resumed")
+	return nil
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/milla-v/chat/auth"
+	"github.com/milla-v/chat/config"
+	"github.com/milla-v/chat/prot"
+)
+
+func TestStopWorker(t *testing.T) {
+	s, dir := newTestServer(t, Options{})
+	defer os.RemoveAll(dir)
+
+	r, err := s.getRoom(defaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.store, err = OpenLogStore(dir+"/store/", Retention{}); err != nil {
+		t.Fatal(err)
+	}
+
+	connected := make(chan struct{})
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		s.clients = append(s.clients, &client{ua: &auth.UserAuth{Name: "bob"}, ws: ws})
+		close(connected)
+		var e prot.Envelope
+		websocket.JSON.Receive(ws, &e)
+	}))
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http", "ws", 1), "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	<-connected
+
+	s.stopWorker()
+
+	var e prot.Envelope
+	if err = websocket.JSON.Receive(ws, &e); err != nil || e.Message == nil || e.Message.Text != restartNotice {
+		t.Errorf("notice: %+v %v", e.Message, err)
+	}
+	if err = websocket.JSON.Receive(ws, &e); err == nil {
+		t.Error("connection is not closed")
+	}
+
+	if len(s.clients) != 0 || s.store != nil {
+		t.Errorf("clients: %d, store: %v", len(s.clients), s.store)
+	}
+	if _, err = r.historyFile.WriteString("x"); err == nil {
+		t.Error("history file is not closed")
+	}
+}
+
+func TestReload(t *testing.T) {
+	s, dir := newTestServer(t, Options{})
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	if err := generateSelfSigned(certFile, keyFile, []string{"chat.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if s.certs, err = newCertReloader(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	c := s.config().Clone()
+	c.Address = "chat.example.com"
+	c.CertPath = dir + "/certs"
+	c.Mail.From = "chat@example.com"
+	c.Mail.Admin = "admin@example.com"
+	c.TLS = config.TLSConfig{Mode: config.TLSStatic, CertFile: certFile, KeyFile: keyFile}
+	s.cfg.Store(c)
+
+	var next *config.ServiceConfig
+	s.opts.Reload = func() (*config.ServiceConfig, error) { return next, nil }
+
+	next = c.Clone()
+	next.Admins = []string{"root"}
+	next.HTTP = ":9999"
+	if err = s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := s.config(); len(cfg.Admins) != 1 || cfg.HTTP != c.HTTP {
+		t.Errorf("reloaded config: %v %s", cfg.Admins, cfg.HTTP)
+	}
+	c = s.config()
+
+	next = c.Clone()
+	next.Admins = nil
+	next.Mail.Transport = "pigeon"
+	if err = s.reload(); err == nil {
+		t.Error("invalid config is accepted")
+	}
+	if s.config() != c {
+		t.Error("invalid config is applied")
+	}
+
+	broken := dir + "/broken.pem"
+	ioutil.WriteFile(broken, []byte("broken"), 0600)
+	next = c.Clone()
+	next.Admins = nil
+	next.TLS.CertFile, next.TLS.KeyFile = broken, broken
+	if err = s.reload(); err == nil {
+		t.Error("broken certificate is accepted")
+	}
+	if s.config() != c || s.certs.certFile != certFile {
+		t.Error("config with broken certificate is applied")
+	}
+}
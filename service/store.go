@@ -0,0 +1,560 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/milla-v/chat/prot"
+)
+
+// Store keeps structured chat history.
+type Store interface {
+	// Append saves the envelope. Envelope is durable when Append returns.
+	Append(e *prot.Envelope) error
+	// Replay calls fn for every retained envelope in the order they were appended.
+	Replay(fn func(e *prot.Envelope)) error
+	// Compact drops envelopes which are out of retention and merges old segments.
+	Compact() error
+	// LastID returns the largest appended message id including dropped envelopes.
+	LastID() int64
+	// Close closes the store.
+	Close() error
+}
+
+// Retention limits the stored history.
+type Retention struct {
+	MaxCount int           // max envelopes per room or private conversation. 0 is unlimited.
+	MaxAge   time.Duration // max envelope age. 0 is unlimited.
+}
+
+// segmentSize is a size after which the log store starts a new segment.
+const segmentSize = 4 << 20
+
+// logRecord is a line of the log segment.
+// Compacted segment starts with the record with CompactedUpto set to the last merged segment number
+// and LastID set to the largest message id of the merged segments, so ids are not reused when
+// all messages are dropped.
+type logRecord struct {
+	CompactedUpto int            `json:"compacted_upto,omitempty"`
+	LastID        int64          `json:"last_id,omitempty"`
+	Envelope      *prot.Envelope `json:"envelope,omitempty"`
+}
+
+// logStore is an append-only on-disk Store. Each record is a line "CRC32 JSON".
+// Incomplete or corrupted tail of the last segment is truncated on open.
+type logStore struct {
+	dir       string
+	retention Retention
+	segments  []int    // segment numbers in ascending order. The last one is active.
+	active    *os.File // active segment
+	size      int64    // active segment size
+	lastID    int64    // largest appended message id
+}
+
+// OpenLogStore opens or creates the log store in dir.
+func OpenLogStore(dir string, retention Retention) (Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &logStore{dir: dir, retention: retention}
+	if err := s.scan(); err != nil {
+		return nil, err
+	}
+
+	if len(s.segments) == 0 {
+		s.segments = []int{1}
+	}
+
+	if err := s.openActive(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *logStore) segmentName(n int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%06d.log", n))
+}
+
+// scan finds segments and removes the ones already merged into a compacted segment.
+func (s *logStore) scan() error {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.log"))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), ".log"))
+		if err != nil {
+			log.Println("store: skip", name)
+			continue
+		}
+		s.segments = append(s.segments, n)
+	}
+	sort.Ints(s.segments)
+
+	compacted := 0
+	for _, n := range s.segments {
+		err := s.readSegment(n, func(rec *logRecord) {
+			if rec.CompactedUpto > compacted {
+				compacted = rec.CompactedUpto
+			}
+			s.updateLastID(rec)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var left []int
+	for _, n := range s.segments {
+		if n > compacted {
+			left = append(left, n)
+			continue
+		}
+		if err := os.Remove(s.segmentName(n)); err != nil {
+			return err
+		}
+		log.Println("store: removed merged segment", n)
+	}
+	s.segments = left
+	return nil
+}
+
+func (s *logStore) openActive() error {
+	n := s.segments[len(s.segments)-1]
+	f, err := os.OpenFile(s.segmentName(n), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+
+	valid, err := validLength(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if st.Size() != valid {
+		log.Printf("store: segment %d truncated from %d to %d", n, st.Size(), valid)
+		if err = f.Truncate(valid); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if _, err = f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	s.active = f
+	s.size = valid
+	return nil
+}
+
+// validLength returns length of the segment prefix which consists of complete valid records.
+func validLength(r io.Reader) (int64, error) {
+	var valid int64
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return valid, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if _, err := decodeRecord(line); err != nil {
+			return valid, nil
+		}
+		valid += int64(len(line))
+	}
+}
+
+func encodeRecord(rec *logRecord) ([]byte, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)), nil
+}
+
+func decodeRecord(line []byte) (*logRecord, error) {
+	if len(line) < 10 || line[8] != ' ' || line[len(line)-1] != '\n' {
+		return nil, errors.New("broken record")
+	}
+
+	sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	data := line[9 : len(line)-1]
+	if crc32.ChecksumIEEE(data) != uint32(sum) {
+		return nil, errors.New("record checksum mismatch")
+	}
+
+	var rec logRecord
+	if err = json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// readSegment calls fn for every valid record of the segment. Stops at the first broken record.
+func (s *logStore) readSegment(n int, fn func(rec *logRecord)) error {
+	f, err := os.Open(s.segmentName(n))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rec, err := decodeRecord(line)
+		if err != nil {
+			log.Printf("store: segment %d: %v", n, err)
+			return nil
+		}
+		fn(rec)
+	}
+}
+
+func (s *logStore) write(rec *logRecord) error {
+	line, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+
+	if s.active == nil {
+		// previous compaction could not open the new segment
+		if err = s.openActive(); err != nil {
+			return err
+		}
+	}
+
+	if _, err = s.active.Write(line); err != nil {
+		return err
+	}
+	s.size += int64(len(line))
+	return s.active.Sync()
+}
+
+// updateLastID updates the largest message id from the record.
+func (s *logStore) updateLastID(rec *logRecord) {
+	if rec.LastID > s.lastID {
+		s.lastID = rec.LastID
+	}
+	if e := rec.Envelope; e != nil && e.Message != nil && e.Message.ID > s.lastID {
+		s.lastID = e.Message.ID
+	}
+}
+
+func (s *logStore) LastID() int64 {
+	return s.lastID
+}
+
+func (s *logStore) Append(e *prot.Envelope) error {
+	rec := &logRecord{Envelope: e}
+	if err := s.write(rec); err != nil {
+		return err
+	}
+	s.updateLastID(rec)
+
+	if s.size < segmentSize {
+		return nil
+	}
+
+	if err := s.active.Close(); err != nil {
+		return err
+	}
+	s.active = nil
+	s.segments = append(s.segments, s.segments[len(s.segments)-1]+1)
+	return s.openActive()
+}
+
+// historyKey returns room name or private conversation key of the envelope.
+func historyKey(e *prot.Envelope) string {
+	if e.Message != nil && e.Message.To != "" {
+		return "@" + privateKey(e.Message.Name, e.Message.To)
+	}
+	return "#" + e.Room
+}
+
+func envelopeTime(e *prot.Envelope) time.Time {
+	switch {
+	case e.Message != nil:
+		return e.Message.Ts
+	case e.Edit != nil:
+		return e.Edit.Ts
+	case e.Delete != nil:
+		return e.Delete.Ts
+	case e.Reaction != nil:
+		return e.Reaction.Ts
+	case e.Action != nil:
+		return e.Action.Ts
+	case e.Preview != nil:
+		return e.Preview.Ts
+	}
+	return time.Time{}
+}
+
+// eachRetained calls fn for every envelope which is within retention limits.
+// Segments are read twice: the first pass counts envelopes by history key,
+// the second one skips all but the last MaxCount of every key. Stops at the first fn error.
+func (s *logStore) eachRetained(fn func(e *prot.Envelope) error) error {
+	now := time.Now()
+	expired := func(e *prot.Envelope) bool {
+		return s.retention.MaxAge > 0 && now.Sub(envelopeTime(e)) > s.retention.MaxAge
+	}
+
+	totals := map[string]int{}
+	if s.retention.MaxCount > 0 {
+		for _, n := range s.segments {
+			err := s.readSegment(n, func(rec *logRecord) {
+				if rec.Envelope != nil && !expired(rec.Envelope) {
+					totals[historyKey(rec.Envelope)]++
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var fnErr error
+	for _, n := range s.segments {
+		err := s.readSegment(n, func(rec *logRecord) {
+			e := rec.Envelope
+			if fnErr != nil || e == nil || expired(e) {
+				return
+			}
+			if s.retention.MaxCount > 0 {
+				key := historyKey(e)
+				totals[key]--
+				if totals[key] >= s.retention.MaxCount {
+					return
+				}
+			}
+			fnErr = fn(e)
+		})
+		if err != nil {
+			return err
+		}
+		if fnErr != nil {
+			return fnErr
+		}
+	}
+	return nil
+}
+
+func (s *logStore) Replay(fn func(e *prot.Envelope)) error {
+	return s.eachRetained(func(e *prot.Envelope) error {
+		fn(e)
+		return nil
+	})
+}
+
+// Compact merges all segments into a new one which has only retained envelopes.
+// The new segment is written into a temporary file and renamed.
+// Merged segments are removed after the rename or on next open if the process crashes.
+// The active segment stays open if the compaction fails.
+func (s *logStore) Compact() error {
+	last := s.segments[len(s.segments)-1]
+	next := last + 1
+	tmpName := s.segmentName(next) + ".tmp"
+
+	count, err := s.writeCompacted(tmpName, last)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	if err = os.Rename(tmpName, s.segmentName(next)); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	if s.active != nil {
+		if err = s.active.Close(); err != nil {
+			log.Println("store: cannot close active segment:", err)
+		}
+		s.active = nil
+	}
+
+	for _, n := range s.segments {
+		if err = os.Remove(s.segmentName(n)); err != nil {
+			log.Println("store: cannot remove merged segment:", err)
+		}
+	}
+
+	log.Printf("store: compacted %d segments, %d envelopes retained", len(s.segments), count)
+	s.segments = []int{next}
+	return s.openActive()
+}
+
+// writeCompacted writes retained envelopes into the file. Returns number of written envelopes.
+func (s *logStore) writeCompacted(name string, last int) (int, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+
+	w := bufio.NewWriter(f)
+	writeRecord := func(rec *logRecord) error {
+		line, err := encodeRecord(rec)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(line)
+		return err
+	}
+
+	count := 0
+	err = writeRecord(&logRecord{CompactedUpto: last, LastID: s.lastID})
+	if err == nil {
+		err = s.eachRetained(func(e *prot.Envelope) error {
+			count++
+			return writeRecord(&logRecord{Envelope: e})
+		})
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	return count, f.Close()
+}
+
+func (s *logStore) Close() error {
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Close()
+	s.active = nil
+	return err
+}
+
+// moveStore moves the store of older versions from the web root to dir.
+func moveStore(old, dir string) error {
+	if _, err := os.Stat(old); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("store: both %s and %s exist, remove one of them", old, dir)
+	}
+	if err := os.MkdirAll(filepath.Dir(filepath.Clean(dir)), 0700); err != nil {
+		return err
+	}
+	log.Println("store: moving", old, "to", dir)
+	return os.Rename(old, dir)
+}
+
+// trimHistory keeps in memory no more envelopes than the store retains.
+func (s *Server) trimHistory(h []prot.Envelope) []prot.Envelope {
+	cfg := s.config()
+	if cfg.HistoryMaxCount > 0 && len(h) > cfg.HistoryMaxCount {
+		for _, e := range h[:len(h)-cfg.HistoryMaxCount] {
+			if e.Message != nil {
+				s.index.remove(e.Message)
+			}
+		}
+		h = h[len(h)-cfg.HistoryMaxCount:]
+	}
+	return h
+}
+
+func (s *Server) storeEnvelope(e *prot.Envelope) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.Append(e); err != nil {
+		log.Println("store: cannot append:", err)
+	}
+}
+
+func (s *Server) compactStore() {
+	if err := s.store.Compact(); err != nil {
+		log.Println("store: cannot compact:", err)
+	}
+}
+
+// loadHistory rebuilds rooms and private conversations history from the store.
+func (s *Server) loadHistory() error {
+	count := 0
+	err := s.store.Replay(func(e *prot.Envelope) {
+		count++
+		if e.Edit != nil || e.Delete != nil {
+			s.loadEdit(e)
+			return
+		}
+
+		if e.Reaction != nil {
+			s.loadReaction(e)
+			return
+		}
+
+		if e.Action != nil {
+			s.loadAction(e)
+			return
+		}
+
+		if e.Preview != nil {
+			s.loadPreview(e)
+			return
+		}
+
+		if e.Message != nil {
+			s.index.add(e.Message)
+			s.addReply(e.Message)
+		}
+
+		if e.Message != nil && e.Message.To != "" {
+			key := privateKey(e.Message.Name, e.Message.To)
+			s.privateHistory[key] = append(s.privateHistory[key], *e)
+			return
+		}
+
+		r, err := s.getRoom(e.Room)
+		if err != nil {
+			log.Println("store: skip envelope:", err)
+			return
+		}
+		r.history = append(r.history, *e)
+	})
+
+	// ids of dropped messages are still in read markers and inboxes
+	s.lastID = s.store.LastID()
+	log.Println("store: loaded", count, "envelopes")
+	return err
+}
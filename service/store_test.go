@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/milla-v/chat/prot"
+)
+
+func testEnvelope(room, text string, ts time.Time) *prot.Envelope {
+	return &prot.Envelope{Room: room, Message: &prot.Message{Ts: ts, Room: room, Name: "test", Text: text}}
+}
+
+func replayTexts(t *testing.T, s Store) []string {
+	var list []string
+	err := s.Replay(func(e *prot.Envelope) {
+		list = append(list, e.Message.Text)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestLogStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	s, err := OpenLogStore(dir, Retention{MaxCount: 2, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Append(testEnvelope("general", "old", now.Add(-2*time.Hour)))
+	s.Append(testEnvelope("general", "1", now))
+	s.Append(testEnvelope("dev", "2", now))
+	s.Append(testEnvelope("general", "3", now))
+	s.Append(testEnvelope("general", "4", now))
+	s.Close()
+
+	// simulate crash in the middle of the write
+	f, err := os.OpenFile(dir+"/000001.log", os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`0000000 {"envelope":`)
+	f.Close()
+
+	s, err = OpenLogStore(dir, Retention{MaxCount: 2, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Append(testEnvelope("general", "5", now)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = OpenLogStore(dir, Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	list := replayTexts(t, s)
+	expected := []string{"2", "4", "5"}
+	if len(list) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, list)
+	}
+	for i := range list {
+		if list[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, list)
+		}
+	}
+}
+
+func TestLogStoreCompactError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenLogStore(dir, Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Append(testEnvelope("general", "1", time.Now()))
+
+	// next segment cannot be renamed over a non-empty directory
+	if err = os.MkdirAll(dir+"/000002.log/x", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Compact(); err == nil {
+		t.Fatal("compaction succeeded")
+	}
+	os.RemoveAll(dir + "/000002.log")
+
+	if err = s.Append(testEnvelope("general", "2", time.Now())); err != nil {
+		t.Fatal("active segment is closed after failed compaction:", err)
+	}
+	if list := replayTexts(t, s); len(list) != 2 || list[1] != "2" {
+		t.Errorf("replay: %v", list)
+	}
+}
+
+func TestStoreNotServed(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice"}})
+	defer os.RemoveAll(dir)
+
+	// store of older versions is in the web root
+	old, err := OpenLogStore(dir+"/store/", Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := testEnvelope("general", "secret", time.Now())
+	e.Message.ID = 1
+	old.Append(e)
+	old.Close()
+
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	c := newTestClient(t, s.Handler())
+	defer c.ts.Close()
+
+	for _, path := range []string{"/store/", "/store/000001.log", "/" + privateDir + "store/000001.log"} {
+		if code, _ := c.do("GET", path, "", "T1"); code != http.StatusNotFound {
+			t.Errorf("%s: %d", path, code)
+		}
+	}
+	if body := c.history("T1", "secret"); body == "" {
+		t.Error("store is not moved")
+	}
+}
+
+func TestLastIDAfterExpiry(t *testing.T) {
+	srv, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice"}})
+	defer os.RemoveAll(dir)
+	cfg := srv.config()
+
+	s, err := OpenLogStore(cfg.WorkDir+privateDir+"store/", Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().AddDate(-2, 0, 0)
+	for i := int64(1); i <= 5; i++ {
+		e := testEnvelope(defaultRoom, "old", old)
+		e.Message.ID = i
+		s.Append(e)
+	}
+	s.Close()
+
+	// all messages expire on start. Compacted store keeps the last id
+	for i := 0; i < 2; i++ {
+		if err = srv.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err = srv.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+	c := newTestClient(t, srv.Handler())
+	defer c.ts.Close()
+
+	c.do("POST", "/m", "new", "T1")
+	if body := c.history("T1", "new"); !strings.Contains(body, `"id":6,`) || strings.Contains(body, "old") {
+		t.Errorf("history: %s", body)
+	}
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/milla-v/chat/prot"
+)
+
+// threadParent checks that the reply to the message id goes to the same room or private conversation.
+// Reply to a reply goes to the root of the thread.
+func (s *Server) threadParent(id int64, room, from, to string) (int64, error) {
+	if id == 0 {
+		return 0, nil
+	}
+
+	parent, ok := s.index.messages[id]
+	if !ok || parent.Deleted {
+		return 0, errors.New("no such message: " + strconv.FormatInt(id, 10))
+	}
+
+	if parent.Parent != 0 {
+		return s.threadParent(parent.Parent, room, from, to)
+	}
+
+	if to != "" {
+		if privateKey(parent.Name, parent.To) != privateKey(from, to) {
+			return 0, errors.New("message is not in this conversation")
+		}
+		return id, nil
+	}
+
+	if parent.To != "" || parent.Room != room {
+		return 0, errors.New("message is not in room " + room)
+	}
+	return id, nil
+}
+
+// addReply updates thread summary of the reply parent. Returns nil if there is no parent.
+func (s *Server) addReply(msg *prot.Message) *prot.ThreadSummary {
+	if msg.Parent == 0 {
+		return nil
+	}
+
+	parent, ok := s.index.messages[msg.Parent]
+	if !ok {
+		return nil
+	}
+
+	parent.Replies++
+	ts := msg.Ts
+	parent.LastReply = &ts
+	return &prot.ThreadSummary{ID: parent.ID, Replies: parent.Replies, LastReply: ts}
+}
+
+// sendThreadSummary notifies clients about new reply in the thread.
+func (s *Server) sendThreadSummary(msg *prot.Message) {
+	summary := s.addReply(msg)
+	if summary == nil {
+		return
+	}
+
+	e := prot.Envelope{Room: msg.Room, Thread: summary}
+	s.sendToParticipants(msg, &e)
+}
+
+// replyCommand handles "/reply ID TEXT" command.
+func (s *Server) replyCommand(msg *message, arg string) {
+	fields := strings.SplitN(arg, " ", 2)
+	id, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || len(fields) < 2 || strings.TrimSpace(fields[1]) == "" {
+		sendInfo(msg.from, "usage: /reply ID TEXT")
+		return
+	}
+
+	parent, ok := s.index.messages[id]
+	if !ok {
+		sendInfo(msg.from, "no such message: "+fields[0])
+		return
+	}
+
+	reply := *msg
+	reply.text = strings.TrimSpace(fields[1])
+	reply.parent = id
+	reply.room = parent.Room
+	reply.to = nil
+	if parent.To != "" {
+		name := parent.To
+		if name == msg.from.ua.Name {
+			name = parent.Name
+		}
+		if reply.to, err = s.findRecipient(name); err != nil {
+			sendInfo(msg.from, err.Error())
+			return
+		}
+	}
+
+	s.broadcastMessage(&reply)
+}
+
+// broadcastMessage sends the message to the room or to the private recipient.
+func (s *Server) broadcastMessage(msg *message) {
+	room, to := msg.room, ""
+	if msg.to != nil {
+		to = msg.to.ua.Name
+	}
+
+	r, err := s.resolveRoom(msg.from, room)
+	if err != nil && to == "" {
+		log.Println("broadcast:", err)
+		sendInfo(msg.from, err.Error())
+		return
+	}
+	if to == "" {
+		room = r.name
+	}
+
+	parent, err := s.threadParent(msg.parent, room, msg.from.ua.Name, to)
+	if err != nil {
+		log.Println("broadcast:", err)
+		sendInfo(msg.from, err.Error())
+		return
+	}
+
+	msg.parent = parent
+	if to != "" {
+		s.sendPrivate(msg)
+		return
+	}
+	s.sendToRoom(r, msg)
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/milla-v/chat/auth"
+	"github.com/milla-v/chat/prot"
+)
+
+func TestThreadParent(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice", "T2": "bob"}})
+	defer os.RemoveAll(dir)
+
+	s.getRoom(defaultRoom)
+	dev, _ := s.getRoom("dev")
+	var infos []string
+	alice := &client{ua: &auth.UserAuth{Name: "alice", Token: "T1"}, infos: &infos}
+	s.clients = []*client{alice}
+	dev.join(alice)
+
+	post := func(m *message) *prot.Message {
+		infos = nil
+		last := s.lastID
+		s.processMessage(m)
+		if s.lastID == last {
+			return nil
+		}
+		return s.index.messages[s.lastID]
+	}
+
+	root := post(&message{from: alice, text: "root", room: defaultRoom})
+	reply := post(&message{from: alice, text: "reply", room: defaultRoom, parent: root.ID})
+	if reply == nil || reply.Parent != root.ID {
+		t.Fatalf("reply: %+v", reply)
+	}
+
+	// reply to a reply goes to the root
+	nested := post(&message{from: alice, text: "nested", room: defaultRoom, parent: reply.ID})
+	if nested == nil || nested.Parent != root.ID {
+		t.Errorf("reply to reply: %+v", nested)
+	}
+	nested = post(&message{from: alice, text: "/reply " + strconv.FormatInt(reply.ID, 10) + " nested command"})
+	if nested == nil || nested.Parent != root.ID {
+		t.Errorf("/reply to reply: %+v %q", nested, infos)
+	}
+	if root.Replies != 3 || root.LastReply == nil || !root.LastReply.Equal(nested.Ts) || reply.Replies != 0 {
+		t.Errorf("root replies %d %v, reply replies %d", root.Replies, root.LastReply, reply.Replies)
+	}
+
+	tests := []struct {
+		m    *message
+		info string
+	}{
+		{&message{from: alice, text: "missing", room: defaultRoom, parent: nested.ID + 10}, "no such message"},
+		{&message{from: alice, text: "/reply " + strconv.FormatInt(nested.ID+10, 10) + " missing"}, "no such message"},
+		{&message{from: alice, text: "other room", room: "dev", parent: root.ID}, "message is not in room dev"},
+	}
+	for _, tt := range tests {
+		if msg := post(tt.m); msg != nil || len(infos) != 1 || !strings.HasPrefix(infos[0], tt.info) {
+			t.Errorf("%q: posted %+v, infos %q", tt.m.text, msg, infos)
+		}
+	}
+}
+
+func TestThreadReplay(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice"}})
+	defer os.RemoveAll(dir)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	tc := newTestClient(t, s.Handler())
+	defer tc.ts.Close()
+
+	// rootMessage returns the message with the text from the room history.
+	rootMessage := func(text string) *prot.Message {
+		var page prot.HistoryPage
+		json.Unmarshal([]byte(tc.history("T1", text)), &page)
+		for _, m := range page.Messages {
+			if m.Text == text {
+				return m
+			}
+		}
+		t.Fatalf("%q is not in the history", text)
+		return nil
+	}
+
+	tc.do("POST", "/m", "root", "T1")
+	id := strconv.FormatInt(rootMessage("root").ID, 10)
+	tc.do("POST", "/m", "/reply "+id+" first", "T1")
+	tc.do("POST", "/m", "/reply "+id+" second", "T1")
+	tc.do("POST", "/m", "after", "T1")
+	rootMessage("after") // the worker processed the replies
+	before := rootMessage("root")
+
+	var thread prot.HistoryPage
+	_, body := tc.do("GET", "/api/history?parent="+id, "", "T1")
+	json.Unmarshal([]byte(body), &thread)
+	if len(thread.Messages) != 2 || thread.Messages[1].Text != "second" {
+		t.Fatalf("thread: %s", body)
+	}
+	if before.Replies != 2 || before.LastReply == nil || !before.LastReply.Equal(thread.Messages[1].Ts) {
+		t.Errorf("thread summary before restart: %d %v", before.Replies, before.LastReply)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	after := rootMessage("root")
+	if after.Replies != 2 || after.LastReply == nil || !after.LastReply.Equal(*before.LastReply) {
+		t.Errorf("thread summary after restart: %d %v", after.Replies, after.LastReply)
+	}
+}
@@ -0,0 +1,347 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/milla-v/chat/config"
+)
+
+const (
+	certCheckInterval = time.Second * 10     // how often static certificate files are checked for changes
+	selfSignedTTL     = time.Hour * 24 * 365 // validity of generated development certificate
+)
+
+// certReloader serves the certificate from files and reloads it when the files change.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // latest modification time of the files
+	checked time.Time // last check of modification time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// filesTime returns latest modification time of the certificate and key files.
+func (r *certReloader) filesTime() (time.Time, error) {
+	var t time.Time
+	for _, fname := range []string{r.certFile, r.keyFile} {
+		st, err := os.Stat(fname)
+		if err != nil {
+			return t, err
+		}
+		if st.ModTime().After(t) {
+			t = st.ModTime()
+		}
+	}
+	return t, nil
+}
+
+func (r *certReloader) load() error {
+	mt, err := r.filesTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.cert = &cert
+	r.modTime = mt
+	r.checked = time.Now()
+	return nil
+}
+
+// GetCertificate returns current certificate. Old certificate is kept if the new files cannot be loaded.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.checked = time.Now()
+
+	mt, err := r.filesTime()
+	if err != nil || mt.Equal(r.modTime) {
+		return r.cert, nil
+	}
+
+	if err = r.load(); err != nil {
+		log.Println("tls: cannot reload certificate:", err)
+	} else {
+		log.Println("tls: certificate reloaded from", r.certFile)
+	}
+	return r.cert, nil
+}
+
+// reload loads the certificate from the files. Old certificate and files are kept on error.
+func (r *certReloader) reload(certFile, keyFile string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	oldCert, oldKey := r.certFile, r.keyFile
+	r.certFile, r.keyFile = certFile, keyFile
+	if err := r.load(); err != nil {
+		r.certFile, r.keyFile = oldCert, oldKey
+		return err
+	}
+	return nil
+}
+
+// addressHost returns host part of cfg.Address.
+func addressHost(cfg *config.ServiceConfig) string {
+	host, _, err := net.SplitHostPort(cfg.Address)
+	if err != nil {
+		return cfg.Address
+	}
+	return host
+}
+
+// generateSelfSigned creates development certificate and key files for the hosts.
+func generateSelfSigned(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"chat development"}, CommonName: hosts[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedTTL),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// selfSignedCert loads development certificate from cfg.CertPath and generates it on first run.
+func selfSignedCert(cfg *config.ServiceConfig) (*certReloader, error) {
+	if err := os.MkdirAll(cfg.CertPath, 0700); err != nil {
+		return nil, err
+	}
+
+	certFile := cfg.CertPath + "/selfsigned-cert.pem"
+	keyFile := cfg.CertPath + "/selfsigned-key.pem"
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		hosts := append([]string{addressHost(cfg), "localhost", "127.0.0.1", "::1"}, cfg.TLS.Hosts...)
+		if err = generateSelfSigned(certFile, keyFile, hosts); err != nil {
+			return nil, err
+		}
+		log.Println("tls: generated self-signed certificate", certFile, "for", hosts)
+	}
+
+	return newCertReloader(certFile, keyFile)
+}
+
+// acmeManager creates ACME certificate manager for cfg.TLS hosts and directory.
+func acmeManager(cfg *config.ServiceConfig) (*autocert.Manager, error) {
+	hosts := cfg.TLS.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{addressHost(cfg)}
+	}
+
+	m := &autocert.Manager{
+		Cache:      autocert.DirCache(cfg.CertPath),
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Email:      cfg.TLS.Email,
+	}
+
+	if cfg.TLS.Directory == "" && cfg.TLS.DirectoryCA == "" {
+		return m, nil
+	}
+
+	m.Client = &acme.Client{DirectoryURL: cfg.TLS.Directory}
+	if cfg.TLS.DirectoryCA != "" {
+		data, err := ioutil.ReadFile(cfg.TLS.DirectoryCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("tls: no certificates in " + cfg.TLS.DirectoryCA)
+		}
+		m.Client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		}
+	}
+
+	return m, nil
+}
+
+// redirectHandler redirects http requests to https on the public port.
+func (s *Server) redirectHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(cfg.Address); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// setupTLS returns TLS config for cfg.TLS.Mode and the handler for the redirect listener.
+// TLS config is nil in off mode.
+func (s *Server) setupTLS() (*tls.Config, http.Handler, error) {
+	cfg := s.config()
+	switch cfg.TLS.Mode {
+	case config.TLSACME:
+		m, err := acmeManager(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{GetCertificate: m.GetCertificate}, m.HTTPHandler(http.HandlerFunc(s.redirectHandler)), nil
+	case config.TLSStatic:
+		var err error
+		if s.certs, err = newCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile); err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{GetCertificate: s.certs.GetCertificate}, http.HandlerFunc(s.redirectHandler), nil
+	case config.TLSSelfSigned:
+		var err error
+		if s.certs, err = selfSignedCert(cfg); err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{GetCertificate: s.certs.GetCertificate}, http.HandlerFunc(s.redirectHandler), nil
+	case config.TLSOff:
+		return nil, nil, nil
+	}
+	return nil, nil, fmt.Errorf("tls: unknown mode %q", cfg.TLS.Mode)
+}
+
+// proxyHandler applies X-Forwarded-For, X-Forwarded-Host and X-Forwarded-Proto headers
+// of requests from trusted proxies.
+type proxyHandler struct {
+	trusted []*net.IPNet
+	handler http.Handler
+}
+
+func newProxyHandler(proxies []string, h http.Handler) (*proxyHandler, error) {
+	p := &proxyHandler{handler: h}
+	for _, s := range proxies {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("tls: invalid proxy address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			p.trusted = append(p.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("tls: invalid proxy address %q", s)
+		}
+		p.trusted = append(p.trusted, n)
+	}
+	return p, nil
+}
+
+func (p *proxyHandler) isTrusted(addr string) bool {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+	for _, n := range p.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !p.isTrusted(host) {
+		p.handler.ServeHTTP(w, r)
+		return
+	}
+
+	// client is the rightmost address which is not a trusted proxy
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		r.RemoteAddr = net.JoinHostPort(hop, "0")
+		if !p.isTrusted(hop) {
+			break
+		}
+	}
+
+	if h := r.Header.Get("X-Forwarded-Host"); h != "" {
+		r.Host = h
+		r.URL.Host = h
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "https" || proto == "http" {
+		r.URL.Scheme = proto
+	}
+
+	p.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chattls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	if err = generateSelfSigned(certFile, keyFile, []string{"one.example.com", "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf := func() *x509.Certificate {
+		c, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, err := x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return x
+	}
+
+	if x := leaf(); x.DNSNames[0] != "one.example.com" || len(x.IPAddresses) != 1 {
+		t.Errorf("certificate: %v %v", x.DNSNames, x.IPAddresses)
+	}
+
+	if err = generateSelfSigned(certFile, keyFile, []string{"two.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	r.checked = time.Time{}
+	if x := leaf(); x.DNSNames[0] != "two.example.com" {
+		t.Errorf("certificate is not reloaded: %v", x.DNSNames)
+	}
+
+	ioutil.WriteFile(keyFile, []byte("broken"), 0600)
+	os.Chtimes(keyFile, future.Add(time.Minute), future.Add(time.Minute))
+	r.checked = time.Time{}
+	if x := leaf(); x.DNSNames[0] != "two.example.com" {
+		t.Errorf("broken files replaced the certificate: %v", x.DNSNames)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	s, dir := newTestServer(t, Options{})
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		address, url, location string
+	}{
+		{"chat.example.com", "http://chat.example.com/a?b=1", "https://chat.example.com/a?b=1"},
+		{"chat.example.com:8085", "http://chat.example.com:80/", "https://chat.example.com:8085/"},
+		{"chat.example.com:443", "http://other.example.com/x", "https://other.example.com/x"},
+	}
+
+	for _, tt := range tests {
+		c := *s.config()
+		c.Address = tt.address
+		s.cfg.Store(&c)
+		w := httptest.NewRecorder()
+		s.redirectHandler(w, httptest.NewRequest("GET", tt.url, nil))
+		if loc := w.Header().Get("Location"); w.Code != http.StatusMovedPermanently || loc != tt.location {
+			t.Errorf("%s: %d %s, want %s", tt.url, w.Code, loc, tt.location)
+		}
+	}
+}
+
+func TestProxyHandler(t *testing.T) {
+	var got *http.Request
+	p, err := newProxyHandler([]string{"127.0.0.1", "10.0.0.0/8"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newProxyHandler([]string{"bad"}, nil); err == nil {
+		t.Error("invalid proxy is accepted")
+	}
+
+	tests := []struct {
+		remote, xff, addr, host string
+	}{
+		{"127.0.0.1:1000", "1.2.3.4", "1.2.3.4:0", "chat.example.com"},
+		{"127.0.0.1:1000", "6.6.6.6, 1.2.3.4, 10.1.1.1", "1.2.3.4:0", "chat.example.com"},
+		{"5.5.5.5:1000", "1.2.3.4", "5.5.5.5:1000", "internal:8080"},
+		{"127.0.0.1:1000", "", "127.0.0.1:1000", "chat.example.com"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://internal:8080/ws", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		r.Header.Set("X-Forwarded-Host", "chat.example.com")
+		r.Header.Set("X-Forwarded-Proto", "https")
+		p.ServeHTTP(httptest.NewRecorder(), r)
+		if got.RemoteAddr != tt.addr || got.Host != tt.host {
+			t.Errorf("%s %q: %s %s, want %s %s", tt.remote, tt.xff, got.RemoteAddr, got.Host, tt.addr, tt.host)
+		}
+	}
+}
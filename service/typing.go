@@ -0,0 +1,71 @@
+package service
+
+import (
+	"log"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/milla-v/chat/prot"
+)
+
+const (
+	typingInterval = time.Second * 2 // min interval between typing envelopes from one client
+	typingExpiry   = time.Second * 6 // typing indicator lifetime
+)
+
+// typing is a typing notification passed to the worker.
+type typing struct {
+	cli    *client
+	typing prot.Typing
+}
+
+// allowTyping rate limits typing envelopes of the client. Called by the worker which owns
+// lastTypingTime, because the client is reused when it reconnects.
+func allowTyping(cli *client) bool {
+	now := time.Now()
+	if now.Sub(cli.lastTypingTime) < typingInterval {
+		return false
+	}
+	cli.lastTypingTime = now
+	return true
+}
+
+// sendTyping fans out typing indicator to other room members or to the private conversation peer.
+// Typing envelopes of the client are dropped if they come more often than typingInterval.
+func (s *Server) sendTyping(t *typing) {
+	if !allowTyping(t.cli) {
+		return
+	}
+
+	e := prot.Envelope{Typing: &prot.Typing{
+		To:      t.typing.To,
+		Name:    t.cli.ua.Name,
+		Expires: time.Now().Add(typingExpiry),
+	}}
+
+	list := s.clients
+	if t.typing.To == "" {
+		r, err := s.resolveRoom(t.cli, t.typing.Room)
+		if err != nil {
+			return
+		}
+		e.Room = r.name
+		e.Typing.Room = r.name
+		list = r.clients
+	}
+
+	for _, cli := range list {
+		if cli.ws == nil || cli.ua.Name == t.cli.ua.Name {
+			continue
+		}
+		if t.typing.To != "" && cli.ua.Name != t.typing.To {
+			continue
+		}
+
+		err := websocket.JSON.Send(cli.ws, &e)
+		if err != nil {
+			log.Println("send error:", err)
+		}
+	}
+}
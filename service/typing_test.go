@@ -0,0 +1,63 @@
+package service
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/milla-v/chat/prot"
+)
+
+func TestTypingBurst(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice", "T2": "bob"}})
+	defer os.RemoveAll(dir)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	tc := newTestClient(t, s.Handler())
+	defer tc.ts.Close()
+
+	bob := tc.dial("T2")
+	defer bob.Close()
+	alice := tc.dial("T1")
+	defer alice.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := websocket.JSON.Send(alice, &prot.Envelope{Typing: &prot.Typing{Room: defaultRoom}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// bob gets one indicator within the interval
+	n := 0
+	bob.SetReadDeadline(time.Now().Add(typingInterval / 2))
+	for {
+		var e prot.Envelope
+		if err := websocket.JSON.Receive(bob, &e); err != nil {
+			break
+		}
+		if e.Typing != nil {
+			n++
+			if e.Typing.Name != "alice" || e.Typing.Room != defaultRoom {
+				t.Errorf("typing: %+v", e.Typing)
+			}
+		}
+	}
+	if n != 1 {
+		t.Errorf("typing envelopes: %d", n)
+	}
+
+	cli := &client{}
+	if !allowTyping(cli) || allowTyping(cli) {
+		t.Error("second typing within the interval is allowed")
+	}
+	cli.lastTypingTime = time.Now().Add(-typingInterval)
+	if !allowTyping(cli) {
+		t.Error("typing after the interval is not allowed")
+	}
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/milla-v/chat/prot"
+)
+
+// markRead is a mark read request passed to the worker.
+type markRead struct {
+	cli  *client
+	mark prot.MarkRead
+}
+
+func (s *Server) readMarkersFile(name string) string {
+	cfg := s.config()
+	return cfg.WorkDir + privateDir + "read-" + name + ".json"
+}
+
+// userReadMarkers returns read markers of the user. Loads them from the file on first use.
+func (s *Server) userReadMarkers(name string) map[string]int64 {
+	if m, ok := s.readMarkers[name]; ok {
+		return m
+	}
+
+	m := map[string]int64{}
+	data, err := ioutil.ReadFile(s.readMarkersFile(name))
+	if err == nil {
+		err = json.Unmarshal(data, &m)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("read markers:", name, err)
+	}
+
+	s.readMarkers[name] = m
+	return m
+}
+
+func (s *Server) saveReadMarkers(name string) {
+	cfg := s.config()
+	data, err := json.Marshal(s.readMarkers[name])
+	if err != nil {
+		log.Println("read markers:", name, err)
+		return
+	}
+
+	if err = os.MkdirAll(cfg.WorkDir+privateDir, 0700); err != nil {
+		log.Println("read markers:", name, err)
+		return
+	}
+
+	if err = ioutil.WriteFile(s.readMarkersFile(name), data, 0600); err != nil {
+		log.Println("read markers:", name, err)
+	}
+}
+
+func countUnread(h []prot.Envelope, name string, lastRead int64) int {
+	count := 0
+	for _, e := range h {
+		if e.Message == nil || e.Message.ID <= lastRead || e.Message.Name == name || e.Message.Deleted {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// unreadFor counts unread messages in the rooms joined by the user and in private conversations.
+func (s *Server) unreadFor(name string) *prot.Unread {
+	markers := s.userReadMarkers(name)
+	u := &prot.Unread{
+		Rooms:    map[string]int{},
+		Private:  map[string]int{},
+		LastRead: markers,
+	}
+
+	for _, r := range s.rooms {
+		if r.joinedBy(name) {
+			u.Rooms[r.name] = countUnread(r.history, name, markers[r.name])
+		}
+	}
+
+	for _, h := range s.privateHistory {
+		if len(h) == 0 || h[0].Message == nil {
+			continue
+		}
+		peer := h[0].Message.To
+		if peer == name {
+			peer = h[0].Message.Name
+		} else if h[0].Message.Name != name {
+			continue
+		}
+		u.Private[peer] = countUnread(h, name, markers["@"+peer])
+	}
+
+	return u
+}
+
+// sendUnread sends unread counts to all connections of the user.
+func (s *Server) sendUnread(name string) {
+	e := prot.Envelope{Unread: s.unreadFor(name)}
+	for _, cli := range s.clients {
+		if cli.ws == nil || cli.ua.Name != name {
+			continue
+		}
+		err := websocket.JSON.Send(cli.ws, &e)
+		if err != nil {
+			log.Println("send error:", err)
+		}
+	}
+}
+
+// processMarkRead saves the read marker of the joined room or of the private conversation with a user.
+func (s *Server) processMarkRead(req *markRead) {
+	if req.mark.ID <= 0 || req.mark.ID > s.lastID {
+		return
+	}
+
+	name := req.cli.ua.Name
+	key := req.mark.Room
+	if req.mark.To != "" {
+		if req.mark.To == name || !s.users.UserExists(req.mark.To) {
+			return
+		}
+		key = "@" + req.mark.To
+	} else if r, ok := s.rooms[key]; !ok || !r.joinedBy(name) {
+		return
+	}
+
+	markers := s.userReadMarkers(name)
+	if markers[key] >= req.mark.ID {
+		return
+	}
+
+	markers[key] = req.mark.ID
+	s.saveReadMarkers(name)
+	s.sendUnread(name)
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"os"
+	"testing"
+
+	"github.com/milla-v/chat/auth"
+	"github.com/milla-v/chat/prot"
+)
+
+func TestProcessMarkRead(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice", "T2": "bob"}})
+	defer os.RemoveAll(dir)
+
+	s.getRoom(defaultRoom)
+	dev, _ := s.getRoom("dev")
+	s.getRoom("secret")
+	alice := &client{ua: &auth.UserAuth{Name: "alice", Token: "T1"}}
+	dev.join(alice)
+	s.lastID = 10
+
+	tests := []struct {
+		room, to string
+		ok       bool
+	}{
+		{defaultRoom, "", true},
+		{"dev", "", true},
+		{"secret", "", false},
+		{"nosuch", "", false},
+		{"", "", false},
+		{"", "bob", true},
+		{"", "nobody", false},
+		{"", "alice", false},
+	}
+
+	for i, tt := range tests {
+		id := int64(i + 1)
+		s.processMarkRead(&markRead{cli: alice, mark: prot.MarkRead{Room: tt.room, To: tt.to, ID: id}})
+		key := tt.room
+		if tt.to != "" {
+			key = "@" + tt.to
+		}
+		if got := s.userReadMarkers("alice")[key] == id; got != tt.ok {
+			t.Errorf("%q %q: saved %v, want %v", tt.room, tt.to, got, tt.ok)
+		}
+	}
+
+	s.processMarkRead(&markRead{cli: alice, mark: prot.MarkRead{Room: "dev", ID: 11}})
+	if s.userReadMarkers("alice")["dev"] != 2 {
+		t.Error("marker after the last message is saved")
+	}
+	if len(s.userReadMarkers("alice")) != 3 {
+		t.Errorf("markers: %v", s.userReadMarkers("alice"))
+	}
+}
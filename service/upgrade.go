@@ -0,0 +1,265 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	upgradeListenersEnv = "CHAT_UPGRADE_LISTENERS" // comma separated names of inherited listeners. Files start at fd 3
+	upgradeStateEnv     = "CHAT_UPGRADE_STATE"     // state file written by the old process
+	upgradeReadyEnv     = "CHAT_UPGRADE_READY"     // fd of the pipe closed by the new process when it serves
+	upgradeTimeout      = time.Second * 30         // max wait for the new process
+)
+
+// upgradeClient is a connected client passed to the new process.
+type upgradeClient struct {
+	Name  string   `json:"name"`
+	Token string   `json:"token"`
+	Room  string   `json:"room"`  // current room
+	Rooms []string `json:"rooms"` // joined rooms
+}
+
+// upgradeState is a snapshot of the hub passed to the new process.
+type upgradeState struct {
+	Version string          `json:"version"`
+	LastID  int64           `json:"last_id"` // history cursor: id of the last stored message
+	Clients []upgradeClient `json:"clients"` // roster
+}
+
+// snapshot returns the upgrade state. Called by the worker before it stops.
+func (s *Server) snapshot() *upgradeState {
+	st := &upgradeState{Version: version, LastID: s.lastID}
+	for _, cli := range s.clients {
+		if cli.ua == nil || cli.ua.Token == "" {
+			continue
+		}
+		uc := upgradeClient{Name: cli.ua.Name, Token: cli.ua.Token, Rooms: s.joinedRooms(cli)}
+		if cli.room != nil {
+			uc.Room = cli.room.name
+		}
+		st.Clients = append(st.Clients, uc)
+	}
+	return st
+}
+
+func (s *Server) upgradeStateFile() string {
+	cfg := s.config()
+	return cfg.WorkDir + privateDir + "upgrade.json"
+}
+
+// loadInherited opens listeners passed by the old process.
+func (s *Server) loadInherited() error {
+	names := os.Getenv(upgradeListenersEnv)
+	os.Unsetenv(upgradeListenersEnv)
+	if names == "" {
+		return nil
+	}
+
+	for i, name := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(3+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("upgrade: listener %s: %v", name, err)
+		}
+		s.inherited[name] = l
+	}
+	return nil
+}
+
+// listen returns the inherited listener or listens on the address.
+func (s *Server) listen(name, addr string) (net.Listener, error) {
+	if l, ok := s.inherited[name]; ok {
+		delete(s.inherited, name)
+		log.Println("upgrade: inherited listener", name, l.Addr())
+		return l, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// restoreUpgrade restores the roster from the old process state. Restored clients
+// have no connection until they reconnect and are removed by expireRestored.
+func (s *Server) restoreUpgrade() {
+	fname := os.Getenv(upgradeStateEnv)
+	os.Unsetenv(upgradeStateEnv)
+	if fname == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(fname)
+	os.Remove(fname)
+	var st upgradeState
+	if err == nil {
+		err = json.Unmarshal(data, &st)
+	}
+	if err != nil {
+		log.Println("upgrade: cannot load state:", err)
+		return
+	}
+
+	if s.lastID < st.LastID {
+		log.Printf("upgrade: history cursor %d is behind the old process %d", s.lastID, st.LastID)
+	}
+
+	joined := false
+	for _, uc := range st.Clients {
+		if _, err := s.findClient(uc.Token); err == nil {
+			continue
+		}
+		ua, err := s.users.GetAuthUser(uc.Token)
+		if err != nil {
+			log.Println("upgrade: cannot restore client:", err)
+			continue
+		}
+
+		cli := &client{ua: ua}
+		s.clients = append(s.clients, cli)
+		joined = s.rooms[defaultRoom].join(cli) || joined
+		for _, name := range append(uc.Rooms, uc.Room) {
+			if r, err := s.getRoom(name); err == nil {
+				joined = r.join(cli) || joined
+			}
+		}
+	}
+	if joined {
+		// members of the old process without the rooms file
+		s.saveRooms()
+	}
+	log.Printf("upgrade: restored %d clients from version %s", len(st.Clients), st.Version)
+}
+
+// expireRestored removes restored clients which did not reconnect.
+func (s *Server) expireRestored() {
+	var connected []*client
+	for _, cli := range s.clients {
+		if cli.ws != nil {
+			connected = append(connected, cli)
+			continue
+		}
+		for _, r := range s.rooms {
+			r.leave(cli)
+		}
+	}
+
+	if len(connected) != len(s.clients) {
+		s.clients = connected
+		s.broadcastRoster()
+	}
+}
+
+// notifyReady tells the old process that this process serves.
+func notifyReady() {
+	fd := os.Getenv(upgradeReadyEnv)
+	os.Unsetenv(upgradeReadyEnv)
+	if fd == "" {
+		return
+	}
+
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		log.Println("upgrade:", err)
+		return
+	}
+	f := os.NewFile(uintptr(n), "ready")
+	f.Write([]byte("ready\n"))
+	f.Close()
+}
+
+// listenerFile returns a duplicate file of the listener which stays open after the listener is closed.
+func listenerFile(l net.Listener) (*os.File, error) {
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil, errors.New("upgrade: not a tcp listener")
+	}
+	return tl.File()
+}
+
+// checkExecutable runs the new binary with -version before the upgrade.
+func (s *Server) checkExecutable() error {
+	cmd := exec.Command(s.executable, "-version")
+	done := make(chan error, 1)
+	var out []byte
+	go func() {
+		var err error
+		out, err = cmd.Output()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("upgrade: %s -version: %v", s.executable, err)
+		}
+		log.Printf("upgrade: new binary %s", strings.TrimSpace(string(out)))
+		return nil
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("upgrade: %s -version timed out", s.executable)
+	}
+}
+
+// writeUpgradeState writes the state file read by restoreUpgrade.
+func (s *Server) writeUpgradeState(st *upgradeState) error {
+	cfg := s.config()
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(cfg.WorkDir+privateDir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.upgradeStateFile(), data, 0600)
+}
+
+// startUpgraded writes the state and starts the new process with the listener files.
+// It returns when the new process is ready. The new process is killed if it is not ready.
+func (s *Server) startUpgraded(st *upgradeState, names []string, files []*os.File) error {
+	if err := s.writeUpgradeState(st); err != nil {
+		return err
+	}
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	env := os.Environ()
+	env = append(env,
+		upgradeListenersEnv+"="+strings.Join(names, ","),
+		upgradeStateEnv+"="+s.upgradeStateFile(),
+		upgradeReadyEnv+"="+strconv.Itoa(3+len(files)),
+	)
+
+	attr := &os.ProcAttr{
+		Env:   env,
+		Files: append(append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...), readyW),
+	}
+	p, err := os.StartProcess(s.executable, os.Args, attr)
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	log.Println("upgrade: started new process", p.Pid)
+
+	ready.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	buf := make([]byte, 16)
+	if n, err := ready.Read(buf); err != nil || string(buf[:n]) != "ready\n" {
+		p.Kill()
+		p.Wait()
+		return fmt.Errorf("upgrade: new process %d is not ready: %v", p.Pid, err)
+	}
+
+	p.Release()
+	return nil
+}
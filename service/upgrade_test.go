@@ -0,0 +1,131 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/milla-v/chat/auth"
+	"github.com/milla-v/chat/prot"
+)
+
+func TestUpgradeState(t *testing.T) {
+	s, dir := newTestServer(t, Options{})
+	defer os.RemoveAll(dir)
+	cfg := s.config()
+	s.lastID = 42
+
+	ioutil.WriteFile(cfg.WorkDir+"user-bob.txt", []byte("bob pw bob@example.com\n"), 0600)
+	ioutil.WriteFile(cfg.WorkDir+"token-TOK.txt", []byte("bob 2026-01-01T00:00:00Z\n"), 0600)
+
+	general, _ := s.getRoom(defaultRoom)
+	dev, _ := s.getRoom("dev")
+	bob := &client{ua: &auth.UserAuth{Name: "bob", Token: "TOK"}}
+	anon := &client{ua: &auth.UserAuth{Name: "bot"}}
+	s.clients = []*client{bob, anon}
+	general.join(bob)
+	dev.join(bob)
+
+	st := s.snapshot()
+	if st.LastID != 42 || len(st.Clients) != 1 || st.Clients[0].Room != "dev" || len(st.Clients[0].Rooms) != 2 {
+		t.Fatalf("snapshot: %+v", st)
+	}
+
+	data, _ := json.Marshal(st)
+	os.MkdirAll(cfg.WorkDir+privateDir, 0700)
+	ioutil.WriteFile(s.upgradeStateFile(), data, 0600)
+	os.Setenv(upgradeStateEnv, s.upgradeStateFile())
+	defer os.Unsetenv(upgradeStateEnv)
+
+	s.rooms = map[string]*room{}
+	s.clients = nil
+	s.getRoom(defaultRoom)
+	s.restoreUpgrade()
+
+	if len(s.clients) != 1 || s.clients[0].ua.Name != "bob" || s.clients[0].ws != nil {
+		t.Fatalf("restored clients: %+v", s.clients)
+	}
+	if cli := s.clients[0]; cli.room != s.rooms["dev"] || !s.rooms[defaultRoom].has(cli) {
+		t.Errorf("restored rooms: %v", s.joinedRooms(cli))
+	}
+	if _, err := os.Stat(s.upgradeStateFile()); !os.IsNotExist(err) {
+		t.Error("state file is not removed")
+	}
+
+	cli, err := s.findClient("TOK")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.expireRestored()
+	if len(s.clients) != 0 || s.rooms["dev"].has(cli) {
+		t.Errorf("restored client is not expired: %d", len(s.clients))
+	}
+}
+
+func TestUpgradeFailure(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice"}})
+	defer os.RemoveAll(dir)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// new binary passes the version check and exits without serving
+	s.executable = dir + "/chatd"
+	script := "#!/bin/sh\nif [ \"$1\" = -version ]; then echo version: test; exit 0; fi\nexit 1\n"
+	if err := ioutil.WriteFile(s.executable, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &listener{name: "http", l: nl, server: &http.Server{Handler: s.Handler()}}
+	listeners := []*listener{l}
+	serveErr := make(chan error, 1)
+	go l.serve(serveErr)
+	defer s.shutdown(false, listeners)
+
+	url := "http://" + nl.Addr().String()
+	wc, err := websocket.NewConfig("ws://"+nl.Addr().String()+"/ws", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc.Header.Set("Token", "T1")
+	ws, err := websocket.DialConfig(wc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	var e prot.Envelope
+	if err = websocket.JSON.Receive(ws, &e); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.upgrade(listeners, serveErr); err == nil {
+		t.Fatal("failed upgrade returns no error")
+	}
+
+	resp, err := http.Get(url + "/ver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status after failed upgrade: %s", resp.Status)
+	}
+	if _, err = os.Stat(s.upgradeStateFile()); !os.IsNotExist(err) {
+		t.Error("snapshot is not restored")
+	}
+	select {
+	case err = <-serveErr:
+		t.Error(err)
+	default:
+	}
+}
@@ -0,0 +1,287 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/milla-v/chat/auth"
+	"github.com/milla-v/chat/config"
+	"github.com/milla-v/chat/prot"
+)
+
+const (
+	webhookTimeout      = time.Second * 5 // default outgoing webhook request timeout
+	maxWebhookResponse  = 64 * 1024       // max webhook response body size
+	webhookSignatureHdr = "X-Chat-Signature"
+	webhookTimestampHdr = "X-Chat-Timestamp"
+)
+
+var webhookRetryDelay = time.Second // delay before the first retry. Doubled for every next retry
+
+// webhookSignature returns "sha256=" prefixed hex HMAC-SHA256 of the timestamp, "." and the body.
+func webhookSignature(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// matchWebhook checks if the room message triggers the webhook. Returns matched trigger word or mention.
+func matchWebhook(h *config.OutgoingWebhook, room, text string) (trigger string, ok bool) {
+	if len(h.Rooms) > 0 {
+		found := false
+		for _, r := range h.Rooms {
+			if r == room {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", false
+		}
+	}
+
+	if len(h.Triggers) == 0 && !h.Mention {
+		return "", true
+	}
+
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return "", false
+	}
+
+	for _, t := range h.Triggers {
+		if strings.EqualFold(words[0], t) {
+			return t, true
+		}
+	}
+
+	if h.Mention {
+		mention := "@" + h.Name
+		for _, w := range words {
+			if strings.EqualFold(strings.TrimRight(w, ".,:;!?"), mention) {
+				return mention, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// callWebhook posts the request to the webhook url and returns the reply.
+// Retries on network errors and server errors.
+func callWebhook(h *config.OutgoingWebhook, req *prot.WebhookRequest) (*prot.WebhookResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := webhookTimeout
+	if h.Timeout > 0 {
+		timeout = time.Duration(h.Timeout) * time.Second
+	}
+	hc := &http.Client{Timeout: timeout}
+
+	delay := webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		var reply *prot.WebhookResponse
+		var retry bool
+		reply, retry, err = postWebhook(hc, h, body)
+		if err == nil || !retry || attempt >= h.Retries {
+			return reply, err
+		}
+		log.Println("webhook:", h.Name, err, "retry in", delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// postWebhook makes single webhook request. Returns true retry flag if the request can be repeated.
+func postWebhook(hc *http.Client, h *config.OutgoingWebhook, body []byte) (reply *prot.WebhookResponse, retry bool, err error) {
+	hreq, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set(webhookTimestampHdr, ts)
+	hreq.Header.Set(webhookSignatureHdr, webhookSignature(h.Secret, ts, body))
+
+	resp, err := hc.Do(hreq)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxWebhookResponse))
+	if err != nil {
+		return nil, true, err
+	}
+
+	if resp.StatusCode >= 500 {
+		return nil, true, errors.New("webhook: " + resp.Status)
+	}
+	if resp.StatusCode >= 300 {
+		return nil, false, errors.New("webhook: " + resp.Status)
+	}
+
+	var wr prot.WebhookResponse
+	if len(bytes.TrimSpace(data)) == 0 {
+		return &wr, false, nil
+	}
+
+	if err = json.Unmarshal(data, &wr); err != nil {
+		return nil, false, fmt.Errorf("webhook: bad response: %v", err)
+	}
+	wr.Text = strings.TrimSpace(wr.Text)
+	return &wr, false, nil
+}
+
+// outgoingWebhook returns the outgoing webhook of the bot or nil.
+func (s *Server) outgoingWebhook(name string) *config.OutgoingWebhook {
+	for _, h := range s.config().OutgoingWebhooks {
+		if h.Name == name {
+			return &h
+		}
+	}
+	return nil
+}
+
+// isOutgoingBot checks if the name is a bot name of an outgoing webhook.
+func (s *Server) isOutgoingBot(name string) bool {
+	return s.outgoingWebhook(name) != nil
+}
+
+// runWebhook calls the webhook and posts its reply to the room as the bot.
+// Reply buttons are handled by the webhook, see clickWebhook.
+func (s *Server) runWebhook(h config.OutgoingWebhook, req *prot.WebhookRequest) {
+	reply, err := callWebhook(&h, req)
+	if err != nil {
+		log.Println("webhook:", h.Name, err)
+		return
+	}
+	text := reply.Text
+	if text == "" {
+		return
+	}
+
+	if strings.HasPrefix(text, "/") {
+		// bots cannot run commands. Send the text as is.
+		text = "/" + text
+	}
+
+	bot := &client{ua: &auth.UserAuth{Name: h.Name}}
+	m := &message{from: bot, text: html.EscapeString(text), room: req.Room, webhook: true}
+	for _, b := range reply.Buttons {
+		if b = strings.TrimSpace(b); b != "" {
+			m.buttons = append(m.buttons, html.EscapeString(b))
+		}
+	}
+	if len(m.buttons) > 0 {
+		m.bot = h.Name
+	}
+
+	if err = s.send(m); err != nil {
+		log.Println("webhook:", h.Name, err)
+	}
+}
+
+// webhookClick is a webhook reply to the button click passed to the worker.
+type webhookClick struct {
+	id     int64  // message id
+	name   string // user who clicked
+	click  int    // button number
+	result string // reply text
+}
+
+// clickWebhook posts the click on the button of the bot message to the webhook of the bot in background.
+// Non-empty reply text becomes the message action result.
+func (s *Server) clickWebhook(cli *client, msg *prot.Message, click int) {
+	h := s.outgoingWebhook(msg.Bot)
+	if h == nil {
+		sendInfo(cli, "no action handler: "+msg.Bot)
+		return
+	}
+
+	req := &prot.WebhookRequest{
+		ID:    msg.ID,
+		Ts:    msg.Ts,
+		Room:  msg.Room,
+		Name:  cli.ua.Name,
+		Text:  html.UnescapeString(msg.Text),
+		Click: click,
+	}
+	go func() {
+		reply, err := callWebhook(h, req)
+		if err != nil {
+			log.Println("webhook:", h.Name, err)
+			return
+		}
+		if reply.Text == "" {
+			return
+		}
+		select {
+		case s.clickChan <- &webhookClick{id: req.ID, name: req.Name, click: click, result: html.EscapeString(reply.Text)}:
+		case <-s.workerDone():
+		}
+	}()
+}
+
+// processWebhookClick applies the webhook reply to the click.
+func (s *Server) processWebhookClick(c *webhookClick) {
+	msg, ok := s.index.messages[c.id]
+	if !ok || msg.Deleted {
+		return
+	}
+	s.applyAction(msg, c.name, c.click, c.result)
+}
+
+// dispatchWebhooks starts matching outgoing webhooks for the room message.
+// Messages of webhook bots are skipped to avoid loops. Bots with names of users
+// or incoming webhooks are skipped, so they cannot post as somebody else.
+func (s *Server) dispatchWebhooks(msg *prot.Message) {
+	cfg := s.config()
+	if msg.To != "" || msg.Webhook {
+		return
+	}
+
+	text := html.UnescapeString(msg.Text)
+	for _, h := range cfg.OutgoingWebhooks {
+		if len(h.Name) < 3 {
+			log.Println("webhook: bot name is too short:", h.Name)
+			continue
+		}
+		if _, ok := s.incomingHooks[h.Name]; ok || s.users.UserExists(h.Name) {
+			log.Println("webhook: bot name is already taken:", h.Name)
+			continue
+		}
+
+		trigger, ok := matchWebhook(&h, msg.Room, text)
+		if !ok {
+			continue
+		}
+
+		req := &prot.WebhookRequest{
+			ID:      msg.ID,
+			Ts:      msg.Ts,
+			Room:    msg.Room,
+			Name:    msg.Name,
+			Text:    text,
+			Trigger: trigger,
+		}
+		go s.runWebhook(h, req)
+	}
+}
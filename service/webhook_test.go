@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/milla-v/chat/auth"
+	"github.com/milla-v/chat/config"
+	"github.com/milla-v/chat/prot"
+)
+
+func TestMatchWebhook(t *testing.T) {
+	h := &config.OutgoingWebhook{
+		Name:     "weatherbot",
+		Triggers: []string{"!weather"},
+		Rooms:    []string{"general", "dev"},
+		Mention:  true,
+	}
+
+	tests := []struct {
+		room    string
+		text    string
+		trigger string
+		ok      bool
+	}{
+		{"general", "!weather Boston", "!weather", true},
+		{"dev", "!WEATHER", "!weather", true},
+		{"general", "what is the weather?", "", false},
+		{"general", "hi @weatherbot, rain today?", "@weatherbot", true},
+		{"random", "!weather Boston", "", false},
+		{"general", "", "", false},
+	}
+
+	for _, tt := range tests {
+		trigger, ok := matchWebhook(h, tt.room, tt.text)
+		if trigger != tt.trigger || ok != tt.ok {
+			t.Errorf("%s %q: got %q %v, want %q %v", tt.room, tt.text, trigger, ok, tt.trigger, tt.ok)
+		}
+	}
+
+	all := &config.OutgoingWebhook{Name: "logbot", Rooms: []string{"dev"}}
+	if _, ok := matchWebhook(all, "dev", "anything"); !ok {
+		t.Error("room webhook does not match")
+	}
+}
+
+func TestCallWebhook(t *testing.T) {
+	webhookRetryDelay = time.Millisecond
+	calls := 0
+	errs := make(chan error, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			errs <- err
+			return
+		}
+		ts := r.Header.Get(webhookTimestampHdr)
+		if sig := r.Header.Get(webhookSignatureHdr); sig != webhookSignature("secret", ts, body) {
+			errs <- errors.New("bad signature: " + sig)
+		}
+		if sec, err := strconv.ParseInt(ts, 10, 64); err != nil || time.Since(time.Unix(sec, 0)) > prot.WebhookReplayWindow {
+			errs <- errors.New("bad timestamp: " + ts)
+		}
+
+		if calls == 1 {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req prot.WebhookRequest
+		if err = json.Unmarshal(body, &req); err != nil {
+			errs <- err
+			return
+		}
+		json.NewEncoder(w).Encode(&prot.WebhookResponse{Text: "echo: " + req.Text})
+	}))
+	defer srv.Close()
+
+	h := &config.OutgoingWebhook{Name: "echobot", URL: srv.URL, Secret: "secret", Retries: 2}
+	reply, err := callWebhook(h, &prot.WebhookRequest{ID: 1, Room: "general", Name: "test", Text: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Text != "echo: hello" {
+		t.Errorf("reply: %q", reply.Text)
+	}
+	if calls != 2 {
+		t.Errorf("calls: %d, want 2", calls)
+	}
+
+	calls = 0
+	h.Retries = 0
+	if _, err = callWebhook(h, &prot.WebhookRequest{Text: "hello"}); err == nil {
+		t.Error("no error without retries")
+	}
+
+	for len(errs) > 0 {
+		t.Error(<-errs)
+	}
+}
+
+func TestDispatchWebhooks(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"t1": "alice"}})
+	defer os.RemoveAll(dir)
+
+	calls := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- r.URL.Path
+	}))
+	defer srv.Close()
+
+	c := *s.config()
+	c.OutgoingWebhooks = []config.OutgoingWebhook{
+		{Name: "alice", URL: srv.URL + "/alice"},
+		{Name: "hookbot", URL: srv.URL + "/hookbot"},
+		{Name: "echobot", URL: srv.URL + "/echobot"},
+	}
+	s.cfg.Store(&c)
+	s.incomingHooks["hookbot"] = &incomingHook{Name: "hookbot"}
+	if _, err := s.getRoom(defaultRoom); err != nil {
+		t.Fatal(err)
+	}
+
+	s.dispatchWebhooks(&prot.Message{ID: 1, Room: defaultRoom, Name: "alice", Text: "hello"})
+	select {
+	case path := <-calls:
+		if path != "/echobot" {
+			t.Errorf("webhook with taken name is called: %s", path)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("webhook is not called")
+	}
+	select {
+	case path := <-calls:
+		t.Errorf("webhook with taken name is called: %s", path)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	if _, err := s.addIncomingHook("alice", defaultRoom, "echobot", ""); err == nil {
+		t.Error("incoming webhook with the outgoing bot name is added")
+	}
+}
+
+func TestCallWebhookTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond * 1500)
+	}))
+	defer srv.Close()
+
+	h := &config.OutgoingWebhook{Name: "slowbot", URL: srv.URL, Timeout: 1}
+	if _, err := callWebhook(h, &prot.WebhookRequest{Text: "hello"}); err == nil {
+		t.Error("no timeout error")
+	}
+}
+
+func TestWebhookClick(t *testing.T) {
+	s, dir := newTestServer(t, Options{Auth: testAuth{"T1": "alice"}})
+	defer os.RemoveAll(dir)
+
+	clicks := make(chan *prot.WebhookRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req prot.WebhookRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Click == 0 {
+			json.NewEncoder(w).Encode(&prot.WebhookResponse{Text: "pick one", Buttons: []string{"<a>", " ", "b"}})
+			return
+		}
+		clicks <- &req
+		json.NewEncoder(w).Encode(&prot.WebhookResponse{Text: req.Name + " picked " + strconv.Itoa(req.Click)})
+	}))
+	defer srv.Close()
+
+	c := *s.config()
+	c.OutgoingWebhooks = []config.OutgoingWebhook{{Name: "quizbot", URL: srv.URL, Triggers: []string{"!quiz"}}}
+	s.cfg.Store(&c)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	tc := newTestClient(t, s.Handler())
+	defer tc.ts.Close()
+
+	tc.do("POST", "/m", "!quiz", "T1")
+	var page prot.HistoryPage
+	json.Unmarshal([]byte(tc.history("T1", "pick one")), &page)
+	var msg *prot.Message
+	for _, m := range page.Messages {
+		if m.Name == "quizbot" {
+			msg = m
+		}
+	}
+	if msg == nil || msg.Bot != "quizbot" || len(msg.Buttons) != 2 || msg.Buttons[0] != "&lt;a&gt;" {
+		t.Fatalf("bot message: %+v", msg)
+	}
+
+	alice := &client{ua: &auth.UserAuth{Name: "alice", Token: "T1"}}
+	s.actionChan <- &actionRequest{cli: alice, action: prot.Action{ID: msg.ID, Click: 2}}
+	select {
+	case req := <-clicks:
+		if req.ID != msg.ID || req.Name != "alice" || req.Text != "pick one" {
+			t.Errorf("click request: %+v", req)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("click is not posted to the webhook")
+	}
+
+	if tc.history("T1", `"result":"alice picked 2"`) == "" {
+		t.Error("click result is not applied")
+	}
+}